@@ -0,0 +1,147 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package cell defines the fixed-size cells all traffic of a circuit is
+// carried in, so relayed messages do not leak their size.
+//
+// A cell is Size bytes:
+//
+//	| command (1) | stream ID (4) | payload length (2) | payload | zero padding |
+//
+// Integers are big endian. Padding must be zero so every cell has
+// exactly one encoding.
+package cell
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	Size       = 1024
+	HeaderSize = 1 + 4 + 2
+	MaxPayload = Size - HeaderSize
+)
+
+type Command uint8
+
+const (
+	Padding Command = iota // ignored by the receiver
+	Data                   // stream data
+	End                    // end of stream
+	Control                // JSON control message, see node/control.go
+
+	numCommands
+)
+
+var (
+	ErrSize        = errors.New("cell size mismatch")
+	ErrPayloadSize = errors.New("cell payload too large")
+	ErrCommand     = errors.New("unknown cell command")
+	ErrPadding     = errors.New("non-zero cell padding")
+)
+
+func (c Command) String() string {
+	switch c {
+	case Padding:
+		return "padding"
+	case Data:
+		return "data"
+	case End:
+		return "end"
+	case Control:
+		return "control"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(c))
+}
+
+type Cell struct {
+	Command  Command
+	StreamID uint32
+	Payload  []byte
+}
+
+func New(cmd Command, streamID uint32, payload []byte) (*Cell, error) {
+	if cmd >= numCommands {
+		return nil, ErrCommand
+	}
+	if len(payload) > MaxPayload {
+		return nil, ErrPayloadSize
+	}
+	return &Cell{cmd, streamID, payload}, nil
+}
+
+// Encode returns the Size bytes encoding of c
+func (c *Cell) Encode() ([]byte, error) {
+	if c.Command >= numCommands {
+		return nil, ErrCommand
+	}
+	if len(c.Payload) > MaxPayload {
+		return nil, ErrPayloadSize
+	}
+	b := make([]byte, Size)
+	b[0] = byte(c.Command)
+	binary.BigEndian.PutUint32(b[1:5], c.StreamID)
+	binary.BigEndian.PutUint16(b[5:7], uint16(len(c.Payload)))
+	copy(b[HeaderSize:], c.Payload)
+	return b, nil
+}
+
+// Decode decodes a cell encoded with Encode. The payload of the
+// returned cell is a copy.
+func Decode(b []byte) (*Cell, error) {
+	if len(b) != Size {
+		return nil, ErrSize
+	}
+	cmd := Command(b[0])
+	if cmd >= numCommands {
+		return nil, ErrCommand
+	}
+	n := int(binary.BigEndian.Uint16(b[5:7]))
+	if n > MaxPayload {
+		return nil, ErrPayloadSize
+	}
+	for _, p := range b[HeaderSize+n:] {
+		if p != 0 {
+			return nil, ErrPadding
+		}
+	}
+	payload := make([]byte, n)
+	copy(payload, b[HeaderSize:HeaderSize+n])
+	return &Cell{cmd, binary.BigEndian.Uint32(b[1:5]), payload}, nil
+}
+
+// Split splits data into as few cells of cmd as possible
+func Split(cmd Command, streamID uint32, data []byte) ([]*Cell, error) {
+	cells := []*Cell{}
+	for len(data) > 0 {
+		n := len(data)
+		if n > MaxPayload {
+			n = MaxPayload
+		}
+		c, err := New(cmd, streamID, data[:n])
+		if err != nil {
+			return nil, err
+		}
+		cells = append(cells, c)
+		data = data[n:]
+	}
+	return cells, nil
+}
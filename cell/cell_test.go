@@ -0,0 +1,151 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cell
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	for _, payload := range [][]byte{{}, []byte("foobar"), bytes.Repeat([]byte{42}, MaxPayload)} {
+		c, err := New(Data, 7, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := c.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) != Size {
+			t.Fatalf("unexpected encoded size: %d", len(b))
+		}
+		c1, err := Decode(b)
+		if err != nil {
+			t.Fatalf("Decode err: %v", err)
+		}
+		if c1.Command != Data || c1.StreamID != 7 || !bytes.Equal(c1.Payload, payload) {
+			t.Fatalf("unexpected decoded cell: %v", c1)
+		}
+	}
+
+	_, err := New(Data, 0, make([]byte, MaxPayload+1))
+	if err != ErrPayloadSize {
+		t.Fatalf("unexpected New err: %v", err)
+	}
+	_, err = New(numCommands, 0, nil)
+	if err != ErrCommand {
+		t.Fatalf("unexpected New err: %v", err)
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	c, err := New(Control, 1, []byte("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, err := c.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(b []byte) []byte
+		err    error
+	}{
+		{"short", func(b []byte) []byte { return b[:Size-1] }, ErrSize},
+		{"long", func(b []byte) []byte { return append(b, 0) }, ErrSize},
+		{"command", func(b []byte) []byte { b[0] = byte(numCommands); return b }, ErrCommand},
+		{"length", func(b []byte) []byte { b[5], b[6] = 0xff, 0xff; return b }, ErrPayloadSize},
+		{"padding", func(b []byte) []byte { b[Size-1] = 1; return b }, ErrPadding},
+	}
+	for _, test := range tests {
+		b := test.modify(append([]byte{}, valid...))
+		_, err := Decode(b)
+		if err != test.err {
+			t.Fatalf("%s: unexpected err: %v", test.name, err)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), MaxPayload/4)
+	cells, err := Split(Data, 3, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cells) != 3 {
+		t.Fatalf("unexpected number of cells: %d", len(cells))
+	}
+	joined := []byte{}
+	for _, c := range cells {
+		joined = append(joined, c.Payload...)
+	}
+	if !bytes.Equal(joined, data) {
+		t.Fatalf("split cells do not join to data")
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	c, _ := New(Data, 1, []byte("foobar"))
+	b, _ := c.Encode()
+	f.Add(b)
+	f.Add(make([]byte, Size))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		c, err := Decode(b)
+		if err != nil {
+			return
+		}
+		// the encoding of a cell is unique
+		b1, err := c.Encode()
+		if err != nil {
+			t.Fatalf("Encode of decoded cell err: %v", err)
+		}
+		if !bytes.Equal(b, b1) {
+			t.Fatalf("re-encoded cell differs")
+		}
+	})
+}
+
+func FuzzEncode(f *testing.F) {
+	f.Add(uint8(Data), uint32(1), []byte("foobar"))
+	f.Add(uint8(Control), uint32(0), []byte{})
+
+	f.Fuzz(func(t *testing.T, cmd uint8, streamID uint32, payload []byte) {
+		c, err := New(Command(cmd), streamID, payload)
+		if err != nil {
+			return
+		}
+		b, err := c.Encode()
+		if err != nil {
+			t.Fatalf("Encode err: %v", err)
+		}
+		c1, err := Decode(b)
+		if err != nil {
+			t.Fatalf("Decode err: %v", err)
+		}
+		if c1.Command != c.Command || c1.StreamID != streamID || !bytes.Equal(c1.Payload, payload) {
+			t.Fatalf("round trip mismatch")
+		}
+	})
+}
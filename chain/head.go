@@ -0,0 +1,103 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package chain provides the Ethereum chain head to nodes, which stamp
+// their BackResponses with it to prove their recency (see p2p/backresponse.go).
+package chain
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// HeadProvider returns the number of the latest block of the chain.
+// Satisfied by *ethclient.Client.
+type HeadProvider interface {
+	BlockNumber(ctx context.Context) (uint64, error)
+}
+
+// DialRPC connects to the Ethereum JSON-RPC endpoint at url
+func DialRPC(url string) (HeadProvider, error) {
+	return ethclient.Dial(url)
+}
+
+// CachedHead asks its provider for the head at most once per maxAge,
+// so nodes do not make an RPC call for every offer they answer.
+type CachedHead struct {
+	provider HeadProvider
+	maxAge   time.Duration
+
+	mutex   sync.Mutex
+	head    uint64
+	fetched time.Time
+}
+
+func NewCachedHead(provider HeadProvider, maxAge time.Duration) *CachedHead {
+	return &CachedHead{provider: provider, maxAge: maxAge}
+}
+
+func (c *CachedHead) BlockNumber(ctx context.Context) (uint64, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.fetched.IsZero() && time.Since(c.fetched) < c.maxAge {
+		return c.head, nil
+	}
+	head, err := c.provider.BlockNumber(ctx)
+	if err != nil {
+		return 0, err
+	}
+	c.head = head
+	c.fetched = time.Now()
+	return head, nil
+}
+
+// FakeHead is a local chain head for tests and development networks.
+// Unless set, the head advances by one block every blockTime.
+type FakeHead struct {
+	mutex     sync.Mutex
+	head      uint64
+	blockTime time.Duration
+	since     time.Time
+}
+
+// NewFakeHead returns a FakeHead at head, advancing every blockTime
+// unless zero
+func NewFakeHead(head uint64, blockTime time.Duration) *FakeHead {
+	return &FakeHead{head: head, blockTime: blockTime, since: time.Now()}
+}
+
+func (f *FakeHead) BlockNumber(ctx context.Context) (uint64, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.blockTime == 0 {
+		return f.head, nil
+	}
+	return f.head + uint64(time.Since(f.since)/f.blockTime), nil
+}
+
+// Set sets the head to block
+func (f *FakeHead) Set(block uint64) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.head = block
+	f.since = time.Now()
+}
@@ -0,0 +1,85 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package chain
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRPCHead(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     json.RawMessage `json:"id"`
+			Method string          `json:"method"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Method != "eth_blockNumber" {
+			t.Errorf("unexpected method %q", req.Method)
+		}
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      req.ID,
+			"result":  "0x2a",
+		})
+	}))
+	defer server.Close()
+
+	rpc, err := DialRPC(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := NewCachedHead(rpc, time.Hour)
+	for i := 0; i < 3; i++ {
+		block, err := head.BlockNumber(context.Background())
+		if err != nil || block != 42 {
+			t.Fatal(block, err)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("%d RPC calls, expected 1 within cache age", n)
+	}
+}
+
+func TestFakeHead(t *testing.T) {
+	ctx := context.Background()
+	head := NewFakeHead(100, 0)
+	if block, _ := head.BlockNumber(ctx); block != 100 {
+		t.Fatal(block)
+	}
+	head.Set(7)
+	if block, _ := head.BlockNumber(ctx); block != 7 {
+		t.Fatal(block)
+	}
+
+	head = NewFakeHead(100, 10*time.Millisecond)
+	time.Sleep(35 * time.Millisecond)
+	if block, _ := head.BlockNumber(ctx); block < 103 {
+		t.Fatal(block)
+	}
+}
@@ -0,0 +1,424 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Gustav-Simonsson/orchid-lib/crypto"
+	"github.com/Gustav-Simonsson/orchid-lib/directory"
+	"github.com/Gustav-Simonsson/orchid-lib/p2p"
+	"github.com/ethereum/go-ethereum/log"
+	"golang.org/x/term"
+)
+
+/* orchid key new|rotate|account|list|export <pub>|import <file>
+   orchid key descriptor <URL> relay|exit [<exit policy>]
+
+   Keys are kept encrypted in the keystore under ~/.orchid/keystore,
+   together with the identity key of the node, which is created with the
+   first node key and encrypted with the same passphrase, and the
+   Ethereum account of the node. Running relays and exits reload their
+   keys from the keystore on SIGHUP and every hour, so keys rotated with
+   the rotate subcommand are used without a restart.
+   The descriptor subcommand prints the signed descriptor of the node
+   at URL for directories (see the directory package), including the
+   binding of the account of the node if it has one.
+   The passphrase is read from the ORCHID_PASSPHRASE environment variable
+   if set, and otherwise prompted for on stdin, without echo if stdin
+   is a terminal.
+*/
+
+const (
+	keystoreDir   = "keystore"
+	passphraseEnv = "ORCHID_PASSPHRASE"
+
+	// running nodes reload their keys this often, and on SIGHUP
+	keyReloadInterval = time.Hour
+)
+
+func keyUsage() {
+	log.Error("run as 'orchid key new', 'orchid key rotate', 'orchid key account', 'orchid key list', 'orchid key export <pub>', 'orchid key import <file>' or 'orchid key descriptor <URL> relay|exit [<exit policy>]'")
+	os.Exit(1)
+}
+
+func openKeyStore() *crypto.KeyStore {
+	ks, err := crypto.NewKeyStore(filepath.Join(orchidDir, keystoreDir), crypto.StandardScryptN, crypto.StandardScryptP)
+	if err != nil {
+		log.Error("opening keystore", "err", err)
+		os.Exit(1)
+	}
+	return ks
+}
+
+// reads passphrases, shared so buffered input is not lost between reads
+var stdin = bufio.NewReader(os.Stdin)
+
+func readPassphrase(prompt string) string {
+	if p, ok := os.LookupEnv(passphraseEnv); ok {
+		return p
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		b, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			log.Error("reading passphrase", "err", err)
+			os.Exit(1)
+		}
+		return string(b)
+	}
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		log.Error("reading passphrase", "err", err)
+		os.Exit(1)
+	}
+	return strings.TrimRight(line, "\r\n")
+}
+
+func newPassphrase() string {
+	p := readPassphrase("New passphrase: ")
+	if _, ok := os.LookupEnv(passphraseEnv); !ok && readPassphrase("Repeat passphrase: ") != p {
+		log.Error("passphrases do not match")
+		os.Exit(1)
+	}
+	return p
+}
+
+// newKey stores a new key and returns it with the identity of the node
+// and the passphrase of the keystore
+func newKey(ks *crypto.KeyStore) (*crypto.NodeKey, *crypto.Identity, string) {
+	key, err := crypto.NewNodeKey()
+	if err != nil {
+		log.Error("crypto.NewNodeKey", "err", err)
+		os.Exit(1)
+	}
+	passphrase := keystorePassphrase(ks)
+	id := unlockIdentity(ks, passphrase)
+	err = ks.Store(key, passphrase)
+	if err != nil {
+		log.Error("storing key", "err", err)
+		os.Exit(1)
+	}
+	return key, crypto.NewIdentity(id, key), passphrase
+}
+
+// keystorePassphrase asks for a new passphrase if the keystore is
+// empty, and else for the passphrase of the keys in the keystore
+func keystorePassphrase(ks *crypto.KeyStore) string {
+	empty, err := ks.Empty()
+	if err != nil {
+		log.Error("opening keystore", "err", err)
+		os.Exit(1)
+	}
+	if empty {
+		return newPassphrase()
+	}
+	passphrase := readPassphrase("Keystore passphrase: ")
+	err = ks.CheckPassphrase(passphrase)
+	if err != nil {
+		log.Error("unlocking keystore", "err", err)
+		os.Exit(1)
+	}
+	return passphrase
+}
+
+// unlockIdentity unlocks the identity key of the node,
+// creating it if the keystore has none
+func unlockIdentity(ks *crypto.KeyStore, passphrase string) *crypto.IdentityKey {
+	id, err := ks.UnlockIdentity(passphrase)
+	if err == crypto.ErrKeyNotFound {
+		log.Info("No identity key in keystore, creating a new identity key")
+		id, err = crypto.NewIdentityKey()
+		if err == nil {
+			err = ks.StoreIdentity(id, passphrase)
+		}
+	}
+	if err != nil {
+		log.Error("unlocking identity key", "err", err)
+		os.Exit(1)
+	}
+	return id
+}
+
+func loadKeySet(ks *crypto.KeyStore, passphrase string) *crypto.KeySet {
+	set, err := ks.LoadKeySet(passphrase, time.Now())
+	if err != nil {
+		log.Error("unlocking keys", "err", err)
+		os.Exit(1)
+	}
+	return set
+}
+
+// loadKeys unlocks the keys in the keystore that have not expired and
+// the identity key, creating them if the keystore is empty
+func loadKeys() (*crypto.KeySet, *crypto.Identity) {
+	ks := openKeyStore()
+	pubs, err := ks.List()
+	if err != nil {
+		log.Error("listing keys", "err", err)
+		os.Exit(1)
+	}
+	if len(pubs) == 0 {
+		log.Info("No key in keystore, creating a new key")
+		key, id, passphrase := newKey(ks)
+		set := crypto.NewKeySet(key)
+		go reloadKeys(ks, passphrase, set)
+		return set, id
+	}
+	passphrase := readPassphrase("Keystore passphrase: ")
+	set := loadKeySet(ks, passphrase)
+	current := set.Current(time.Now())
+	if current == nil {
+		log.Error("no valid key in keystore, create one with 'orchid key new'")
+		os.Exit(1)
+	}
+	go reloadKeys(ks, passphrase, set)
+	return set, crypto.NewIdentity(unlockIdentity(ks, passphrase), current)
+}
+
+// reloadKeys reloads set from ks on SIGHUP and every keyReloadInterval,
+// so running nodes pick up keys rotated with 'orchid key rotate', and
+// prunes the keys of set that expired
+func reloadKeys(ks *crypto.KeyStore, passphrase string, set *crypto.KeySet) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(keyReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hup:
+		case <-ticker.C:
+		}
+		now := time.Now()
+		loaded, err := ks.LoadKeySet(passphrase, now)
+		if err == nil && loaded.Current(now) == nil {
+			err = crypto.ErrNoValidKey
+		}
+		if err != nil {
+			log.Error("reloading keys", "err", err)
+		} else {
+			set.Replace(loaded)
+			log.Info("Reloaded keys", "current", loaded.Current(now).URLBase64())
+		}
+		set.Prune(now)
+	}
+}
+
+// rotateKey adds a successor to the keys in the keystore, valid after
+// DefaultRotationLead, and prints the signed announcement of the
+// current and next keys. Running nodes serve it once they reload their
+// keys, on SIGHUP or within keyReloadInterval.
+func rotateKey(ks *crypto.KeyStore) {
+	passphrase := readPassphrase("Keystore passphrase: ")
+	set := loadKeySet(ks, passphrase)
+	id := unlockIdentity(ks, passphrase)
+
+	now := time.Now()
+	next, err := set.Rotate(now, crypto.DefaultRotationLead, crypto.DefaultRotationOverlap, 0)
+	if err == nil {
+		err = ks.Store(next.Key, passphrase)
+	}
+	if err == nil {
+		err = ks.StoreKeySet(set)
+	}
+	if err != nil {
+		log.Error("rotating key", "err", err)
+		os.Exit(1)
+	}
+	log.Info("Rotated key", "next", next.Key.URLBase64(), "validFrom", next.NotBefore)
+
+	a, err := set.Announce(id, now)
+	if err != nil {
+		log.Error("announcing keys", "err", err)
+		os.Exit(1)
+	}
+	b, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		log.Error("announcing keys", "err", err)
+		os.Exit(1)
+	}
+	os.Stdout.Write(append(b, '\n'))
+}
+
+// bindAccount prints the Ethereum account of the node, creating it if
+// needed, and its binding to the identity and current key of the node
+func bindAccount(ks *crypto.KeyStore) {
+	passphrase := readPassphrase("Keystore passphrase: ")
+	current := loadKeySet(ks, passphrase).Current(time.Now())
+	if current == nil {
+		log.Error("no valid key in keystore, create one with 'orchid key new'")
+		os.Exit(1)
+	}
+	id := crypto.NewIdentity(unlockIdentity(ks, passphrase), current)
+
+	account, err := ks.UnlockAccount(passphrase)
+	if err == crypto.ErrKeyNotFound {
+		log.Info("No account in keystore, creating a new account")
+		account, err = crypto.NewAccount()
+		if err == nil {
+			err = ks.StoreAccount(account, passphrase)
+		}
+	}
+	if err != nil {
+		log.Error("unlocking account", "err", err)
+		os.Exit(1)
+	}
+
+	binding, err := crypto.NewAccountBinding(account, id)
+	if err != nil {
+		log.Error("binding account", "err", err)
+		os.Exit(1)
+	}
+	b, err := json.MarshalIndent(binding, "", "  ")
+	if err != nil {
+		log.Error("binding account", "err", err)
+		os.Exit(1)
+	}
+	fmt.Println(account.Address.Hex())
+	os.Stdout.Write(append(b, '\n'))
+}
+
+// nodeTemplate returns the descriptor fields of a node at ref with
+// role r and, for exits, exit policy
+func nodeTemplate(ref *url.URL, r string, policy *directory.ExitPolicy) *directory.NodeDescriptor {
+	return &directory.NodeDescriptor{
+		Endpoints:  []string{ref.String()},
+		Versions:   []uint32{p2p.SignalingVersion},
+		Roles:      []string{r},
+		ExitPolicy: policy,
+	}
+}
+
+// describeNode prints the signed descriptor of the node at ref with
+// role r and, for exits, exit policy
+func describeNode(ks *crypto.KeyStore, ref *url.URL, r string, policy *directory.ExitPolicy) {
+	passphrase := readPassphrase("Keystore passphrase: ")
+	current := loadKeySet(ks, passphrase).Current(time.Now())
+	if current == nil {
+		log.Error("no valid key in keystore, create one with 'orchid key new'")
+		os.Exit(1)
+	}
+	id := crypto.NewIdentity(unlockIdentity(ks, passphrase), current)
+
+	var binding *crypto.AccountBinding
+	account, err := ks.UnlockAccount(passphrase)
+	if err == nil {
+		binding, err = crypto.NewAccountBinding(account, id)
+	}
+	if err != nil && err != crypto.ErrKeyNotFound {
+		log.Error("binding account", "err", err)
+		os.Exit(1)
+	}
+
+	d := nodeTemplate(ref, r, policy)
+	d.Account = binding
+	b, err := json.MarshalIndent(d.Sign(id, time.Now()), "", "  ")
+	if err != nil {
+		log.Error("signing descriptor", "err", err)
+		os.Exit(1)
+	}
+	os.Stdout.Write(append(b, '\n'))
+}
+
+func keyCmd(args []string) {
+	if len(args) == 0 {
+		keyUsage()
+	}
+	ks := openKeyStore()
+
+	switch {
+	case args[0] == "new" && len(args) == 1:
+		key, id, _ := newKey(ks)
+		fmt.Println(key.URLBase64())
+		fmt.Println("identity", hex.EncodeToString(id.Key.Pub))
+	case args[0] == "rotate" && len(args) == 1:
+		rotateKey(ks)
+	case args[0] == "account" && len(args) == 1:
+		bindAccount(ks)
+	case args[0] == "list" && len(args) == 1:
+		pubs, err := ks.List()
+		if err != nil {
+			log.Error("listing keys", "err", err)
+			os.Exit(1)
+		}
+		for _, pub := range pubs {
+			fmt.Println(crypto.NACLKeyToURLBase64(pub))
+		}
+	case args[0] == "export" && len(args) == 2:
+		pub, err := crypto.URLBase64ToNACLKey(args[1])
+		if err != nil {
+			log.Error("invalid node public key", "err", err)
+			os.Exit(1)
+		}
+		// the exported key file stays encrypted
+		b, err := ks.Export(pub)
+		if err != nil {
+			log.Error("exporting key", "err", err)
+			os.Exit(1)
+		}
+		os.Stdout.Write(append(b, '\n'))
+	case args[0] == "import" && len(args) == 2:
+		b, err := ioutil.ReadFile(args[1])
+		if err != nil {
+			log.Error("reading key file", "err", err)
+			os.Exit(1)
+		}
+		pub, err := ks.Import(b, readPassphrase("Passphrase of key file: "), readPassphrase("Keystore passphrase: "))
+		if err != nil {
+			log.Error("importing key", "err", err)
+			os.Exit(1)
+		}
+		fmt.Println(crypto.NACLKeyToURLBase64(pub))
+	case args[0] == "descriptor" && (len(args) == 3 || len(args) == 4):
+		ref, err := url.Parse(args[1])
+		if err != nil {
+			log.Error("invalid node URL", "err", err)
+			os.Exit(1)
+		}
+		var policy *directory.ExitPolicy
+		switch {
+		case args[2] == directory.RoleExit && len(args) == 4:
+			policy, err = directory.ParseExitPolicy(args[3])
+		case args[2] == directory.RoleExit:
+			policy = directory.AcceptAll
+		case args[2] != directory.RoleRelay || len(args) == 4:
+			keyUsage()
+		}
+		if err != nil {
+			log.Error("invalid exit policy", "err", err)
+			os.Exit(1)
+		}
+		describeNode(ks, ref, args[2], policy)
+	default:
+		keyUsage()
+	}
+}
@@ -20,15 +20,55 @@
 package main
 
 import (
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/Gustav-Simonsson/orchid-lib/chain"
+	"github.com/Gustav-Simonsson/orchid-lib/crypto"
+	"github.com/Gustav-Simonsson/orchid-lib/directory"
 	"github.com/Gustav-Simonsson/orchid-lib/node"
+	"github.com/Gustav-Simonsson/orchid-lib/payment"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/ethereum/go-ethereum/log"
 	homedir "github.com/mitchellh/go-homedir"
 )
 
-const ()
+const (
+	// Ethereum JSON-RPC endpoint BackResponses are stamped and checked with
+	ethRPCEnv = "ORCHID_ETH_RPC"
+
+	headCacheAge = 5 * time.Second
+
+	// address of the Lottery contract, whose deposits weigh the nodes
+	// sources pick by the stake of their operators
+	lotteryEnv = "ORCHID_LOTTERY"
+
+	// file or server URL of a node directory sources add to the cache
+	directoryEnv = "ORCHID_DIRECTORY"
+	// cache of the node directory, in orchidDir
+	directoryFile = "directory.json"
+	// reputation of the nodes sources used, in orchidDir
+	reputationFile = "reputation.json"
+	// winning tickets of an exit, in orchidDir
+	winsFile = "wins.json"
+
+	// signaling URL relays and exits advertise in their descriptor
+	publicURLEnv = "ORCHID_PUBLIC_URL"
+
+	// relays of circuits picked from the directory, so the exit does
+	// not see the address of the source
+	relaysEnv     = "ORCHID_RELAYS"
+	defaultRelays = 1
+
+	// set for relays to extend circuits to loopback and private
+	// addresses, such as an exit on localhost
+	privateHopsEnv = "ORCHID_PRIVATE_HOPS"
+)
 
 var (
 	orchidDir string
@@ -52,21 +92,205 @@ func init() {
 	}
 }
 
+func usage() {
+	log.Error("dev testing: run as 'orchid exit', 'orchid relay' or 'orchid source [<hop> ...]' with hops as <pub>[@<URL>], the last hop an exit, or an exit of the directory gossiped by earlier circuits (cached in ~/.orchid/" + directoryFile + ") and in " + directoryEnv + ", through " + relaysEnv + " relays (default 1); manage node keys with 'orchid key'; set " + ethRPCEnv + " to check BackResponse blocks, " + lotteryEnv + " to weigh nodes by the Lottery deposits of their operators, " + publicURLEnv + " to serve the descriptor of a relay or exit, and " + privateHopsEnv + " for relays to extend to private addresses")
+	os.Exit(1)
+}
+
+// ethClient connects to the Ethereum JSON-RPC endpoint in
+// ORCHID_ETH_RPC, or returns nil if not set
+func ethClient() *ethclient.Client {
+	rpc, ok := os.LookupEnv(ethRPCEnv)
+	if !ok {
+		return nil
+	}
+	client, err := ethclient.Dial(rpc)
+	if err != nil {
+		log.Error("Ethereum JSON-RPC", "url", rpc, "err", err)
+		os.Exit(1)
+	}
+	return client
+}
+
+// chainHead returns the chain head of client, or nil without one
+func chainHead(client *ethclient.Client) chain.HeadProvider {
+	if client == nil {
+		return nil
+	}
+	return chain.NewCachedHead(client, headCacheAge)
+}
+
+// operatorStakes returns the deposits of the Lottery in ORCHID_LOTTERY
+// as the stakes of node operators, or nil if not set or without client
+func operatorStakes(client *ethclient.Client) node.StakeProvider {
+	address, ok := os.LookupEnv(lotteryEnv)
+	if !ok || client == nil {
+		return nil
+	}
+	if !common.IsHexAddress(address) {
+		log.Error("invalid Lottery address", "address", address)
+		os.Exit(1)
+	}
+	deposits, err := payment.NewDeposits(common.HexToAddress(address), client)
+	if err != nil {
+		log.Error("binding Lottery", "err", err)
+		os.Exit(1)
+	}
+	return deposits
+}
+
+// parseHop parses a hop given as <pub>[@<URL>],
+// defaulting to an exit on localhost
+func parseHop(arg string) node.Hop {
+	parts := strings.SplitN(arg, "@", 2)
+	pub, err := crypto.URLBase64ToNACLKey(parts[0])
+	if err != nil {
+		log.Error("invalid node public key", "err", err)
+		os.Exit(1)
+	}
+	ref := node.LocalURL(node.ExitHTTPPort)
+	if len(parts) == 2 {
+		ref, err = url.Parse(parts[1])
+		if err != nil {
+			log.Error("invalid node URL", "err", err)
+			os.Exit(1)
+		}
+	}
+	return node.Hop{URL: ref, Pub: pub}
+}
+
+// publicDescriptor returns the descriptor template of a node with
+// role r at the URL in ORCHID_PUBLIC_URL, or nil if not set
+func publicDescriptor(r string, policy *directory.ExitPolicy) *directory.NodeDescriptor {
+	public, ok := os.LookupEnv(publicURLEnv)
+	if !ok {
+		return nil
+	}
+	ref, err := url.Parse(public)
+	if err != nil {
+		log.Error("invalid public URL", "err", err)
+		os.Exit(1)
+	}
+	return nodeTemplate(ref, r, policy)
+}
+
+// nodeGossip returns the gossip of a node, starting from the directory
+// cached in ~/.orchid, if any
+func nodeGossip() *node.Gossip {
+	cache := filepath.Join(orchidDir, directoryFile)
+	dir := directory.New()
+	_, err := dir.LoadCache(cache)
+	if err != nil && !os.IsNotExist(err) {
+		log.Warn("loading cached node directory", "path", cache, "err", err)
+	}
+	return node.NewGossip(dir, cache)
+}
+
+// sourceReputation loads the reputation of the nodes used by sources
+func sourceReputation() *node.Reputation {
+	path := filepath.Join(orchidDir, reputationFile)
+	rep, err := node.LoadReputation(path)
+	if err != nil {
+		log.Warn("loading reputation", "path", path, "err", err)
+		rep = node.NewReputation(path)
+	}
+	return rep
+}
+
+// exitWins loads the winning tickets an exit has not redeemed yet
+func exitWins() *payment.WinQueue {
+	path := filepath.Join(orchidDir, winsFile)
+	wins, err := payment.OpenWinQueue(path)
+	if err != nil {
+		log.Error("loading winning tickets", "path", path, "err", err)
+		os.Exit(1)
+	}
+	return wins
+}
+
+// directoryPaths returns the paths through ORCHID_RELAYS relays to an
+// exit picked from the node directory of gossip, after adding the
+// directory in ORCHID_DIRECTORY, if set, avoiding nodes of bad reputation
+// and weighing them by stakes, if not nil. Paths are picked among the nodes of ORCHID_DIRECTORY if they allow one,
+// so gossip cannot eclipse them.
+func directoryPaths(gossip *node.Gossip, rep *node.Reputation, stakes node.StakeProvider) func() ([]node.Hop, error) {
+	relays := defaultRelays
+	if n, ok := os.LookupEnv(relaysEnv); ok {
+		var err error
+		relays, err = strconv.Atoi(n)
+		if err != nil || relays < 0 || relays >= crypto.MaxOnionLayers {
+			log.Error("invalid number of relays", "relays", n)
+			os.Exit(1)
+		}
+	}
+	if source, ok := os.LookupEnv(directoryEnv); ok {
+		_, err := gossip.Dir.LoadOrFetch(source)
+		if err != nil {
+			log.Error("loading node directory", "source", source, "err", err)
+			os.Exit(1)
+		}
+	}
+	if len(gossip.Dir.All(time.Now())) == 0 {
+		log.Error("no known nodes, bootstrap with 'orchid source <pub>@<URL>'")
+		os.Exit(1)
+	}
+	selector := node.NewSelector()
+	selector.Reputation = rep
+	selector.Stakes = stakes
+	return func() ([]node.Hop, error) {
+		now := time.Now()
+		hops, err := selector.PathHops(gossip.Dir.Configured(now), relays, node.PathConstraints{})
+		if err != nil {
+			return selector.PathHops(gossip.Dir.All(now), relays, node.PathConstraints{})
+		}
+		return hops, nil
+	}
+}
+
 func main() {
 	// TODO: replace with urfave/cli app
-	// simple session with one source and one exit node, launch as either:
-	if len(os.Args) != 2 || (os.Args[1] != "source" && os.Args[1] != "exit") {
-		log.Error("dev testing: run as 'orchid source' or 'orchid exit'")
+	// simple session with one source, optional relays and one exit node
+	if len(os.Args) < 2 {
+		usage()
 	}
 
+	client := ethClient()
+	head := chainHead(client)
+
 	var err error
-	if os.Args[1] == "source" {
-		err = node.SimpleSource()
-	} else {
-		err = node.SimpleExit()
+	switch {
+	case os.Args[1] == "key":
+		keyCmd(os.Args[2:])
+		return
+	case os.Args[1] == "source" && len(os.Args) == 2:
+		gossip, rep := nodeGossip(), sourceReputation()
+		err = (&node.Source{Gossip: gossip, Reputation: rep, Head: head}).ServePaths(directoryPaths(gossip, rep, operatorStakes(client)))
+	case os.Args[1] == "source":
+		hops := []node.Hop{}
+		for _, arg := range os.Args[2:] {
+			hops = append(hops, parseHop(arg))
+		}
+		err = (&node.Source{Gossip: nodeGossip(), Reputation: sourceReputation(), Head: head}).Serve(hops...)
+	case os.Args[1] == "relay" && len(os.Args) == 2:
+		relay := node.NewRelay(loadKeys())
+		relay.Descriptor = publicDescriptor(directory.RoleRelay, nil)
+		relay.Gossip = nodeGossip()
+		relay.Head = head
+		_, relay.PrivateHops = os.LookupEnv(privateHopsEnv)
+		err = relay.ListenAndServe(node.RelayHTTPPort)
+	case os.Args[1] == "exit" && len(os.Args) == 2:
+		keys, id := loadKeys()
+		exit := node.NewExit(keys, id, nil)
+		exit.Descriptor = publicDescriptor(directory.RoleExit, directory.AcceptAll)
+		exit.Gossip = nodeGossip()
+		exit.Wins = exitWins()
+		exit.Head = head
+		err = exit.ListenAndServe(node.ExitHTTPPort)
+	default:
+		usage()
 	}
 	if err != nil {
-		log.Error("node exit:", "source", os.Args[1] == "source", "err", err)
+		log.Error("node exit:", "mode", os.Args[1], "err", err)
 	}
 
 	os.Exit(1)
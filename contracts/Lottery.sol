@@ -0,0 +1,93 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+pragma solidity ^0.8.0;
+
+/* Lottery pays winning orchid payment tickets, see payment/ticket.go.
+
+   Sources deposit ether to pay their tickets. A recipient redeems a
+   winning ticket by revealing the secret of its commit; the ticket pays
+   its face value, or what is left of the deposit of the source, to the
+   recipient. Each ticket can only be redeemed once, before it expires.
+
+   To withdraw, a source first unlocks its deposit and waits for
+   UNLOCK_DELAY, giving recipients time to redeem the tickets it paid.
+*/
+contract Lottery {
+    uint256 public constant UNLOCK_DELAY = 1 days;
+
+    mapping(address => uint256) public balances;
+    mapping(address => uint256) public unlocks;
+    mapping(bytes32 => bool) public spent;
+
+    event Deposited(address indexed source, uint256 amount);
+    event Unlocked(address indexed source, uint256 at);
+    event Withdrawn(address indexed source, uint256 amount);
+    event Redeemed(bytes32 indexed ticket, address indexed source, address indexed recipient, uint256 amount);
+
+    function deposit() external payable {
+        balances[msg.sender] += msg.value;
+        unlocks[msg.sender] = 0;
+        emit Deposited(msg.sender, msg.value);
+    }
+
+    function unlock() external {
+        unlocks[msg.sender] = block.timestamp + UNLOCK_DELAY;
+        emit Unlocked(msg.sender, unlocks[msg.sender]);
+    }
+
+    function withdraw() external {
+        uint256 at = unlocks[msg.sender];
+        require(at != 0 && block.timestamp >= at, "deposit locked");
+        uint256 amount = balances[msg.sender];
+        balances[msg.sender] = 0;
+        unlocks[msg.sender] = 0;
+        emit Withdrawn(msg.sender, amount);
+        (bool ok, ) = msg.sender.call{value: amount}("");
+        require(ok, "transfer failed");
+    }
+
+    // ticketHash is Ticket.Hash
+    function ticketHash(bytes32 commit, address recipient, uint256 faceValue, uint64 winProb, bytes32 nonce, uint64 expiry) public pure returns (bytes32) {
+        return keccak256(abi.encodePacked("orchid ticket v1", commit, recipient, faceValue, winProb, nonce, expiry));
+    }
+
+    // redeem pays the winning ticket with secret, signed by the source with
+    // v, r and s (see crypto.Account.Sign), to recipient
+    function redeem(bytes32 secret, address recipient, uint256 faceValue, uint64 winProb, bytes32 nonce, uint64 expiry, uint8 v, bytes32 r, bytes32 s) external {
+        require(block.timestamp < expiry, "ticket expired");
+        bytes32 hash = ticketHash(keccak256(abi.encodePacked(secret)), recipient, faceValue, winProb, nonce, expiry);
+        require(!spent[hash], "ticket spent");
+        require(winProb == type(uint64).max || uint64(bytes8(keccak256(abi.encodePacked(secret, hash)))) < winProb, "ticket does not win");
+
+        address source = ecrecover(keccak256(abi.encodePacked("\x19Ethereum Signed Message:\n32", hash)), v, r, s);
+        require(source != address(0), "invalid signature");
+
+        spent[hash] = true;
+        uint256 amount = faceValue;
+        if (amount > balances[source]) {
+            amount = balances[source];
+        }
+        balances[source] -= amount;
+        emit Redeemed(hash, source, recipient, amount);
+        (bool ok, ) = recipient.call{value: amount}("");
+        require(ok, "transfer failed");
+    }
+}
@@ -0,0 +1,169 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package crypto
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	nacl "github.com/kevinburke/nacl"
+)
+
+/* Ethereum accounts of nodes.
+
+   Stake and payments are held by a secp256k1 Ethereum account. An
+   AccountBinding ties the account to the identity key (see identity.go)
+   and the NodeKey of a node, signed by both the account and the identity
+   over the same statement:
+
+     "orchid account binding v1" || address (20) || identity (32) || node pub (32)
+
+   The account signs the statement as an Ethereum signed message
+   (eth_sign / personal_sign, see SignHash), so contracts can verify it
+   with ecrecover; the identity signs it as a DomainAccountBinding
+   statement. Requiring both signatures prevents an account from claiming
+   another node, and a node from claiming stake of another account.
+*/
+
+const (
+	DomainAccountBinding = "account binding"
+
+	accountBindingPrefix = "orchid account binding v1"
+)
+
+var (
+	ErrAccountBinding = errors.New("invalid account binding")
+)
+
+type Account struct {
+	Key     *ecdsa.PrivateKey
+	Address common.Address
+}
+
+func NewAccount() (*Account, error) {
+	key, err := ethcrypto.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	return accountFromKey(key), nil
+}
+
+func accountFromKey(key *ecdsa.PrivateKey) *Account {
+	return &Account{key, ethcrypto.PubkeyToAddress(key.PublicKey)}
+}
+
+// SignHash returns the hash of msg as signed by eth_sign
+func SignHash(msg []byte) []byte {
+	prefixed := fmt.Sprintf("\x19Ethereum Signed Message:\n%d%s", len(msg), msg)
+	return ethcrypto.Keccak256([]byte(prefixed))
+}
+
+// Sign signs msg as an Ethereum signed message, with V as 27 or 28
+// as expected by ecrecover
+func (a *Account) Sign(msg []byte) ([]byte, error) {
+	sig, err := ethcrypto.Sign(SignHash(msg), a.Key)
+	if err != nil {
+		return nil, err
+	}
+	sig[64] += 27
+	return sig, nil
+}
+
+// RecoverAddress returns the address of the account that signed msg
+// with Account.Sign
+func RecoverAddress(msg, sig []byte) (common.Address, error) {
+	if len(sig) != 65 || (sig[64] != 27 && sig[64] != 28) {
+		return common.Address{}, ErrSignature
+	}
+	rsv := append([]byte{}, sig...)
+	rsv[64] -= 27
+	pub, err := ethcrypto.SigToPub(SignHash(msg), rsv)
+	if err != nil {
+		return common.Address{}, ErrSignature
+	}
+	return ethcrypto.PubkeyToAddress(*pub), nil
+}
+
+type AccountBinding struct {
+	Address     common.Address `json:"address"`
+	Identity    hexutil.Bytes  `json:"identity"`
+	NodePub     hexutil.Bytes  `json:"nodePub"`
+	AccountSig  hexutil.Bytes  `json:"accountSig"`
+	IdentitySig hexutil.Bytes  `json:"identitySig"`
+}
+
+// NewAccountBinding binds account to the identity of a node
+// and the NodeKey of its binding
+func NewAccountBinding(account *Account, id *Identity) (*AccountBinding, error) {
+	b := &AccountBinding{
+		account.Address,
+		hexutil.Bytes(id.Key.Pub),
+		hexutil.Bytes(id.Binding.NodePub[:]),
+		nil,
+		nil,
+	}
+	msg := b.statement()
+	sig, err := account.Sign(msg)
+	if err != nil {
+		return nil, err
+	}
+	b.AccountSig = sig
+	b.IdentitySig = id.Sign(DomainAccountBinding, msg)
+	return b, nil
+}
+
+func (b *AccountBinding) statement() []byte {
+	msg := make([]byte, 0, len(accountBindingPrefix)+common.AddressLength+2*nacl.KeySize)
+	msg = append(msg, accountBindingPrefix...)
+	msg = append(msg, b.Address[:]...)
+	msg = append(msg, b.Identity...)
+	return append(msg, b.NodePub...)
+}
+
+// Verify checks both signatures of b
+func (b *AccountBinding) Verify() error {
+	if len(b.Identity) != ed25519.PublicKeySize || len(b.NodePub) != nacl.KeySize {
+		return ErrAccountBinding
+	}
+	msg := b.statement()
+	addr, err := RecoverAddress(msg, b.AccountSig)
+	if err != nil {
+		return err
+	}
+	if addr != b.Address {
+		return ErrAccountBinding
+	}
+	return VerifySignature(ed25519.PublicKey(b.Identity), DomainAccountBinding, msg, b.IdentitySig)
+}
+
+// Binds checks that b is a valid binding of the node with nodePub
+// to address
+func (b *AccountBinding) Binds(address common.Address, nodePub nacl.Key) error {
+	if b.Address != address || nodePub == nil || !bytes.Equal(b.NodePub, nodePub[:]) {
+		return ErrAccountBinding
+	}
+	return b.Verify()
+}
@@ -0,0 +1,118 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package crypto
+
+import (
+	"encoding/json"
+	"testing"
+
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+)
+
+func testIdentity(t *testing.T) *Identity {
+	idKey, err := NewIdentityKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewIdentity(idKey, testKeys(t, 1)[0])
+}
+
+func TestAccountSign(t *testing.T) {
+	a, err := NewAccount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte("statement")
+	sig, err := a.Sign(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig[64] != 27 && sig[64] != 28 {
+		t.Fatalf("unexpected V: %d", sig[64])
+	}
+	addr, err := RecoverAddress(msg, sig)
+	if err != nil || addr != a.Address {
+		t.Fatalf("unexpected recovered address: %v err: %v", addr.Hex(), err)
+	}
+
+	// eth_sign compatible: recoverable from the prefixed hash
+	rsv := append([]byte{}, sig...)
+	rsv[64] -= 27
+	pub, err := ethcrypto.SigToPub(SignHash(msg), rsv)
+	if err != nil || ethcrypto.PubkeyToAddress(*pub) != a.Address {
+		t.Fatalf("unexpected SigToPub: %v", err)
+	}
+
+	addr, err = RecoverAddress([]byte("statemenT"), sig)
+	if err == nil && addr == a.Address {
+		t.Fatalf("signature valid for other msg")
+	}
+	_, err = RecoverAddress(msg, sig[:64])
+	if err != ErrSignature {
+		t.Fatalf("unexpected RecoverAddress (short) err: %v", err)
+	}
+}
+
+func TestAccountBinding(t *testing.T) {
+	a, err := NewAccount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewAccount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := testIdentity(t)
+
+	b, err := NewAccountBinding(a, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b1 := new(AccountBinding)
+	err = json.Unmarshal(j, b1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b1.Binds(a.Address, id.Binding.NodePub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b1.Binds(other.Address, id.Binding.NodePub)
+	if err != ErrAccountBinding {
+		t.Fatalf("unexpected Binds (other account) err: %v", err)
+	}
+
+	// claiming another node or another account fails
+	otherID := testIdentity(t)
+	claimNode := *b1
+	claimNode.Identity = []byte(otherID.Key.Pub)
+	claimNode.NodePub = otherID.Binding.NodePub[:]
+	claimAccount := *b1
+	claimAccount.Address = other.Address
+	for name, b := range map[string]*AccountBinding{"node": &claimNode, "account": &claimAccount} {
+		if b.Verify() == nil {
+			t.Errorf("claim of other %s verified", name)
+		}
+	}
+}
@@ -20,6 +20,8 @@
 package crypto
 
 import (
+	"errors"
+
 	nacl "github.com/kevinburke/nacl"
 	naclbox "github.com/kevinburke/nacl/box"
 )
@@ -39,25 +41,55 @@ const (
 	sealPreAllocSize = 64
 )
 
-var ()
+var (
+	ErrSealedOpen = errors.New("could not open sealed message")
+)
 
+// Box seals messages with a key precomputed from a static-static key
+// agreement. Both ends share the key, so each message is sealed with a
+// fresh random nonce, which is prepended to the returned ciphertext.
+// Streams should use a SecureConn over a handshake Session instead.
 type Box struct {
 	sharedKey nacl.Key
-	nonce     nacl.Nonce
 }
 
 func NewBox(peerPub, priv nacl.Key) (*Box, error) {
 	shared := naclbox.Precompute(peerPub, priv)
-	nonce := nacl.NewNonce()
-	return &Box{shared, nonce}, nil
+	return &Box{shared}, nil
 }
 
 func (b *Box) Seal(msg []byte) []byte {
-	out := make([]byte, sealPreAllocSize)
-	return naclbox.SealAfterPrecomputation(out, msg, b.nonce, b.sharedKey)
+	nonce := nacl.NewNonce()
+	out := make([]byte, nacl.NonceSize, nacl.NonceSize+naclbox.Overhead+len(msg))
+	copy(out, nonce[:])
+	return naclbox.SealAfterPrecomputation(out, msg, nonce, b.sharedKey)
+}
+
+func (b *Box) Open(sealed []byte) ([]byte, bool) {
+	if len(sealed) < nacl.NonceSize {
+		return nil, false
+	}
+	nonce := new([nacl.NonceSize]byte)
+	copy(nonce[:], sealed)
+	out := make([]byte, 0, sealPreAllocSize)
+	return naclbox.OpenAfterPrecomputation(out, sealed[nacl.NonceSize:], nonce, b.sharedKey)
+}
+
+// SealTo seals msg from k to peerPub with a fresh random nonce,
+// which is prepended to the returned ciphertext.
+// Used for one-off messages such as signaling payloads, where
+// there is no session to derive nonces from.
+func (k *NodeKey) SealTo(peerPub nacl.Key, msg []byte) []byte {
+	return naclbox.EasySeal(msg, peerPub, k.Priv)
 }
 
-func (b *Box) Open(ciphertext []byte, nonce nacl.Nonce) ([]byte, bool) {
-	out := make([]byte, sealPreAllocSize)
-	return naclbox.OpenAfterPrecomputation(out, ciphertext, nonce, b.sharedKey)
+// OpenFrom opens a message sealed with SealTo by the holder of
+// the private key of peerPub. Successful opening authenticates
+// the sender as the holder of that private key.
+func (k *NodeKey) OpenFrom(peerPub nacl.Key, sealed []byte) ([]byte, error) {
+	msg, err := naclbox.EasyOpen(sealed, peerPub, k.Priv)
+	if err != nil {
+		return nil, ErrSealedOpen
+	}
+	return msg, nil
 }
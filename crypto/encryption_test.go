@@ -0,0 +1,101 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSealToOpenFrom(t *testing.T) {
+	a, err := NewNodeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewNodeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewNodeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := []byte("offer sdp")
+	sealed := a.SealTo(b.Pub, msg)
+
+	opened, err := b.OpenFrom(a.Pub, sealed)
+	if err != nil {
+		t.Fatalf("b.OpenFrom err: %v", err)
+	}
+	if !bytes.Equal(opened, msg) {
+		t.Fatalf("unexpected opened msg: %v", opened)
+	}
+
+	// not addressed to c
+	_, err = c.OpenFrom(a.Pub, sealed)
+	if err != ErrSealedOpen {
+		t.Fatalf("unexpected c.OpenFrom err: %v", err)
+	}
+
+	// not sealed by c
+	_, err = b.OpenFrom(c.Pub, sealed)
+	if err != ErrSealedOpen {
+		t.Fatalf("unexpected b.OpenFrom err: %v", err)
+	}
+
+	sealed[len(sealed)-1] ^= 1
+	_, err = b.OpenFrom(a.Pub, sealed)
+	if err != ErrSealedOpen {
+		t.Fatalf("unexpected b.OpenFrom (tampered) err: %v", err)
+	}
+}
+
+func TestBox(t *testing.T) {
+	a, err := NewNodeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewNodeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ab, _ := NewBox(b.Pub, a.Priv)
+	ba, _ := NewBox(a.Pub, b.Priv)
+
+	msg := []byte("msg")
+	s1, s2 := ab.Seal(msg), ab.Seal(msg)
+	if bytes.Equal(s1, s2) {
+		t.Fatalf("nonce reused")
+	}
+	for _, s := range [][]byte{s1, s2} {
+		opened, ok := ba.Open(s)
+		if !ok || !bytes.Equal(opened, msg) {
+			t.Fatalf("unexpected Open: %v %v", opened, ok)
+		}
+	}
+	s1[len(s1)-1] ^= 1
+	if _, ok := ba.Open(s1); ok {
+		t.Fatalf("tampered box opened")
+	}
+	if _, ok := ba.Open(nil); ok {
+		t.Fatalf("empty box opened")
+	}
+}
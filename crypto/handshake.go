@@ -0,0 +1,324 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	nacl "github.com/kevinburke/nacl"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+/* Authenticated key exchange between nodes.
+
+   NewBox and NewOnionLayer derive keys from a single Diffie-Hellman,
+   which gives no forward secrecy (static-static) or no authentication
+   of the initiator (ephemeral-static), and binds no transcript.
+
+   Handshake implements the Noise IK pattern
+   (https://noiseprotocol.org/noise.html#interactive-handshake-patterns):
+
+     <- s
+     ...
+     -> e, es, s, ss
+     <- e, ee, se
+
+   The initiator knows the static key (NodeKey.Pub) of the responder in
+   advance, e.g. from the hop of a circuit, and sends its own static key
+   encrypted in the first message. The responder proves possession of its
+   static key by being able to complete the second message. Both sides mix
+   fresh ephemeral keys into the result, so recorded sessions cannot be
+   decrypted later even if the static keys are compromised.
+
+   The resulting Session holds one key per direction and the handshake hash,
+   which uniquely identifies the session. The prologue binds the protocol
+   version; a peer speaking another version fails the handshake.
+
+   The handshake messages are transport agnostic; p2p runs them as the
+   first messages on the control DataChannel.
+*/
+
+const (
+	handshakeProtocol = "Noise_IK_25519_ChaChaPoly_SHA256"
+	handshakePrologue = "orchid handshake v1"
+
+	// sizes of the first (initiator) and second (responder) messages
+	HandshakeInitSize     = 32 + 32 + chacha20poly1305.Overhead + chacha20poly1305.Overhead
+	HandshakeResponseSize = 32 + chacha20poly1305.Overhead
+)
+
+var (
+	ErrHandshake      = errors.New("handshake failed")
+	ErrHandshakeState = errors.New("handshake message out of order")
+)
+
+// Session is the result of a completed Handshake
+type Session struct {
+	SendKey nacl.Key // to the peer
+	RecvKey nacl.Key // from the peer
+	PeerPub nacl.Key // authenticated static key of the peer
+	Hash    [32]byte // handshake hash, the same at both ends
+}
+
+type Handshake struct {
+	initiator bool
+	static    *NodeKey
+	eph       *NodeKey
+	peerPub   nacl.Key // static key of the peer
+	peerEph   nacl.Key
+	step      int
+
+	ck [32]byte // chaining key
+	h  [32]byte // handshake hash
+	k  *[32]byte
+	n  uint64
+}
+
+func newHandshake(initiator bool, static *NodeKey) *Handshake {
+	hs := &Handshake{initiator: initiator, static: static}
+	copy(hs.h[:], handshakeProtocol) // exactly HashLen bytes, no hashing
+	hs.ck = hs.h
+	hs.mixHash([]byte(handshakePrologue))
+	return hs
+}
+
+// NewHandshakeInitiator starts a handshake with the holder of peerPub
+func NewHandshakeInitiator(static *NodeKey, peerPub nacl.Key) *Handshake {
+	hs := newHandshake(true, static)
+	hs.peerPub = peerPub
+	hs.mixHash(peerPub[:])
+	return hs
+}
+
+// NewHandshakeResponder waits for a handshake from any initiator; the
+// static key of the initiator is available in the Session.
+func NewHandshakeResponder(static *NodeKey) *Handshake {
+	hs := newHandshake(false, static)
+	hs.mixHash(static.Pub[:])
+	return hs
+}
+
+// WriteInit returns the first message, sent by the initiator
+func (hs *Handshake) WriteInit() ([]byte, error) {
+	if !hs.initiator || hs.step != 0 {
+		return nil, ErrHandshakeState
+	}
+	hs.step++
+
+	var err error
+	hs.eph, err = NewNodeKey()
+	if err != nil {
+		return nil, err
+	}
+	msg := append([]byte{}, hs.eph.Pub[:]...)
+	hs.mixHash(hs.eph.Pub[:])
+
+	// es
+	err = hs.mixDH(hs.eph.Priv, hs.peerPub)
+	if err != nil {
+		return nil, err
+	}
+	msg = append(msg, hs.encryptAndHash(hs.static.Pub[:])...)
+
+	// ss
+	err = hs.mixDH(hs.static.Priv, hs.peerPub)
+	if err != nil {
+		return nil, err
+	}
+	return append(msg, hs.encryptAndHash(nil)...), nil
+}
+
+// ReadInit processes the first message at the responder
+func (hs *Handshake) ReadInit(msg []byte) error {
+	if hs.initiator || hs.step != 0 {
+		return ErrHandshakeState
+	}
+	hs.step++
+	if len(msg) != HandshakeInitSize {
+		return ErrHandshake
+	}
+
+	hs.peerEph = keyFrom(msg[:32])
+	hs.mixHash(msg[:32])
+
+	// es
+	err := hs.mixDH(hs.static.Priv, hs.peerEph)
+	if err != nil {
+		return err
+	}
+	s, err := hs.decryptAndHash(msg[32 : 32+32+chacha20poly1305.Overhead])
+	if err != nil {
+		return err
+	}
+	hs.peerPub = keyFrom(s)
+
+	// ss
+	err = hs.mixDH(hs.static.Priv, hs.peerPub)
+	if err != nil {
+		return err
+	}
+	_, err = hs.decryptAndHash(msg[32+32+chacha20poly1305.Overhead:])
+	return err
+}
+
+// WriteResponse returns the second message, sent by the responder,
+// after which the handshake is complete at the responder.
+func (hs *Handshake) WriteResponse() ([]byte, *Session, error) {
+	if hs.initiator || hs.step != 1 {
+		return nil, nil, ErrHandshakeState
+	}
+	hs.step++
+
+	var err error
+	hs.eph, err = NewNodeKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	msg := append([]byte{}, hs.eph.Pub[:]...)
+	hs.mixHash(hs.eph.Pub[:])
+
+	// ee
+	err = hs.mixDH(hs.eph.Priv, hs.peerEph)
+	if err != nil {
+		return nil, nil, err
+	}
+	// se
+	err = hs.mixDH(hs.eph.Priv, hs.peerPub)
+	if err != nil {
+		return nil, nil, err
+	}
+	msg = append(msg, hs.encryptAndHash(nil)...)
+	return msg, hs.split(), nil
+}
+
+// ReadResponse processes the second message at the initiator,
+// after which the handshake is complete.
+func (hs *Handshake) ReadResponse(msg []byte) (*Session, error) {
+	if !hs.initiator || hs.step != 1 {
+		return nil, ErrHandshakeState
+	}
+	hs.step++
+	if len(msg) != HandshakeResponseSize {
+		return nil, ErrHandshake
+	}
+
+	hs.peerEph = keyFrom(msg[:32])
+	hs.mixHash(msg[:32])
+
+	// ee
+	err := hs.mixDH(hs.eph.Priv, hs.peerEph)
+	if err != nil {
+		return nil, err
+	}
+	// se
+	err = hs.mixDH(hs.static.Priv, hs.peerEph)
+	if err != nil {
+		return nil, err
+	}
+	_, err = hs.decryptAndHash(msg[32:])
+	if err != nil {
+		return nil, err
+	}
+	return hs.split(), nil
+}
+
+func (hs *Handshake) mixHash(data []byte) {
+	d := sha256.New()
+	d.Write(hs.h[:])
+	d.Write(data)
+	copy(hs.h[:], d.Sum(nil))
+}
+
+func (hs *Handshake) mixDH(priv, pub nacl.Key) error {
+	shared, err := curve25519.X25519(priv[:], pub[:])
+	if err != nil {
+		// low order point
+		return ErrHandshake
+	}
+	var k [32]byte
+	hs.ck, k = hkdf2(hs.ck[:], shared)
+	hs.k = &k
+	hs.n = 0
+	return nil
+}
+
+func (hs *Handshake) encryptAndHash(plaintext []byte) []byte {
+	aead, _ := chacha20poly1305.New(hs.k[:])
+	ciphertext := aead.Seal(nil, noiseNonce(hs.n), plaintext, hs.h[:])
+	hs.n++
+	hs.mixHash(ciphertext)
+	return ciphertext
+}
+
+func (hs *Handshake) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	aead, _ := chacha20poly1305.New(hs.k[:])
+	plaintext, err := aead.Open(nil, noiseNonce(hs.n), ciphertext, hs.h[:])
+	if err != nil {
+		return nil, ErrHandshake
+	}
+	hs.n++
+	hs.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+func (hs *Handshake) split() *Session {
+	k1, k2 := hkdf2(hs.ck[:], nil)
+	s := &Session{PeerPub: hs.peerPub, Hash: hs.h}
+	if hs.initiator {
+		s.SendKey, s.RecvKey = &k1, &k2
+	} else {
+		s.SendKey, s.RecvKey = &k2, &k1
+	}
+	// ephemeral keys are no longer needed
+	hs.eph = nil
+	hs.k = nil
+	return s
+}
+
+// hkdf2 is HKDF with two outputs as defined by Noise
+func hkdf2(ck, ikm []byte) ([32]byte, [32]byte) {
+	var out1, out2 [32]byte
+	temp := hmacSHA256(ck, ikm)
+	copy(out1[:], hmacSHA256(temp, []byte{1}))
+	copy(out2[:], hmacSHA256(temp, append(out1[:], 2)))
+	return out1, out2
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func noiseNonce(n uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], n)
+	return nonce
+}
+
+func keyFrom(b []byte) nacl.Key {
+	key := new([nacl.KeySize]byte)
+	copy(key[:], b)
+	return key
+}
@@ -0,0 +1,150 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func testKeys(t *testing.T, n int) []*NodeKey {
+	keys := make([]*NodeKey, n)
+	for i := range keys {
+		k, err := NewNodeKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = k
+	}
+	return keys
+}
+
+func runHandshake(t *testing.T, init, resp *NodeKey, respPub []byte) (*Session, *Session, error) {
+	i := NewHandshakeInitiator(init, keyFrom(respPub))
+	r := NewHandshakeResponder(resp)
+
+	msg, err := i.WriteInit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg) != HandshakeInitSize {
+		t.Fatalf("unexpected init size: %d", len(msg))
+	}
+	err = r.ReadInit(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	msg, rs, err := r.WriteResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	is, err := i.ReadResponse(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return is, rs, nil
+}
+
+func TestHandshake(t *testing.T) {
+	keys := testKeys(t, 3)
+	a, b, c := keys[0], keys[1], keys[2]
+
+	as, bs, err := runHandshake(t, a, b, b.Pub[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(as.SendKey[:], bs.RecvKey[:]) || !bytes.Equal(as.RecvKey[:], bs.SendKey[:]) {
+		t.Fatalf("session keys mismatch")
+	}
+	if bytes.Equal(as.SendKey[:], as.RecvKey[:]) {
+		t.Fatalf("same key in both directions")
+	}
+	if as.Hash != bs.Hash {
+		t.Fatalf("handshake hash mismatch")
+	}
+	if !bytes.Equal(as.PeerPub[:], b.Pub[:]) || !bytes.Equal(bs.PeerPub[:], a.Pub[:]) {
+		t.Fatalf("unexpected peer keys")
+	}
+
+	// fresh ephemeral keys give new session keys
+	as2, _, err := runHandshake(t, a, b, b.Pub[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(as.SendKey[:], as2.SendKey[:]) || as.Hash == as2.Hash {
+		t.Fatalf("session keys reused")
+	}
+
+	// initiator expects c, but b responds
+	_, _, err = runHandshake(t, a, b, c.Pub[:])
+	if err != ErrHandshake {
+		t.Fatalf("unexpected err for wrong responder: %v", err)
+	}
+}
+
+func TestHandshakeTampered(t *testing.T) {
+	keys := testKeys(t, 2)
+	a, b := keys[0], keys[1]
+
+	for i := 0; i < HandshakeInitSize; i++ {
+		init := NewHandshakeInitiator(a, b.Pub)
+		msg, err := init.WriteInit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg[i] ^= 1
+		err = NewHandshakeResponder(b).ReadInit(msg)
+		if err != ErrHandshake {
+			t.Fatalf("tampered init byte %d accepted: %v", i, err)
+		}
+	}
+
+	for i := 0; i < HandshakeResponseSize; i++ {
+		init := NewHandshakeInitiator(a, b.Pub)
+		resp := NewHandshakeResponder(b)
+		msg, err := init.WriteInit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = resp.ReadInit(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, _, err = resp.WriteResponse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg[i] ^= 1
+		_, err = init.ReadResponse(msg)
+		if err != ErrHandshake {
+			t.Fatalf("tampered response byte %d accepted: %v", i, err)
+		}
+	}
+
+	// messages out of order
+	_, err := NewHandshakeInitiator(a, b.Pub).ReadResponse(make([]byte, HandshakeResponseSize))
+	if err != ErrHandshakeState {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	_, err = NewHandshakeResponder(b).WriteInit()
+	if err != ErrHandshakeState {
+		t.Fatalf("unexpected err: %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package crypto
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+
+	crand "crypto/rand"
+
+	nacl "github.com/kevinburke/nacl"
+)
+
+/* Node identity keys and signed statements.
+
+   A NodeKey is a Curve25519 (NaCl box) key, used for key agreement but
+   not for signatures. Each node also has a long-lived Ed25519 IdentityKey
+   with which it signs statements others can verify without interaction:
+   node descriptors, BackResponses, payment tickets.
+
+   Binding: the identity key signs the public NodeKey in a KeyBinding.
+   Anyone can verify that the identity vouches for the NodeKey, and holding
+   the private NodeKey is proven separately by every signaling exchange and
+   handshake with it. A KeyBinding alone does not prove the identity holder
+   also holds the NodeKey: an attacker can bind its own identity to the
+   public NodeKey of another node, but it can then not answer signaling
+   or complete handshakes, so peers must only trust a binding for a NodeKey
+   they have talked to, or alongside a statement signed by the identity.
+
+   Statements are signed over a domain separating prefix, so a signature
+   made for one kind of statement can never be valid for another:
+
+     "orchid signature v1\x00" || domain || "\x00" || message
+*/
+
+const (
+	signaturePrefix = "orchid signature v1\x00"
+
+	DomainKeyBinding     = "key binding"
+	DomainNodeDescriptor = "node descriptor"
+	DomainBackResponse   = "back response"
+	DomainTicket         = "payment ticket"
+)
+
+var (
+	ErrSignature   = errors.New("invalid signature")
+	ErrIdentityKey = errors.New("invalid identity key")
+)
+
+type IdentityKey struct {
+	Pub  ed25519.PublicKey
+	Priv ed25519.PrivateKey
+}
+
+func NewIdentityKey() (*IdentityKey, error) {
+	pub, priv, err := ed25519.GenerateKey(crand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &IdentityKey{pub, priv}, nil
+}
+
+// IdentityKeyFromSeed returns the identity key of a 32 byte seed,
+// as stored in key files
+func IdentityKeyFromSeed(seed []byte) (*IdentityKey, error) {
+	if len(seed) != ed25519.SeedSize {
+		return nil, ErrIdentityKey
+	}
+	priv := ed25519.NewKeyFromSeed(seed)
+	return &IdentityKey{priv.Public().(ed25519.PublicKey), priv}, nil
+}
+
+// Sign signs msg as a statement of kind domain
+func (k *IdentityKey) Sign(domain string, msg []byte) []byte {
+	return ed25519.Sign(k.Priv, signedMessage(domain, msg))
+}
+
+// VerifySignature checks that sig is a signature by pub over msg
+// as a statement of kind domain
+func VerifySignature(pub ed25519.PublicKey, domain string, msg, sig []byte) error {
+	if len(pub) != ed25519.PublicKeySize {
+		return ErrIdentityKey
+	}
+	if !ed25519.Verify(pub, signedMessage(domain, msg), sig) {
+		return ErrSignature
+	}
+	return nil
+}
+
+func signedMessage(domain string, msg []byte) []byte {
+	b := make([]byte, 0, len(signaturePrefix)+len(domain)+1+len(msg))
+	b = append(b, signaturePrefix...)
+	b = append(b, domain...)
+	b = append(b, 0)
+	return append(b, msg...)
+}
+
+// KeyBinding is a statement by an identity key vouching for a NodeKey
+type KeyBinding struct {
+	Identity ed25519.PublicKey
+	NodePub  nacl.Key
+	Sig      []byte
+}
+
+type keyBindingJSON struct {
+	Identity string `json:"identity"`
+	NodePub  string `json:"nodePub"`
+	Sig      string `json:"sig"`
+}
+
+func (k *IdentityKey) Bind(nodePub nacl.Key) *KeyBinding {
+	return &KeyBinding{k.Pub, nodePub, k.Sign(DomainKeyBinding, nodePub[:])}
+}
+
+func (b *KeyBinding) Verify() error {
+	if b.NodePub == nil {
+		return ErrSignature
+	}
+	return VerifySignature(b.Identity, DomainKeyBinding, b.NodePub[:], b.Sig)
+}
+
+// Binds checks that b is a valid binding of nodePub
+func (b *KeyBinding) Binds(nodePub nacl.Key) error {
+	if b.NodePub == nil || nodePub == nil || !bytes.Equal(b.NodePub[:], nodePub[:]) {
+		return ErrSignature
+	}
+	return b.Verify()
+}
+
+func (b *KeyBinding) MarshalJSON() ([]byte, error) {
+	nodePub := ""
+	if b.NodePub != nil {
+		nodePub = hex.EncodeToString(b.NodePub[:])
+	}
+	return json.Marshal(keyBindingJSON{
+		hex.EncodeToString(b.Identity),
+		nodePub,
+		hex.EncodeToString(b.Sig),
+	})
+}
+
+func (b *KeyBinding) UnmarshalJSON(j []byte) error {
+	bJSON := new(keyBindingJSON)
+	err := json.Unmarshal(j, bJSON)
+	if err != nil {
+		return err
+	}
+	identity, err := hex.DecodeString(bJSON.Identity)
+	if err != nil {
+		return err
+	}
+	nodePub, err := nacl.Load(bJSON.NodePub)
+	if err != nil {
+		return err
+	}
+	sig, err := hex.DecodeString(bJSON.Sig)
+	if err != nil {
+		return err
+	}
+	b.Identity, b.NodePub, b.Sig = identity, nodePub, sig
+	return nil
+}
+
+// Identity is the identity key of a node together with the binding
+// of the NodeKey it currently uses
+type Identity struct {
+	Key     *IdentityKey
+	Binding *KeyBinding
+}
+
+func NewIdentity(key *IdentityKey, nodeKey *NodeKey) *Identity {
+	return &Identity{key, key.Bind(nodeKey.Pub)}
+}
+
+// For returns the identity with the binding of nodeKey, for nodes
+// with several keys (see keyset.go)
+func (id *Identity) For(nodeKey *NodeKey) *Identity {
+	if id.Binding != nil && bytes.Equal(id.Binding.NodePub[:], nodeKey.Pub[:]) {
+		return id
+	}
+	return NewIdentity(id.Key, nodeKey)
+}
+
+func (id *Identity) Sign(domain string, msg []byte) []byte {
+	return id.Key.Sign(domain, msg)
+}
@@ -0,0 +1,104 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package crypto
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestIdentitySignatures(t *testing.T) {
+	id, err := NewIdentityKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewIdentityKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := []byte("statement")
+	sig := id.Sign(DomainTicket, msg)
+	err = VerifySignature(id.Pub, DomainTicket, msg, sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name   string
+		pub    []byte
+		domain string
+		msg    []byte
+		err    error
+	}{
+		{"other domain", id.Pub, DomainNodeDescriptor, msg, ErrSignature},
+		{"other msg", id.Pub, DomainTicket, []byte("statemenT"), ErrSignature},
+		{"other key", other.Pub, DomainTicket, msg, ErrSignature},
+		{"invalid key", id.Pub[:16], DomainTicket, msg, ErrIdentityKey},
+	} {
+		err = VerifySignature(test.pub, test.domain, test.msg, sig)
+		if err != test.err {
+			t.Errorf("%s: unexpected err: %v", test.name, err)
+		}
+	}
+
+	seeded, err := IdentityKeyFromSeed(id.Priv.Seed())
+	if err != nil || string(seeded.Pub) != string(id.Pub) {
+		t.Fatalf("unexpected key from seed: %v err: %v", seeded, err)
+	}
+}
+
+func TestKeyBinding(t *testing.T) {
+	id, err := NewIdentityKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := testKeys(t, 2)
+
+	b := id.Bind(keys[0].Pub)
+	j, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b1 := new(KeyBinding)
+	err = json.Unmarshal(j, b1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b1.Binds(keys[0].Pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b1.Binds(keys[1].Pub)
+	if err != ErrSignature {
+		t.Fatalf("unexpected Binds (other key) err: %v", err)
+	}
+
+	// a binding signature is not valid as another statement
+	err = VerifySignature(id.Pub, DomainBackResponse, keys[0].Pub[:], b.Sig)
+	if err != ErrSignature {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	b1.NodePub = keys[1].Pub
+	err = b1.Verify()
+	if err != ErrSignature {
+		t.Fatalf("unexpected Verify (tampered) err: %v", err)
+	}
+}
@@ -0,0 +1,318 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package crypto
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	nacl "github.com/kevinburke/nacl"
+)
+
+/* Key rotation with overlapping validity windows.
+
+   A node holds a KeySet of NodeKeys, each valid from NotBefore until
+   NotAfter (no expiry if zero). Rotate adds a successor key, valid after
+   a lead time, and limits the validity of the keys it replaces to some
+   overlap after the successor becomes valid:
+
+     old key  |------------------------------|
+     new key          |   lead  |------------------------------...
+                      ^ rotate  ^ NotBefore  ^ old NotAfter (overlap)
+
+   During the lead time the new key is the next key: it is already
+   advertised, so peers caching the public keys of the node learn it
+   before it is used. From its NotBefore it is the current key, used for
+   outgoing connections, while offers to the old key are still accepted
+   until the overlap ends.
+
+   Keys are advertised in a KeyAnnouncement signed by the identity key
+   of the node (see identity.go), which also binds them to the identity.
+   Nodes sign their announcement whenever it is fetched, and peers reject
+   announcements issued more than MaxAnnouncementAge ago, so an old
+   announcement cannot be replayed to point them back to retired keys.
+*/
+
+const (
+	DomainKeySet = "key set"
+
+	keyAnnouncementPrefix = "orchid key announcement v1"
+
+	DefaultRotationLead    = 24 * time.Hour
+	DefaultRotationOverlap = 7 * 24 * time.Hour
+
+	// announcements are accepted for this long after they are issued,
+	// and issued up to the skew in the future
+	MaxAnnouncementAge  = time.Hour
+	MaxAnnouncementSkew = 5 * time.Minute
+)
+
+var (
+	ErrNoValidKey        = errors.New("no valid key in key set")
+	ErrAnnouncement      = errors.New("invalid key announcement")
+	ErrAnnouncementStale = errors.New("key announcement not issued recently")
+)
+
+// ValidKey is a NodeKey with its validity window
+type ValidKey struct {
+	Key       *NodeKey
+	NotBefore time.Time
+	NotAfter  time.Time // zero: no expiry
+}
+
+func (k *ValidKey) ValidAt(t time.Time) bool {
+	return !t.Before(k.NotBefore) && (k.NotAfter.IsZero() || t.Before(k.NotAfter))
+}
+
+func (k *ValidKey) expiredAt(t time.Time) bool {
+	return !k.NotAfter.IsZero() && !t.Before(k.NotAfter)
+}
+
+type KeySet struct {
+	mutex sync.RWMutex
+	keys  []*ValidKey // sorted by NotBefore, newest first
+}
+
+// NewKeySet returns a set of keys valid from now on without expiry
+func NewKeySet(keys ...*NodeKey) *KeySet {
+	s := new(KeySet)
+	for _, k := range keys {
+		s.Add(&ValidKey{k, time.Time{}, time.Time{}})
+	}
+	return s
+}
+
+func (s *KeySet) Add(k *ValidKey) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.keys = append(s.keys, k)
+	sort.SliceStable(s.keys, func(i, j int) bool {
+		return s.keys[i].NotBefore.After(s.keys[j].NotBefore)
+	})
+}
+
+// All returns a copy of the keys and windows of the set, newest first
+func (s *KeySet) All() []ValidKey {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	all := make([]ValidKey, len(s.keys))
+	for i, k := range s.keys {
+		all[i] = *k
+	}
+	return all
+}
+
+// Valid returns the keys valid at t, newest first.
+// Offers sealed to any of them are accepted.
+func (s *KeySet) Valid(t time.Time) []*NodeKey {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	keys := []*NodeKey{}
+	for _, k := range s.keys {
+		if k.ValidAt(t) {
+			keys = append(keys, k.Key)
+		}
+	}
+	return keys
+}
+
+// Current returns the newest key valid at t, or nil
+func (s *KeySet) Current(t time.Time) *NodeKey {
+	valid := s.Valid(t)
+	if len(valid) == 0 {
+		return nil
+	}
+	return valid[0]
+}
+
+// Next returns the key that becomes valid after t, or nil
+func (s *KeySet) Next(t time.Time) *ValidKey {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var next *ValidKey
+	for _, k := range s.keys {
+		if k.NotBefore.After(t) && (next == nil || k.NotBefore.Before(next.NotBefore)) {
+			next = k
+		}
+	}
+	return next
+}
+
+// Find returns the key of pub if valid at t, or nil
+func (s *KeySet) Find(pub nacl.Key, t time.Time) *NodeKey {
+	for _, k := range s.Valid(t) {
+		if bytes.Equal(k.Pub[:], pub[:]) {
+			return k
+		}
+	}
+	return nil
+}
+
+// Replace replaces the keys of s by those of other, so that nodes
+// holding s use the keys reloaded from a keystore
+func (s *KeySet) Replace(other *KeySet) {
+	all := other.All()
+	keys := make([]*ValidKey, len(all))
+	for i := range all {
+		keys[i] = &all[i]
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.keys = keys
+}
+
+// Prune removes keys expired at t
+func (s *KeySet) Prune(t time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	keys := s.keys[:0]
+	for _, k := range s.keys {
+		if !k.expiredAt(t) {
+			keys = append(keys, k)
+		}
+	}
+	s.keys = keys
+}
+
+// Rotate adds a new key valid from now+lead, expiring after lifetime
+// (none if zero), and limits the keys valid at or after now to expire
+// overlap after the new key becomes valid.
+func (s *KeySet) Rotate(now time.Time, lead, overlap, lifetime time.Duration) (*ValidKey, error) {
+	key, err := NewNodeKey()
+	if err != nil {
+		return nil, err
+	}
+	next := &ValidKey{key, now.Add(lead), time.Time{}}
+	if lifetime != 0 {
+		next.NotAfter = next.NotBefore.Add(lifetime)
+	}
+
+	end := next.NotBefore.Add(overlap)
+	s.mutex.Lock()
+	for _, k := range s.keys {
+		if !k.expiredAt(now) && (k.NotAfter.IsZero() || k.NotAfter.After(end)) {
+			k.NotAfter = end
+		}
+	}
+	s.mutex.Unlock()
+
+	s.Add(next)
+	return next, nil
+}
+
+// AnnouncedKey is the public part of a ValidKey
+type AnnouncedKey struct {
+	Pub       string    `json:"pub"` // URL base64
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+}
+
+// KeyAnnouncement advertises the current and next keys of a node
+type KeyAnnouncement struct {
+	Identity ed25519.PublicKey `json:"identity"`
+	Issued   time.Time         `json:"issued"`
+	Keys     []AnnouncedKey    `json:"keys"`
+	Sig      []byte            `json:"sig,omitempty"`
+}
+
+// Announce returns the keys of s valid at or after now,
+// signed by id
+func (s *KeySet) Announce(id *IdentityKey, now time.Time) (*KeyAnnouncement, error) {
+	a := &KeyAnnouncement{id.Pub, now.UTC(), []AnnouncedKey{}, nil}
+	for _, k := range s.All() {
+		if !k.expiredAt(now) {
+			a.Keys = append(a.Keys, AnnouncedKey{
+				k.Key.URLBase64(),
+				k.NotBefore.UTC(),
+				k.NotAfter.UTC(),
+			})
+		}
+	}
+	msg, err := a.signedBytes()
+	if err != nil {
+		return nil, err
+	}
+	a.Sig = id.Sign(DomainKeySet, msg)
+	return a, nil
+}
+
+// signedBytes returns the canonical encoding of a signed by its
+// identity: fixed size keys, and times and lengths as big endian
+// integers, so it does not depend on how a was encoded.
+func (a *KeyAnnouncement) signedBytes() ([]byte, error) {
+	if len(a.Identity) != ed25519.PublicKeySize {
+		return nil, ErrAnnouncement
+	}
+	b := append([]byte(keyAnnouncementPrefix), a.Identity...)
+	b = appendTime(b, a.Issued)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(a.Keys)))
+	for _, k := range a.Keys {
+		pub, err := URLBase64ToNACLKey(k.Pub)
+		if err != nil {
+			return nil, ErrAnnouncement
+		}
+		b = append(b, pub[:]...)
+		b = appendTime(b, k.NotBefore)
+		b = appendTime(b, k.NotAfter)
+	}
+	return b, nil
+}
+
+func appendTime(b []byte, t time.Time) []byte {
+	b = binary.BigEndian.AppendUint64(b, uint64(t.Unix()))
+	return binary.BigEndian.AppendUint32(b, uint32(t.Nanosecond()))
+}
+
+// Verify checks that a is signed by identity and was issued recently
+// at t, and returns the announced keys valid at t, newest first
+func (a *KeyAnnouncement) Verify(identity ed25519.PublicKey, t time.Time) ([]nacl.Key, error) {
+	if !bytes.Equal(a.Identity, identity) {
+		return nil, ErrAnnouncement
+	}
+	if a.Issued.Before(t.Add(-MaxAnnouncementAge)) || a.Issued.After(t.Add(MaxAnnouncementSkew)) {
+		return nil, ErrAnnouncementStale
+	}
+	msg, err := a.signedBytes()
+	if err != nil {
+		return nil, err
+	}
+	err = VerifySignature(identity, DomainKeySet, msg, a.Sig)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []nacl.Key{}
+	for _, k := range a.Keys {
+		pub, err := URLBase64ToNACLKey(k.Pub)
+		if err != nil {
+			return nil, ErrAnnouncement
+		}
+		vk := ValidKey{&NodeKey{pub, nil}, k.NotBefore, k.NotAfter}
+		if vk.ValidAt(t) {
+			keys = append(keys, pub)
+		}
+	}
+	return keys, nil
+}
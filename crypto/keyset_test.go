@@ -0,0 +1,144 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package crypto
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestKeySetRotate(t *testing.T) {
+	old := testKeys(t, 1)[0]
+	s := NewKeySet(old)
+	now := time.Now()
+
+	next, err := s.Rotate(now, time.Hour, 2*time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name    string
+		t       time.Time
+		valid   int
+		current *NodeKey
+		next    *ValidKey
+	}{
+		{"lead", now, 1, old, next},
+		{"overlap", now.Add(90 * time.Minute), 2, next.Key, nil},
+		{"after overlap", now.Add(3 * time.Hour), 1, next.Key, nil},
+	} {
+		valid := s.Valid(test.t)
+		if len(valid) != test.valid {
+			t.Errorf("%s: unexpected valid keys: %d", test.name, len(valid))
+		}
+		if s.Current(test.t) != test.current {
+			t.Errorf("%s: unexpected current key", test.name)
+		}
+		if s.Next(test.t) != test.next {
+			t.Errorf("%s: unexpected next key", test.name)
+		}
+		for _, k := range valid {
+			if s.Find(k.Pub, test.t) != k {
+				t.Errorf("%s: valid key not found", test.name)
+			}
+		}
+	}
+	if s.Find(old.Pub, now.Add(3*time.Hour)) != nil {
+		t.Fatalf("expired key found")
+	}
+
+	s.Prune(now.Add(3 * time.Hour))
+	if all := s.All(); len(all) != 1 || all[0].Key != next.Key {
+		t.Fatalf("unexpected keys after Prune: %v", all)
+	}
+
+	// a reloaded set replaces the keys in place
+	s.Replace(NewKeySet(old))
+	if s.Current(now) != old {
+		t.Fatalf("unexpected current key after Replace")
+	}
+}
+
+func TestKeyAnnouncement(t *testing.T) {
+	id, err := NewIdentityKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewIdentityKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := testKeys(t, 1)[0]
+	s := NewKeySet(old)
+	now := time.Now()
+	next, err := s.Rotate(now, 30*time.Minute, 2*time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := s.Announce(id, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := json.Marshal(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a1 := new(KeyAnnouncement)
+	err = json.Unmarshal(j, a1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a1.Keys) != 2 {
+		t.Fatalf("unexpected announced keys: %v", a1.Keys)
+	}
+
+	// peers learn the next key before it is valid
+	keys, err := a1.Verify(id.Pub, now.Add(45*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || *keys[0] != *next.Key.Pub || *keys[1] != *old.Pub {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+
+	// the signature does not depend on the encoding of the times
+	a1.Issued = a1.Issued.In(time.FixedZone("UTC+1", 3600))
+	if _, err := a1.Verify(id.Pub, now); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = a1.Verify(other.Pub, now)
+	if err != ErrAnnouncement {
+		t.Fatalf("unexpected Verify (other identity) err: %v", err)
+	}
+	// old announcements cannot be replayed, nor future ones used
+	for _, at := range []time.Time{now.Add(MaxAnnouncementAge + time.Second), now.Add(-2 * MaxAnnouncementSkew)} {
+		if _, err := a1.Verify(id.Pub, at); err != ErrAnnouncementStale {
+			t.Fatalf("unexpected Verify (%v after issued) err: %v", at.Sub(now), err)
+		}
+	}
+	a1.Keys[0].NotAfter = a1.Keys[0].NotAfter.Add(time.Hour)
+	_, err = a1.Verify(id.Pub, now)
+	if err != ErrSignature {
+		t.Fatalf("unexpected Verify (tampered) err: %v", err)
+	}
+}
@@ -0,0 +1,551 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package crypto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	crand "crypto/rand"
+
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	nacl "github.com/kevinburke/nacl"
+	"github.com/kevinburke/nacl/secretbox"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/scrypt"
+)
+
+/* On-disk keystore for NodeKeys.
+
+   Each key is stored in its own file in the keystore directory, named
+   after the URL base64 public key, with the private key encrypted by
+   secretbox with a key derived from a passphrase by scrypt:
+
+     {
+       "version": 1,
+       "pub": "<hex>",
+       "crypto": {
+         "kdf": "scrypt",
+         "kdfparams": {"n": 262144, "r": 8, "p": 1, "salt": "<hex>"},
+         "cipher": "secretbox",
+         "nonce": "<hex>",
+         "ciphertext": "<hex>"
+       }
+     }
+
+   The public key is authenticated by sealing it together with the
+   private key, so a key file cannot be tampered with
+   to pair another public key with the private key.
+
+   The Ed25519 identity key of the node (see identity.go) is stored the
+   same way in identity.json, encrypting its 32 byte seed, and its
+   Ethereum account (see account.go) in account.json. The validity
+   windows of the keys (see keyset.go) are kept in keyset.json.
+
+   Key files with scrypt parameters costlier than the standard ones are
+   rejected, so a planted key file cannot make opening it take unbounded
+   memory or time.
+
+   The keystore refuses to use a directory or key files that can be
+   accessed by other users (except on Windows, where permissions
+   are not checked).
+*/
+
+const (
+	keyFileVersion  = 1
+	keyFileExt      = ".json"
+	identityKeyFile = "identity" + keyFileExt
+	accountKeyFile  = "account" + keyFileExt
+	keySetFile      = "keyset" + keyFileExt
+
+	// scrypt parameters, as used by go-ethereum keystores
+	StandardScryptN = 1 << 18
+	StandardScryptP = 1
+	LightScryptN    = 1 << 12
+	LightScryptP    = 6
+
+	scryptR       = 8
+	scryptSaltLen = 32
+)
+
+var (
+	ErrKeyNotFound    = errors.New("key not found in keystore")
+	ErrKeyExists      = errors.New("key already in keystore")
+	ErrPassphrase     = errors.New("could not decrypt key with passphrase")
+	ErrKeyFile        = errors.New("invalid key file")
+	ErrKeyPermissions = errors.New("keystore accessible by other users")
+)
+
+type KeyStore struct {
+	dir     string
+	scryptN int
+	scryptP int
+}
+
+type keyFileJSON struct {
+	Version int           `json:"version"`
+	Pub     string        `json:"pub"`
+	Crypto  keyCryptoJSON `json:"crypto"`
+}
+
+type keyCryptoJSON struct {
+	KDF        string        `json:"kdf"`
+	KDFParams  scryptKDFJSON `json:"kdfparams"`
+	Cipher     string        `json:"cipher"`
+	Nonce      string        `json:"nonce"`
+	Ciphertext string        `json:"ciphertext"`
+}
+
+// validity window of a key in a KeySet
+type keyWindowJSON struct {
+	Pub       string    `json:"pub"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+}
+
+type scryptKDFJSON struct {
+	N    int    `json:"n"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+	Salt string `json:"salt"`
+}
+
+// NewKeyStore opens the keystore in dir, creating it if needed, encrypting
+// new keys with scrypt parameters n and p.
+func NewKeyStore(dir string, n, p int) (*KeyStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	err = checkPermissions(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyStore{dir, n, p}, nil
+}
+
+// Store encrypts key with passphrase and writes it to a new key file
+func (ks *KeyStore) Store(key *NodeKey, passphrase string) error {
+	b, err := EncryptKey(key, passphrase, ks.scryptN, ks.scryptP)
+	if err != nil {
+		return err
+	}
+	return ks.write(key.Pub, b)
+}
+
+// List returns the public keys in the keystore, sorted by file name
+func (ks *KeyStore) List() ([]nacl.Key, error) {
+	files, err := ioutil.ReadDir(ks.dir)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, f := range files {
+		if f.Mode().IsRegular() && strings.HasSuffix(f.Name(), keyFileExt) {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+
+	keys := []nacl.Key{}
+	for _, name := range names {
+		pub, err := URLBase64ToNACLKey(strings.TrimSuffix(name, keyFileExt))
+		if err != nil {
+			continue // not a key file
+		}
+		keys = append(keys, pub)
+	}
+	return keys, nil
+}
+
+// Unlock loads and decrypts the key of pub
+func (ks *KeyStore) Unlock(pub nacl.Key, passphrase string) (*NodeKey, error) {
+	b, err := ks.Export(pub)
+	if err != nil {
+		return nil, err
+	}
+	return DecryptKey(b, passphrase)
+}
+
+// Export returns the still encrypted key file of pub
+func (ks *KeyStore) Export(pub nacl.Key) ([]byte, error) {
+	return ks.readFile(ks.path(pub))
+}
+
+// Import adds the key of an exported key file, which must decrypt with
+// passphrase, encrypted with ksPassphrase, which must unlock the keys
+// already in the keystore, and returns its public key.
+func (ks *KeyStore) Import(b []byte, passphrase, ksPassphrase string) (nacl.Key, error) {
+	key, err := DecryptKey(b, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	err = ks.CheckPassphrase(ksPassphrase)
+	if err != nil {
+		return nil, err
+	}
+	return key.Pub, ks.Store(key, ksPassphrase)
+}
+
+// Empty checks that the keystore holds neither keys nor an identity key
+func (ks *KeyStore) Empty() (bool, error) {
+	pubs, err := ks.List()
+	if err != nil || len(pubs) > 0 {
+		return false, err
+	}
+	_, err = os.Stat(ks.identityPath())
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	return false, err
+}
+
+// CheckPassphrase checks that passphrase unlocks the identity key and
+// keys already in the keystore, so all keys share one passphrase
+func (ks *KeyStore) CheckPassphrase(passphrase string) error {
+	_, err := ks.UnlockIdentity(passphrase)
+	if err != ErrKeyNotFound {
+		return err
+	}
+	pubs, err := ks.List()
+	if err != nil || len(pubs) == 0 {
+		return err
+	}
+	_, err = ks.Unlock(pubs[0], passphrase)
+	return err
+}
+
+// StoreIdentity encrypts the identity key of the node with passphrase.
+// A keystore holds at most one identity key.
+func (ks *KeyStore) StoreIdentity(key *IdentityKey, passphrase string) error {
+	b, err := EncryptIdentityKey(key, passphrase, ks.scryptN, ks.scryptP)
+	if err != nil {
+		return err
+	}
+	return ks.writeFile(ks.identityPath(), b)
+}
+
+// UnlockIdentity loads and decrypts the identity key of the node
+func (ks *KeyStore) UnlockIdentity(passphrase string) (*IdentityKey, error) {
+	b, err := ks.readFile(ks.identityPath())
+	if err != nil {
+		return nil, err
+	}
+	return DecryptIdentityKey(b, passphrase)
+}
+
+// StoreKeySet records the validity windows of the keys of set,
+// which must already be stored, replacing earlier windows
+func (ks *KeyStore) StoreKeySet(set *KeySet) error {
+	windows := []keyWindowJSON{}
+	for _, k := range set.All() {
+		windows = append(windows, keyWindowJSON{k.Key.URLBase64(), k.NotBefore, k.NotAfter})
+	}
+	b, err := json.MarshalIndent(windows, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(ks.dir, keySetFile)
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	err = ks.writeFile(tmp, b)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadKeySet unlocks all keys not expired at now with passphrase.
+// Keys without a recorded validity window never expire.
+func (ks *KeyStore) LoadKeySet(passphrase string, now time.Time) (*KeySet, error) {
+	windows := map[string]keyWindowJSON{}
+	b, err := ks.readFile(filepath.Join(ks.dir, keySetFile))
+	if err != nil && err != ErrKeyNotFound {
+		return nil, err
+	}
+	if err == nil {
+		list := []keyWindowJSON{}
+		err = json.Unmarshal(b, &list)
+		if err != nil {
+			return nil, err
+		}
+		for _, w := range list {
+			windows[w.Pub] = w
+		}
+	}
+
+	pubs, err := ks.List()
+	if err != nil {
+		return nil, err
+	}
+	set := new(KeySet)
+	for _, pub := range pubs {
+		w := windows[NACLKeyToURLBase64(pub)]
+		vk := &ValidKey{nil, w.NotBefore, w.NotAfter}
+		if vk.expiredAt(now) {
+			continue
+		}
+		vk.Key, err = ks.Unlock(pub, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		set.Add(vk)
+	}
+	return set, nil
+}
+
+// StoreAccount encrypts the Ethereum account of the node with passphrase.
+// A keystore holds at most one account.
+func (ks *KeyStore) StoreAccount(account *Account, passphrase string) error {
+	b, err := EncryptAccountKey(account, passphrase, ks.scryptN, ks.scryptP)
+	if err != nil {
+		return err
+	}
+	return ks.writeFile(filepath.Join(ks.dir, accountKeyFile), b)
+}
+
+// UnlockAccount loads and decrypts the Ethereum account of the node
+func (ks *KeyStore) UnlockAccount(passphrase string) (*Account, error) {
+	b, err := ks.readFile(filepath.Join(ks.dir, accountKeyFile))
+	if err != nil {
+		return nil, err
+	}
+	return DecryptAccountKey(b, passphrase)
+}
+
+func (ks *KeyStore) path(pub nacl.Key) string {
+	return filepath.Join(ks.dir, NACLKeyToURLBase64(pub)+keyFileExt)
+}
+
+func (ks *KeyStore) identityPath() string {
+	return filepath.Join(ks.dir, identityKeyFile)
+}
+
+func (ks *KeyStore) readFile(path string) ([]byte, error) {
+	err := checkPermissions(path)
+	if os.IsNotExist(err) {
+		return nil, ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(path)
+}
+
+func (ks *KeyStore) write(pub nacl.Key, b []byte) error {
+	return ks.writeFile(ks.path(pub), b)
+}
+
+func (ks *KeyStore) writeFile(path string, b []byte) error {
+	// O_EXCL: never overwrite a key
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return ErrKeyExists
+	}
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	return f.Close()
+}
+
+// EncryptKey returns the key file of key encrypted with passphrase
+func EncryptKey(key *NodeKey, passphrase string, n, p int) ([]byte, error) {
+	return sealKeyFile(key.PubBytes(), keyPlaintext(key.Pub, key.Priv), passphrase, n, p)
+}
+
+// DecryptKey decrypts a key file with passphrase
+func DecryptKey(b []byte, passphrase string) (*NodeKey, error) {
+	pubBytes, plaintext, err := openKeyFile(b, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if len(pubBytes) != nacl.KeySize || len(plaintext) != 2*nacl.KeySize {
+		return nil, ErrKeyFile
+	}
+	pub := keyFrom(pubBytes)
+	storedPub, priv := keyFrom(plaintext[:nacl.KeySize]), keyFrom(plaintext[nacl.KeySize:])
+	derivedPub, err := curve25519.X25519(priv[:], curve25519.Basepoint)
+	if err != nil || *storedPub != *pub || string(derivedPub) != string(pub[:]) {
+		return nil, ErrKeyFile
+	}
+	return &NodeKey{pub, priv}, nil
+}
+
+// EncryptIdentityKey returns the key file of an identity key,
+// which stores its seed, encrypted with passphrase
+func EncryptIdentityKey(key *IdentityKey, passphrase string, n, p int) ([]byte, error) {
+	return sealKeyFile(key.Pub, key.Priv.Seed(), passphrase, n, p)
+}
+
+// DecryptIdentityKey decrypts an identity key file with passphrase
+func DecryptIdentityKey(b []byte, passphrase string) (*IdentityKey, error) {
+	pub, seed, err := openKeyFile(b, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	key, err := IdentityKeyFromSeed(seed)
+	if err != nil || string(key.Pub) != string(pub) {
+		return nil, ErrKeyFile
+	}
+	return key, nil
+}
+
+// EncryptAccountKey returns the key file of an Ethereum account,
+// with its address as public key, encrypted with passphrase
+func EncryptAccountKey(account *Account, passphrase string, n, p int) ([]byte, error) {
+	return sealKeyFile(account.Address[:], ethcrypto.FromECDSA(account.Key), passphrase, n, p)
+}
+
+// DecryptAccountKey decrypts an account key file with passphrase
+func DecryptAccountKey(b []byte, passphrase string) (*Account, error) {
+	address, secret, err := openKeyFile(b, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ethcrypto.ToECDSA(secret)
+	if err != nil {
+		return nil, ErrKeyFile
+	}
+	account := accountFromKey(key)
+	if !bytes.Equal(account.Address[:], address) {
+		return nil, ErrKeyFile
+	}
+	return account, nil
+}
+
+// sealKeyFile encrypts the secret of the key pub
+func sealKeyFile(pub, secret []byte, passphrase string, n, p int) ([]byte, error) {
+	salt := make([]byte, scryptSaltLen)
+	_, err := crand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	kdfParams := scryptKDFJSON{n, scryptR, p, hex.EncodeToString(salt)}
+	derived, err := deriveScryptKey(passphrase, kdfParams, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := nacl.NewNonce()
+	ciphertext := secretbox.Seal(nil, secret, nonce, derived)
+	return json.MarshalIndent(keyFileJSON{
+		keyFileVersion,
+		hex.EncodeToString(pub),
+		keyCryptoJSON{
+			"scrypt",
+			kdfParams,
+			"secretbox",
+			hex.EncodeToString(nonce[:]),
+			hex.EncodeToString(ciphertext),
+		},
+	}, "", "  ")
+}
+
+// openKeyFile returns the public key and decrypted secret of a key file
+func openKeyFile(b []byte, passphrase string) ([]byte, []byte, error) {
+	kf := new(keyFileJSON)
+	err := json.Unmarshal(b, kf)
+	if err != nil {
+		return nil, nil, ErrKeyFile
+	}
+	if kf.Version != keyFileVersion || kf.Crypto.KDF != "scrypt" || kf.Crypto.Cipher != "secretbox" {
+		return nil, nil, fmt.Errorf("unsupported key file version %d, kdf %q or cipher %q",
+			kf.Version, kf.Crypto.KDF, kf.Crypto.Cipher)
+	}
+	pub, err := hex.DecodeString(kf.Pub)
+	if err != nil {
+		return nil, nil, ErrKeyFile
+	}
+	salt, err := hex.DecodeString(kf.Crypto.KDFParams.Salt)
+	if err != nil {
+		return nil, nil, ErrKeyFile
+	}
+	nonceBytes, err := hex.DecodeString(kf.Crypto.Nonce)
+	if err != nil || len(nonceBytes) != nacl.NonceSize {
+		return nil, nil, ErrKeyFile
+	}
+	ciphertext, err := hex.DecodeString(kf.Crypto.Ciphertext)
+	if err != nil {
+		return nil, nil, ErrKeyFile
+	}
+
+	derived, err := deriveScryptKey(passphrase, kf.Crypto.KDFParams, salt)
+	if err != nil {
+		return nil, nil, ErrKeyFile
+	}
+	nonce := new([nacl.NonceSize]byte)
+	copy(nonce[:], nonceBytes)
+	secret, ok := secretbox.Open(nil, ciphertext, nonce, derived)
+	if !ok {
+		return nil, nil, ErrPassphrase
+	}
+	return pub, secret, nil
+}
+
+func keyPlaintext(pub, priv nacl.Key) []byte {
+	return append(append([]byte{}, pub[:]...), priv[:]...)
+}
+
+func deriveScryptKey(passphrase string, params scryptKDFJSON, salt []byte) (nacl.Key, error) {
+	if !params.bounded() {
+		return nil, ErrKeyFile
+	}
+	b, err := scrypt.Key([]byte(passphrase), salt, params.N, params.R, params.P, nacl.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	return keyFrom(b), nil
+}
+
+// bounded checks that p costs at most the standard parameters, in
+// memory (N) and in time (N * P), which the light parameters do too
+func (p scryptKDFJSON) bounded() bool {
+	return p.R == scryptR &&
+		p.N > 1 && p.N <= StandardScryptN &&
+		p.P > 0 && p.N*p.P <= StandardScryptN*StandardScryptP
+}
+
+// checkPermissions fails if path can be accessed by other users
+func checkPermissions(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		return ErrKeyPermissions
+	}
+	return nil
+}
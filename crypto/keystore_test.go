@@ -0,0 +1,254 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package crypto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	nacl "github.com/kevinburke/nacl"
+)
+
+func TestKeyStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "orchid-keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ks, err := NewKeyStore(filepath.Join(dir, "keys"), LightScryptN, LightScryptP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := testKeys(t, 2)
+	for _, k := range keys {
+		err = ks.Store(k, "pass")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = ks.Store(keys[0], "other")
+	if err != ErrKeyExists {
+		t.Fatalf("unexpected Store (existing) err: %v", err)
+	}
+
+	pubs, err := ks.List()
+	if err != nil || len(pubs) != 2 {
+		t.Fatalf("unexpected List: %v err: %v", pubs, err)
+	}
+
+	key, err := ks.Unlock(keys[1].Pub, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *key.Pub != *keys[1].Pub || *key.Priv != *keys[1].Priv {
+		t.Fatalf("unexpected unlocked key")
+	}
+	_, err = ks.Unlock(keys[1].Pub, "wrong")
+	if err != ErrPassphrase {
+		t.Fatalf("unexpected Unlock (wrong passphrase) err: %v", err)
+	}
+	_, err = ks.Unlock(testKeys(t, 1)[0].Pub, "pass")
+	if err != ErrKeyNotFound {
+		t.Fatalf("unexpected Unlock (missing) err: %v", err)
+	}
+
+	// exported key files stay encrypted
+	exported, err := ks.Export(keys[0].Pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(exported, []byte(hexKey(keys[0].Priv))) {
+		t.Fatalf("plaintext private key in key file")
+	}
+	ks2, err := NewKeyStore(filepath.Join(dir, "keys2"), LightScryptN, LightScryptP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ks2.Import(exported, "wrong", "pass2")
+	if err != ErrPassphrase {
+		t.Fatalf("unexpected Import (wrong passphrase) err: %v", err)
+	}
+	// imported keys are encrypted with the passphrase of the keystore
+	if empty, err := ks2.Empty(); !empty || err != nil {
+		t.Fatalf("unexpected Empty: %v err: %v", empty, err)
+	}
+	err = ks2.Store(testKeys(t, 1)[0], "pass2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if empty, err := ks2.Empty(); empty || err != nil {
+		t.Fatalf("unexpected Empty: %v err: %v", empty, err)
+	}
+	_, err = ks2.Import(exported, "pass", "wrong")
+	if err != ErrPassphrase {
+		t.Fatalf("unexpected Import (wrong keystore passphrase) err: %v", err)
+	}
+	pub, err := ks2.Import(exported, "pass", "pass2")
+	if err != nil || *pub != *keys[0].Pub {
+		t.Fatalf("unexpected Import: %v err: %v", pub, err)
+	}
+	imported, err := ks2.LoadKeySet("pass2", time.Now())
+	if err != nil || len(imported.All()) != 2 {
+		t.Fatalf("unexpected LoadKeySet after Import: %v err: %v", imported, err)
+	}
+
+	// identity key
+	_, err = ks.UnlockIdentity("pass")
+	if err != ErrKeyNotFound {
+		t.Fatalf("unexpected UnlockIdentity (missing) err: %v", err)
+	}
+	id, err := NewIdentityKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ks.StoreIdentity(id, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ks.StoreIdentity(id, "pass")
+	if err != ErrKeyExists {
+		t.Fatalf("unexpected StoreIdentity (existing) err: %v", err)
+	}
+	id1, err := ks.UnlockIdentity("pass")
+	if err != nil || string(id1.Priv) != string(id.Priv) {
+		t.Fatalf("unexpected UnlockIdentity: %v", err)
+	}
+	_, err = ks.UnlockIdentity("wrong")
+	if err != ErrPassphrase {
+		t.Fatalf("unexpected UnlockIdentity (wrong passphrase) err: %v", err)
+	}
+	pubs, err = ks.List()
+	if err != nil || len(pubs) != 2 {
+		t.Fatalf("unexpected List with identity: %v err: %v", pubs, err)
+	}
+
+	// Ethereum account
+	account, err := NewAccount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ks.StoreAccount(account, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	account1, err := ks.UnlockAccount("pass")
+	if err != nil || account1.Address != account.Address || account1.Key.D.Cmp(account.Key.D) != 0 {
+		t.Fatalf("unexpected UnlockAccount: %v", err)
+	}
+	_, err = ks.UnlockAccount("wrong")
+	if err != ErrPassphrase {
+		t.Fatalf("unexpected UnlockAccount (wrong passphrase) err: %v", err)
+	}
+
+	// validity windows
+	set := NewKeySet(keys...)
+	now := time.Now()
+	next, err := set.Rotate(now.Add(-2*time.Hour), time.Hour, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ks.Store(next.Key, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ks.StoreKeySet(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ks.StoreKeySet(set)
+	if err != nil {
+		t.Fatalf("StoreKeySet (replace) err: %v", err)
+	}
+	loaded, err := ks.LoadKeySet("pass", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the rotated keys have expired
+	all := loaded.All()
+	if len(all) != 1 || *all[0].Key.Priv != *next.Key.Priv || !all[0].NotBefore.Equal(next.NotBefore) {
+		t.Fatalf("unexpected loaded key set: %v", all)
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	err = os.Chmod(ks.path(keys[0].Pub), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ks.Unlock(keys[0].Pub, "pass")
+	if err != ErrKeyPermissions {
+		t.Fatalf("unexpected Unlock (world readable) err: %v", err)
+	}
+	err = os.Chmod(ks.dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewKeyStore(ks.dir, LightScryptN, LightScryptP)
+	if err != ErrKeyPermissions {
+		t.Fatalf("unexpected NewKeyStore (world readable) err: %v", err)
+	}
+}
+
+func TestDecryptKeyTampered(t *testing.T) {
+	keys := testKeys(t, 2)
+	b, err := EncryptKey(keys[0], "pass", LightScryptN, LightScryptP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// pair the encrypted private key with another public key
+	tampered := bytes.Replace(b, []byte(hexKey(keys[0].Pub)), []byte(hexKey(keys[1].Pub)), 1)
+	_, err = DecryptKey(tampered, "pass")
+	if err != ErrKeyFile {
+		t.Fatalf("unexpected DecryptKey (tampered pub) err: %v", err)
+	}
+	_, err = DecryptKey([]byte("{"), "pass")
+	if err != ErrKeyFile {
+		t.Fatalf("unexpected DecryptKey (malformed) err: %v", err)
+	}
+	// scrypt parameters above the standard ones
+	for _, params := range [][3]int{{1 << 30, 8, 1}, {LightScryptN, 1024, LightScryptP}, {LightScryptN, 8, 1000}} {
+		var kf keyFileJSON
+		if err := json.Unmarshal(b, &kf); err != nil {
+			t.Fatal(err)
+		}
+		kf.Crypto.KDFParams.N, kf.Crypto.KDFParams.R, kf.Crypto.KDFParams.P = params[0], params[1], params[2]
+		costly, err := json.Marshal(kf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = DecryptKey(costly, "pass")
+		if err != ErrKeyFile {
+			t.Fatalf("unexpected DecryptKey (%v) err: %v", params, err)
+		}
+	}
+}
+
+func hexKey(k nacl.Key) string {
+	return hex.EncodeToString(k[:])
+}
@@ -0,0 +1,207 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+
+	nacl "github.com/kevinburke/nacl"
+	naclbox "github.com/kevinburke/nacl/box"
+	"github.com/kevinburke/nacl/secretbox"
+)
+
+/* Layered (onion) encryption for multi-hop circuits.
+
+   The source shares an OnionLayer with every hop of a circuit, derived from
+   a NaCl box key agreement between a per-hop ephemeral key of the source and
+   the static key of the hop. Messages towards the exit are wrapped with the
+   forward key of every layer, last hop first, so each hop can only peel its
+   own layer. Messages towards the source are wrapped by each hop with its
+   backward key and peeled by the source, first hop first.
+
+   Each wrap uses secretbox with a random nonce.
+   Circuit traffic is carried in fixed size cells (see the cell package) so
+   wrapped messages do not leak payload lengths.
+
+   Frames keep their size through all layers, so a hop cannot tell its
+   position in the circuit from it. A message is padded with OnionPadding
+   random bytes into a frame: its body, followed by a tail. Wrapping seals
+   the body, keeps the first len(body) bytes of the sealed box as the new
+   body and moves the remaining OnionOverhead bytes to the front of the
+   tail, dropping as many from the end of the tail. Peeling reverses
+   this, appending random bytes to the tail. Up to MaxOnionLayers layers,
+   only padding is dropped:
+
+     message | padding                 wrapped by the exit, 1 layer
+     body 1  | box 1 | padding         wrapped by the relay, 2 layers
+     body 2  | box 2 | box 1 | padding
+*/
+
+const (
+	onionForwardLabel  = "orchid onion forward"
+	onionBackwardLabel = "orchid onion backward"
+
+	// per layer overhead: nonce and MAC
+	OnionOverhead = nacl.NonceSize + secretbox.Overhead
+	// max layers of an onion, that is hops of a circuit
+	MaxOnionLayers = 4
+	// bytes added to every message wrapped into a frame
+	OnionPadding = MaxOnionLayers * OnionOverhead
+)
+
+var (
+	ErrOnionPeel = errors.New("could not peel onion layer")
+	ErrOnionSize = errors.New("onion frame too short")
+)
+
+type OnionLayer struct {
+	forward  nacl.Key // source -> hop
+	backward nacl.Key // hop -> source
+}
+
+// NewOnionLayer derives the layer shared between the holders of the
+// private keys of peerPub and priv; both ends derive the same layer.
+func NewOnionLayer(peerPub, priv nacl.Key) *OnionLayer {
+	shared := naclbox.Precompute(peerPub, priv)
+	return &OnionLayer{
+		deriveKey(shared, onionForwardLabel),
+		deriveKey(shared, onionBackwardLabel),
+	}
+}
+
+func deriveKey(shared nacl.Key, label string) nacl.Key {
+	mac := hmac.New(sha256.New, shared[:])
+	mac.Write([]byte(label))
+	key := new([nacl.KeySize]byte)
+	copy(key[:], mac.Sum(nil))
+	return key
+}
+
+// PadOnion pads msg into a frame without layers
+func PadOnion(msg []byte) []byte {
+	frame := make([]byte, len(msg)+OnionPadding)
+	copy(frame, msg)
+	randomFill(frame[len(msg):])
+	return frame
+}
+
+// UnpadOnion returns the message of a frame without layers
+func UnpadOnion(frame []byte) ([]byte, error) {
+	if len(frame) < OnionPadding {
+		return nil, ErrOnionSize
+	}
+	return frame[:len(frame)-OnionPadding], nil
+}
+
+func randomFill(b []byte) {
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// wrapFrame seals the body of frame with key, keeping its size.
+// Frames shorter than OnionPadding are returned as they are.
+func wrapFrame(frame []byte, key nacl.Key) []byte {
+	if len(frame) < OnionPadding {
+		return frame
+	}
+	n := len(frame) - OnionPadding
+	box := secretbox.EasySeal(frame[:n], key)
+	wrapped := make([]byte, len(frame))
+	copy(wrapped, box)
+	copy(wrapped[len(box):], frame[n:])
+	return wrapped
+}
+
+// peelFrame opens the body of frame with key, keeping its size
+func peelFrame(frame []byte, key nacl.Key) ([]byte, error) {
+	if len(frame) < OnionPadding {
+		return nil, ErrOnionSize
+	}
+	n := len(frame) - OnionPadding + OnionOverhead
+	body, err := secretbox.EasyOpen(frame[:n], key)
+	if err != nil {
+		return nil, ErrOnionPeel
+	}
+	peeled := make([]byte, len(frame))
+	copy(peeled, body)
+	copy(peeled[len(body):], frame[n:])
+	randomFill(peeled[len(frame)-OnionOverhead:])
+	return peeled, nil
+}
+
+func (l *OnionLayer) WrapForward(frame []byte) []byte {
+	return wrapFrame(frame, l.forward)
+}
+
+func (l *OnionLayer) PeelForward(frame []byte) ([]byte, error) {
+	return peelFrame(frame, l.forward)
+}
+
+func (l *OnionLayer) WrapBackward(frame []byte) []byte {
+	return wrapFrame(frame, l.backward)
+}
+
+func (l *OnionLayer) PeelBackward(frame []byte) ([]byte, error) {
+	return peelFrame(frame, l.backward)
+}
+
+// SealBackward pads msg of the hop of l and wraps it for the source
+func (l *OnionLayer) SealBackward(msg []byte) []byte {
+	return l.WrapBackward(PadOnion(msg))
+}
+
+// OpenForward peels a frame for the hop of l and returns its message
+func (l *OnionLayer) OpenForward(frame []byte) ([]byte, error) {
+	frame, err := l.PeelForward(frame)
+	if err != nil {
+		return nil, err
+	}
+	return UnpadOnion(frame)
+}
+
+// Onion is the layers of a circuit as seen by the source, first hop first
+type Onion []*OnionLayer
+
+// WrapForward pads msg and wraps it for the last hop of o
+func (o Onion) WrapForward(msg []byte) []byte {
+	frame := PadOnion(msg)
+	for i := len(o) - 1; i >= 0; i-- {
+		frame = o[i].WrapForward(frame)
+	}
+	return frame
+}
+
+// PeelBackward peels a frame wrapped by every hop of o and returns
+// its message
+func (o Onion) PeelBackward(frame []byte) ([]byte, error) {
+	var err error
+	for _, l := range o {
+		frame, err = l.PeelBackward(frame)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return UnpadOnion(frame)
+}
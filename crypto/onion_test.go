@@ -0,0 +1,143 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+// returns the onion as seen by the source and the layer of each hop
+func testOnion(t *testing.T, hops int) (Onion, []*OnionLayer) {
+	onion := Onion{}
+	hopLayers := []*OnionLayer{}
+	for i := 0; i < hops; i++ {
+		hopKey, err := NewNodeKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ephKey, err := NewNodeKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		onion = append(onion, NewOnionLayer(hopKey.Pub, ephKey.Priv))
+		hopLayers = append(hopLayers, NewOnionLayer(ephKey.Pub, hopKey.Priv))
+	}
+	return onion, hopLayers
+}
+
+func TestOnionForward(t *testing.T) {
+	onion, hops := testOnion(t, 3)
+	payload := []byte("GET / HTTP/1.1")
+
+	b := onion.WrapForward(payload)
+	if len(b) != len(payload)+OnionPadding {
+		t.Fatalf("unexpected wrapped len: %d", len(b))
+	}
+
+	for i, hop := range hops {
+		// no hop can peel layers other than its own
+		for j, other := range hops {
+			if j == i {
+				continue
+			}
+			_, err := other.PeelForward(b)
+			if err != ErrOnionPeel {
+				t.Fatalf("hop %d peeled layer of hop %d, err: %v", j, i, err)
+			}
+		}
+
+		if i == len(hops)-1 {
+			break
+		}
+		var err error
+		b, err = hop.PeelForward(b)
+		if err != nil {
+			t.Fatalf("hop %d PeelForward err: %v", i, err)
+		}
+		if bytes.Contains(b, payload) {
+			t.Fatalf("hop %d can read exit-bound payload", i)
+		}
+		// frames do not show hops their position
+		if len(b) != len(payload)+OnionPadding {
+			t.Fatalf("hop %d unexpected peeled len: %d", i, len(b))
+		}
+	}
+
+	b, err := hops[len(hops)-1].OpenForward(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, payload) {
+		t.Fatalf("unexpected payload at exit: %q", b)
+	}
+}
+
+func TestOnionBackward(t *testing.T) {
+	onion, hops := testOnion(t, 3)
+	payload := []byte("HTTP/1.1 200 OK")
+
+	b := hops[len(hops)-1].SealBackward(payload)
+	for i := len(hops) - 2; i >= 0; i-- {
+		b = hops[i].WrapBackward(b)
+	}
+	if len(b) != len(payload)+OnionPadding {
+		t.Fatalf("unexpected wrapped len: %d", len(b))
+	}
+
+	// backward keys differ from forward keys
+	_, err := hops[0].PeelForward(b)
+	if err != ErrOnionPeel {
+		t.Fatalf("unexpected PeelForward err: %v", err)
+	}
+
+	b, err = onion.PeelBackward(b)
+	if err != nil {
+		t.Fatalf("PeelBackward err: %v", err)
+	}
+	if !bytes.Equal(b, payload) {
+		t.Fatalf("unexpected payload at source: %q", b)
+	}
+
+	// a message not wrapped by every hop is rejected
+	_, err = onion.PeelBackward(hops[0].SealBackward(payload))
+	if err != ErrOnionPeel {
+		t.Fatalf("unexpected PeelBackward err: %v", err)
+	}
+}
+
+func TestOnionMaxLayers(t *testing.T) {
+	onion, hops := testOnion(t, MaxOnionLayers)
+	payload := []byte("GET / HTTP/1.1")
+
+	// the padding fits the overhead of every layer
+	b := onion.WrapForward(payload)
+	var err error
+	for _, hop := range hops[:len(hops)-1] {
+		b, err = hop.PeelForward(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err = hops[len(hops)-1].OpenForward(b)
+	if err != nil || !bytes.Equal(b, payload) {
+		t.Fatalf("unexpected payload at exit: %q, err: %v", b, err)
+	}
+}
@@ -0,0 +1,292 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package pow implements the Equihash proof-of-work.
+//
+// Equihash (Biryukov & Khovratovich, https://eprint.iacr.org/2015/946)
+// with parameters (N, K) asks for 2^K distinct indices i_1 .. i_2^K such
+// that the XOR of the N-bit hashes H(input, nonce, i_j) is zero. Solving
+// with Wagner's algorithm is memory-bound, taking ~2^(N/(K+1)+1) hashes
+// of memory, while verification takes 2^K hashes.
+//
+// As in Zcash, solutions are required to respect the tree ordering
+// of Wagner's algorithm: at every level, the two halves collide on the
+// next N/(K+1) bits and the first index of the left half is smaller
+// than the first index of the right half.
+//
+// Leaf hashes are the first N bits of BLAKE2b-512 over a domain tag,
+// the parameters, the input, the nonce and the index. This is not
+// compatible with the Zcash personalised BLAKE2b hashing.
+package pow
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	// max nonces tried by Solve before giving up
+	maxSolveNonces = 1 << 10
+	// max number of entries with equal collision bits that are combined
+	// pairwise per round; bounds the work on unlucky distributions
+	maxCollisionGroup = 16
+)
+
+var (
+	hashDomain = []byte("orchid-equihash")
+
+	ErrInvalidParams   = errors.New("invalid equihash params")
+	ErrNoSolution      = errors.New("no equihash solution found")
+	ErrInvalidSolution = errors.New("invalid equihash solution")
+)
+
+type Params struct {
+	N uint32 `json:"n"`
+	K uint32 `json:"k"`
+}
+
+var (
+	// DefaultParams takes ~2^13 hashes of memory to solve;
+	// see the package benchmarks for solve / verify costs
+	DefaultParams = Params{N: 72, K: 5}
+)
+
+type Solution struct {
+	Nonce   uint64   `json:"nonce"`
+	Indices []uint32 `json:"indices"`
+}
+
+func (p Params) Validate() error {
+	if p.K < 1 || p.N%8 != 0 || p.N > 512 || p.N%(p.K+1) != 0 {
+		return ErrInvalidParams
+	}
+	// indices must fit in uint32
+	if p.collisionBits() < 1 || p.collisionBits() > 30 {
+		return ErrInvalidParams
+	}
+	return nil
+}
+
+func (p Params) String() string {
+	return fmt.Sprintf("equihash(%d, %d)", p.N, p.K)
+}
+
+func (p Params) collisionBits() uint32 {
+	return p.N / (p.K + 1)
+}
+
+func (p Params) solutionSize() int {
+	return 1 << p.K
+}
+
+func (p Params) hashPrefix(input []byte, nonce uint64) []byte {
+	buf := make([]byte, 0, len(hashDomain)+16+len(input)+4)
+	buf = append(buf, hashDomain...)
+	buf = binary.LittleEndian.AppendUint32(buf, p.N)
+	buf = binary.LittleEndian.AppendUint32(buf, p.K)
+	buf = append(buf, input...)
+	buf = binary.LittleEndian.AppendUint64(buf, nonce)
+	return buf
+}
+
+// leafHash returns the N bit hash of index i. prefix must have spare
+// capacity for the index to avoid allocation.
+func (p Params) leafHash(prefix []byte, i uint32) []byte {
+	h := blake2b.Sum512(binary.LittleEndian.AppendUint32(prefix, i))
+	return h[:p.N/8]
+}
+
+// getBits returns n (<= 64) bits of h starting at bit start (big endian)
+func getBits(h []byte, start, n uint32) uint64 {
+	var v uint64
+	for i := start; i < start+n; i++ {
+		bit := (h[i/8] >> (7 - i%8)) & 1
+		v = v<<1 | uint64(bit)
+	}
+	return v
+}
+
+func xorHash(a, b []byte) []byte {
+	x := make([]byte, len(a))
+	for i := range a {
+		x[i] = a[i] ^ b[i]
+	}
+	return x
+}
+
+func isZero(h []byte) bool {
+	for _, b := range h {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func distinct(a, b []uint32) bool {
+	for _, i := range a {
+		for _, j := range b {
+			if i == j {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+type row struct {
+	hash    []byte
+	indices []uint32
+}
+
+// combine orders the two halves of a candidate (sub)solution
+func combine(a, b *row) *row {
+	indices := make([]uint32, 0, len(a.indices)+len(b.indices))
+	if a.indices[0] < b.indices[0] {
+		indices = append(append(indices, a.indices...), b.indices...)
+	} else {
+		indices = append(append(indices, b.indices...), a.indices...)
+	}
+	return &row{xorHash(a.hash, b.hash), indices}
+}
+
+// collide sorts rows on bits [start, start+n) and calls f on every pair
+// of rows with equal bits and distinct indices.
+func collide(rows []*row, start, n uint32, f func(a, b *row)) {
+	sort.Slice(rows, func(i, j int) bool {
+		return getBits(rows[i].hash, start, n) < getBits(rows[j].hash, start, n)
+	})
+	for i := 0; i < len(rows); {
+		bits := getBits(rows[i].hash, start, n)
+		j := i + 1
+		for j < len(rows) && getBits(rows[j].hash, start, n) == bits {
+			j++
+		}
+		end := j
+		if end-i > maxCollisionGroup {
+			end = i + maxCollisionGroup
+		}
+		for a := i; a < end; a++ {
+			for b := a + 1; b < end; b++ {
+				if distinct(rows[a].indices, rows[b].indices) {
+					f(rows[a], rows[b])
+				}
+			}
+		}
+		i = j
+	}
+}
+
+// solveNonce runs Wagner's algorithm for a single nonce
+func (p Params) solveNonce(input []byte, nonce uint64) []uint32 {
+	cb := p.collisionBits()
+	prefix := p.hashPrefix(input, nonce)
+
+	rows := make([]*row, 1<<(cb+1))
+	for i := range rows {
+		rows[i] = &row{p.leafHash(prefix, uint32(i)), []uint32{uint32(i)}}
+	}
+
+	for r := uint32(0); r < p.K-1; r++ {
+		next := make([]*row, 0, len(rows))
+		collide(rows, r*cb, cb, func(a, b *row) {
+			next = append(next, combine(a, b))
+		})
+		rows = next
+	}
+
+	// last round collides on the remaining 2 * cb bits
+	var solution []uint32
+	collide(rows, (p.K-1)*cb, 2*cb, func(a, b *row) {
+		if solution != nil {
+			return
+		}
+		c := combine(a, b)
+		if isZero(c.hash) {
+			solution = c.indices
+		}
+	})
+	return solution
+}
+
+// Solve searches for a solution over input, trying nonces
+// from zero upwards.
+func Solve(p Params, input []byte) (*Solution, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	for nonce := uint64(0); nonce < maxSolveNonces; nonce++ {
+		indices := p.solveNonce(input, nonce)
+		if indices != nil {
+			return &Solution{nonce, indices}, nil
+		}
+	}
+	return nil, ErrNoSolution
+}
+
+// Verify checks that s is a valid solution over input.
+func Verify(p Params, input []byte, s *Solution) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	if s == nil || len(s.Indices) != p.solutionSize() {
+		return ErrInvalidSolution
+	}
+
+	cb := p.collisionBits()
+	seen := make(map[uint32]struct{}, len(s.Indices))
+	prefix := p.hashPrefix(input, s.Nonce)
+	rows := make([]*row, len(s.Indices))
+	for i, index := range s.Indices {
+		if index >= 1<<(cb+1) {
+			return ErrInvalidSolution
+		}
+		if _, ok := seen[index]; ok {
+			return ErrInvalidSolution
+		}
+		seen[index] = struct{}{}
+		rows[i] = &row{p.leafHash(prefix, index), s.Indices[i : i+1]}
+	}
+
+	// walk the tree bottom up, checking ordering and collisions
+	for r := uint32(0); r < p.K; r++ {
+		next := make([]*row, len(rows)/2)
+		for i := range next {
+			a, b := rows[2*i], rows[2*i+1]
+			if a.indices[0] >= b.indices[0] {
+				return ErrInvalidSolution
+			}
+			x := xorHash(a.hash, b.hash)
+			if getBits(x, r*cb, cb) != 0 {
+				return ErrInvalidSolution
+			}
+			next[i] = &row{x, s.Indices[2*i<<r : 2*(i+1)<<r]}
+		}
+		rows = next
+	}
+
+	if !isZero(rows[0].hash) {
+		return ErrInvalidSolution
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pow
+
+import (
+	"testing"
+)
+
+var (
+	testParams = Params{N: 48, K: 5}
+	testInput  = []byte("orchid offer")
+)
+
+func TestSolveVerify(t *testing.T) {
+	s, err := Solve(testParams, testInput)
+	if err != nil {
+		t.Fatalf("Solve err: %v", err)
+	}
+	if len(s.Indices) != 32 {
+		t.Fatalf("unexpected solution size: %d", len(s.Indices))
+	}
+
+	err = Verify(testParams, testInput, s)
+	if err != nil {
+		t.Fatalf("Verify err: %v", err)
+	}
+
+	err = Verify(testParams, []byte("other input"), s)
+	if err != ErrInvalidSolution {
+		t.Fatalf("unexpected Verify (other input) err: %v", err)
+	}
+
+	err = Verify(Params{N: 72, K: 5}, testInput, s)
+	if err != ErrInvalidSolution {
+		t.Fatalf("unexpected Verify (other params) err: %v", err)
+	}
+
+	bad := &Solution{s.Nonce + 1, s.Indices}
+	err = Verify(testParams, testInput, bad)
+	if err != ErrInvalidSolution {
+		t.Fatalf("unexpected Verify (other nonce) err: %v", err)
+	}
+
+	// swapping the two halves breaks the ordering requirement
+	swapped := append(append([]uint32{}, s.Indices[16:]...), s.Indices[:16]...)
+	err = Verify(testParams, testInput, &Solution{s.Nonce, swapped})
+	if err != ErrInvalidSolution {
+		t.Fatalf("unexpected Verify (swapped) err: %v", err)
+	}
+
+	dup := append([]uint32{}, s.Indices...)
+	dup[1] = dup[0]
+	err = Verify(testParams, testInput, &Solution{s.Nonce, dup})
+	if err != ErrInvalidSolution {
+		t.Fatalf("unexpected Verify (duplicate index) err: %v", err)
+	}
+
+	err = Verify(testParams, testInput, &Solution{s.Nonce, s.Indices[:16]})
+	if err != ErrInvalidSolution {
+		t.Fatalf("unexpected Verify (short) err: %v", err)
+	}
+}
+
+func TestParamsValidate(t *testing.T) {
+	for _, p := range []Params{{48, 5}, {96, 5}, {200, 9}, {16, 1}} {
+		if err := p.Validate(); err != nil {
+			t.Fatalf("unexpected %v err: %v", p, err)
+		}
+	}
+	for _, p := range []Params{{0, 0}, {48, 0}, {50, 4}, {36, 5}, {200, 3}} {
+		if err := p.Validate(); err != ErrInvalidParams {
+			t.Fatalf("unexpected %v err: %v", p, err)
+		}
+	}
+}
+
+func benchmarkSolve(b *testing.B, p Params) {
+	for i := 0; i < b.N; i++ {
+		_, err := Solve(p, testInput)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkVerify(b *testing.B, p Params) {
+	s, err := Solve(p, testInput)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := Verify(p, testInput, s)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSolve48_5(b *testing.B)  { benchmarkSolve(b, Params{48, 5}) }
+func BenchmarkSolve72_5(b *testing.B)  { benchmarkSolve(b, Params{72, 5}) }
+func BenchmarkSolve96_5(b *testing.B)  { benchmarkSolve(b, Params{96, 5}) }
+func BenchmarkVerify48_5(b *testing.B) { benchmarkVerify(b, Params{48, 5}) }
+func BenchmarkVerify72_5(b *testing.B) { benchmarkVerify(b, Params{72, 5}) }
+func BenchmarkVerify96_5(b *testing.B) { benchmarkVerify(b, Params{96, 5}) }
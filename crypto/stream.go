@@ -0,0 +1,221 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package crypto
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+
+	nacl "github.com/kevinburke/nacl"
+	"github.com/kevinburke/nacl/secretbox"
+)
+
+/* Encrypted streams over a Session (see handshake.go).
+
+   A SecureConn wraps a byte stream such as a p2p.DCReadWriteCloser and
+   seals everything written to it into records:
+
+     4 byte big endian length of the rest of the record
+     8 byte big endian record counter
+     secretbox of up to MaxRecordPayload bytes
+
+   The nonce of each record is its counter, which starts at zero and is
+   incremented by one for every record sent. Every key is used in one
+   direction of one stream only: each stream derives its own pair of keys
+   from the session keys and a label unique within the session, such as
+   the DataChannel label. Nonces are therefore never reused with the same
+   key.
+
+   The receiver expects the counters in order; a record with a lower
+   counter is a replay and a higher counter means records were dropped
+   or reordered, and either fails the stream. The underlying transport
+   (reliable, ordered DataChannels) never does this by itself.
+
+   After RekeyRecords records or RekeyBytes bytes of payload, whichever
+   comes first, both ends replace the key of that direction with a key
+   derived from it and restart the counter, limiting the data sealed
+   with any one key. The old key cannot be derived from the new one.
+*/
+
+const (
+	MaxRecordPayload = 16 * 1024
+	RekeyRecords     = 1 << 32
+	RekeyBytes       = 1 << 36
+
+	recordLenSize     = 4
+	recordCounterSize = 8
+	maxRecordSize     = recordCounterSize + secretbox.Overhead + MaxRecordPayload
+
+	streamLabel = "orchid stream "
+	rekeyLabel  = "orchid stream rekey"
+)
+
+var (
+	ErrRecordSize   = errors.New("record exceeds max size")
+	ErrRecordOpen   = errors.New("could not open record")
+	ErrRecordReplay = errors.New("replayed record")
+	ErrRecordOrder  = errors.New("record out of order")
+)
+
+// streamKey is the key and nonce state of one direction of a SecureConn
+type streamKey struct {
+	key     nacl.Key
+	counter uint64 // of the next record
+	bytes   uint64 // of payload sealed with key
+
+	maxRecords uint64
+	maxBytes   uint64
+}
+
+func (k *streamKey) nonce() nacl.Nonce {
+	nonce := new([nacl.NonceSize]byte)
+	binary.BigEndian.PutUint64(nonce[:], k.counter)
+	return nonce
+}
+
+// advance is called after every record sealed or opened with k
+func (k *streamKey) advance(n int) {
+	k.counter++
+	k.bytes += uint64(n)
+	if k.counter >= k.maxRecords || k.bytes >= k.maxBytes {
+		k.key = deriveKey(k.key, rekeyLabel)
+		k.counter = 0
+		k.bytes = 0
+	}
+}
+
+type SecureConn struct {
+	rwc io.ReadWriteCloser
+
+	writeMutex sync.Mutex // over send
+	send       *streamKey
+
+	readMutex sync.Mutex // over recv and readBuf
+	recv      *streamKey
+	readBuf   []byte
+}
+
+// NewSecureConn encrypts rwc with keys derived from session for the
+// stream label, which both ends must agree on and must not be used for
+// any other stream of the session.
+func NewSecureConn(rwc io.ReadWriteCloser, session *Session, label string) *SecureConn {
+	// the send key of one end is the recv key of the other
+	return newSecureConn(rwc,
+		deriveKey(session.SendKey, streamLabel+label),
+		deriveKey(session.RecvKey, streamLabel+label),
+		RekeyRecords, RekeyBytes)
+}
+
+func newSecureConn(rwc io.ReadWriteCloser, send, recv nacl.Key, maxRecords, maxBytes uint64) *SecureConn {
+	return &SecureConn{
+		rwc,
+		sync.Mutex{},
+		&streamKey{send, 0, 0, maxRecords, maxBytes},
+		sync.Mutex{},
+		&streamKey{recv, 0, 0, maxRecords, maxBytes},
+		nil,
+	}
+}
+
+func (c *SecureConn) Write(p []byte) (int, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > MaxRecordPayload {
+			n = MaxRecordPayload
+		}
+		err := c.writeRecord(p[:n])
+		if err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (c *SecureConn) writeRecord(payload []byte) error {
+	size := recordCounterSize + secretbox.Overhead + len(payload)
+	record := make([]byte, recordLenSize+recordCounterSize, recordLenSize+size)
+	binary.BigEndian.PutUint32(record, uint32(size))
+	binary.BigEndian.PutUint64(record[recordLenSize:], c.send.counter)
+	record = secretbox.Seal(record, payload, c.send.nonce(), c.send.key)
+	c.send.advance(len(payload))
+
+	// a single Write keeps records whole on streams shared by writers
+	_, err := c.rwc.Write(record)
+	return err
+}
+
+func (c *SecureConn) Read(p []byte) (int, error) {
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+
+	for len(c.readBuf) == 0 {
+		payload, err := c.readRecord()
+		if err != nil {
+			return 0, err
+		}
+		c.readBuf = payload
+	}
+	n := copy(p, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+func (c *SecureConn) readRecord() ([]byte, error) {
+	hdr := make([]byte, recordLenSize+recordCounterSize)
+	_, err := io.ReadFull(c.rwc, hdr)
+	if err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(hdr)
+	if size > maxRecordSize || size < recordCounterSize+secretbox.Overhead {
+		return nil, ErrRecordSize
+	}
+	box := make([]byte, size-recordCounterSize)
+	_, err = io.ReadFull(c.rwc, box)
+	if err != nil {
+		return nil, err
+	}
+
+	counter := binary.BigEndian.Uint64(hdr[recordLenSize:])
+	switch {
+	case counter < c.recv.counter:
+		return nil, ErrRecordReplay
+	case counter > c.recv.counter:
+		return nil, ErrRecordOrder
+	}
+	payload, ok := secretbox.Open(nil, box, c.recv.nonce(), c.recv.key)
+	if !ok {
+		return nil, ErrRecordOpen
+	}
+	c.recv.advance(len(payload))
+	return payload, nil
+}
+
+func (c *SecureConn) Close() error {
+	return c.rwc.Close()
+}
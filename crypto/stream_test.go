@@ -0,0 +1,165 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package crypto
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// pipeBuf is an in-memory stream recording each Write
+type pipeBuf struct {
+	bytes.Buffer
+	writes [][]byte
+}
+
+func (b *pipeBuf) Write(p []byte) (int, error) {
+	b.writes = append(b.writes, append([]byte{}, p...))
+	return b.Buffer.Write(p)
+}
+
+func (b *pipeBuf) Close() error { return nil }
+
+func testSessions(t *testing.T) (*Session, *Session) {
+	keys := testKeys(t, 2)
+	a, b, err := runHandshake(t, keys[0], keys[1], keys[1].Pub[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, b
+}
+
+func TestSecureConn(t *testing.T) {
+	as, bs := testSessions(t)
+	buf := new(pipeBuf)
+	a := NewSecureConn(buf, as, "1")
+	b := NewSecureConn(buf, bs, "1")
+
+	msg := bytes.Repeat([]byte("orchid"), MaxRecordPayload/3)
+	n, err := a.Write(msg)
+	if err != nil || n != len(msg) {
+		t.Fatalf("Write n: %d err: %v", n, err)
+	}
+	if len(buf.writes) != 2 {
+		t.Fatalf("unexpected number of records: %d", len(buf.writes))
+	}
+	if bytes.Contains(buf.Bytes(), []byte("orchid")) {
+		t.Fatalf("plaintext in stream")
+	}
+	got := make([]byte, len(msg))
+	_, err = io.ReadFull(b, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("unexpected msg")
+	}
+
+	// same plaintext, different nonce
+	a.Write([]byte("x"))
+	a.Write([]byte("x"))
+	n = len(buf.writes)
+	if bytes.Equal(buf.writes[n-1][12:], buf.writes[n-2][12:]) {
+		t.Fatalf("nonce reused")
+	}
+
+	// the other direction and other streams use other keys
+	c := NewSecureConn(new(pipeBuf), bs, "1")
+	c.Write([]byte("x"))
+	d := NewSecureConn(new(pipeBuf), as, "2")
+	d.Write([]byte("x"))
+	for _, w := range [][]byte{c.rwc.(*pipeBuf).writes[0], d.rwc.(*pipeBuf).writes[0]} {
+		if bytes.Equal(w, buf.writes[0][:len(w)]) {
+			t.Fatalf("keys reused")
+		}
+	}
+}
+
+func TestSecureConnReplay(t *testing.T) {
+	as, bs := testSessions(t)
+	for _, test := range []struct {
+		name   string
+		mangle func([][]byte) [][]byte
+		err    error
+	}{
+		{"replay", func(r [][]byte) [][]byte { return [][]byte{r[0], r[1], r[1]} }, ErrRecordReplay},
+		{"drop", func(r [][]byte) [][]byte { return [][]byte{r[0], r[2]} }, ErrRecordOrder},
+		{"reorder", func(r [][]byte) [][]byte { return [][]byte{r[1], r[0]} }, ErrRecordOrder},
+		{"tamper", func(r [][]byte) [][]byte {
+			r[1][len(r[1])-1] ^= 1
+			return r
+		}, ErrRecordOpen},
+		{"size", func(r [][]byte) [][]byte {
+			r[0][0] = 0xff
+			return r
+		}, ErrRecordSize},
+	} {
+		buf := new(pipeBuf)
+		a := NewSecureConn(buf, as, test.name)
+		for i := 0; i < 3; i++ {
+			a.Write([]byte{byte(i)})
+		}
+
+		in := new(pipeBuf)
+		for _, r := range test.mangle(buf.writes) {
+			in.Write(r)
+		}
+		b := NewSecureConn(in, bs, test.name)
+		var err error
+		for err == nil {
+			_, err = b.Read(make([]byte, 1))
+		}
+		if err != test.err {
+			t.Errorf("%s: unexpected err: %v", test.name, err)
+		}
+	}
+}
+
+func TestSecureConnRekey(t *testing.T) {
+	as, bs := testSessions(t)
+	for _, limits := range [][2]uint64{{3, RekeyBytes}, {RekeyRecords, 10}} {
+		buf := new(pipeBuf)
+		a := newSecureConn(buf,
+			deriveKey(as.SendKey, streamLabel), nil, limits[0], limits[1])
+		b := newSecureConn(buf,
+			nil, deriveKey(bs.RecvKey, streamLabel), limits[0], limits[1])
+
+		sendKey := *a.send.key
+		for i := 0; i < 10; i++ {
+			msg := []byte{byte(i), 1, 2, 3}
+			a.Write(msg)
+			got := make([]byte, len(msg))
+			_, err := io.ReadFull(b, got)
+			if err != nil {
+				t.Fatalf("limits %v record %d: %v", limits, i, err)
+			}
+			if !bytes.Equal(got, msg) {
+				t.Fatalf("unexpected msg")
+			}
+		}
+		if *a.send.key == sendKey || a.send.counter >= limits[0] || a.send.bytes >= limits[1] {
+			t.Fatalf("limits %v: no rekey", limits)
+		}
+		if *a.send.key != *b.recv.key || a.send.counter != b.recv.counter {
+			t.Fatalf("limits %v: keys out of sync", limits)
+		}
+	}
+}
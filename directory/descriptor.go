@@ -0,0 +1,351 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package directory maintains the list of known nodes sources build
+// circuits through, as signed node descriptors.
+package directory
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Gustav-Simonsson/orchid-lib/crypto"
+	"github.com/Gustav-Simonsson/orchid-lib/p2p"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	nacl "github.com/kevinburke/nacl"
+)
+
+/* Node descriptors
+
+   A NodeDescriptor advertises a node and what it offers:
+
+   - keys: the identity key of the node and the binding of the NodeKey
+     sources seal offers to and handshake with (see crypto/identity.go),
+     and optionally the binding of its Ethereum account, which holds the
+     stake of the node and receives its payments (see crypto/account.go)
+   - the signaling URLs (endpoints) and versions the node answers offers on
+   - its roles, relay and/or exit
+   - the bandwidth it offers, in bytes per second
+   - for exits, a summary of the exit policy
+   - the price of its bandwidth, the expected value of payment tickets
+     per MiB in wei (see payment.Payer), and the stake of its account
+
+   The identity key signs the canonical encoding of a descriptor as a
+   DomainNodeDescriptor statement. Descriptors are exchanged as JSON,
+   but the signature never depends on how the JSON was written. The
+   canonical encoding is, with integers big endian, strings and big
+   integers (minimal big endian magnitude) prefixed by their uint32
+   length, and lists prefixed by their uint32 count:
+
+     "orchid node descriptor v1" || identity (32) || node pub (32) ||
+     account address (20, zero without account) ||
+     endpoints || versions (uint32 each) || roles ||
+     bandwidth (uint64) || exit policy (string, see policy.go) ||
+     price || stake || published (uint64 unix seconds)
+
+   Nodes serve their current descriptor at DescriptorPath (see
+   DescriptorDocument).
+
+   The stake is only claimed: sources weigh it as far as the staking
+   account is confirmed to hold it (see node/select.go).
+*/
+
+const (
+	RoleRelay = "relay"
+	RoleExit  = "exit"
+
+	// well-known path of the descriptor of a node
+	DescriptorPath = "/.well-known/orchid/node.json"
+
+	// descriptors older than this are dropped; nodes republish theirs
+	MaxDescriptorAge = 7 * 24 * time.Hour
+	// max clock difference to the publishing node
+	MaxClockSkew = 5 * time.Minute
+
+	descriptorPrefix = "orchid node descriptor v1"
+)
+
+var (
+	ErrDescriptor        = errors.New("invalid node descriptor")
+	ErrDescriptorExpired = errors.New("node descriptor expired")
+	ErrDescriptorAccount = errors.New("node descriptor account does not bind node")
+)
+
+type NodeDescriptor struct {
+	Identity   *crypto.KeyBinding     `json:"identity"` // binds the NodeKey
+	Account    *crypto.AccountBinding `json:"account,omitempty"`
+	Endpoints  []string               `json:"endpoints"` // signaling URLs
+	Versions   []uint32               `json:"versions"`  // signaling versions
+	Roles      []string               `json:"roles"`
+	Bandwidth  uint64                 `json:"bandwidth"` // bytes per second
+	ExitPolicy *ExitPolicy            `json:"exitPolicy,omitempty"`
+	Price      *big.Int               `json:"price,omitempty"` // wei per MiB
+	Stake      *big.Int               `json:"stake,omitempty"` // wei staked by Account
+	Published  int64                  `json:"published"`       // unix seconds
+	Sig        hexutil.Bytes          `json:"sig"`
+}
+
+// Sign returns a copy of d with the keys of id, published at now and
+// signed by id. The Account binding of d, if any, must bind the
+// current NodeKey of id.
+func (d NodeDescriptor) Sign(id *crypto.Identity, now time.Time) *NodeDescriptor {
+	d.Identity = id.Binding
+	d.Published = now.Unix()
+	d.Sig = id.Sign(crypto.DomainNodeDescriptor, d.Canonical())
+	return &d
+}
+
+// Canonical returns the encoding of d signed by its identity
+func (d *NodeDescriptor) Canonical() []byte {
+	b := []byte(descriptorPrefix)
+	var identity, nodePub []byte
+	if d.Identity != nil {
+		identity = d.Identity.Identity
+		if d.Identity.NodePub != nil {
+			nodePub = d.Identity.NodePub[:]
+		}
+	}
+	b = appendFixed(b, identity, 32)
+	b = appendFixed(b, nodePub, nacl.KeySize)
+	var address common.Address
+	if d.Account != nil {
+		address = d.Account.Address
+	}
+	b = append(b, address[:]...)
+
+	b = appendStrings(b, d.Endpoints)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(d.Versions)))
+	for _, v := range d.Versions {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	b = appendStrings(b, d.Roles)
+	b = binary.BigEndian.AppendUint64(b, d.Bandwidth)
+	policy := ""
+	if d.ExitPolicy != nil {
+		policy = d.ExitPolicy.String()
+	}
+	b = appendBytes(b, []byte(policy))
+	b = appendBytes(b, bigBytes(d.Price))
+	b = appendBytes(b, bigBytes(d.Stake))
+	return binary.BigEndian.AppendUint64(b, uint64(d.Published))
+}
+
+// appendFixed appends v, zero padded or truncated to n bytes
+func appendFixed(b, v []byte, n int) []byte {
+	fixed := make([]byte, n)
+	copy(fixed, v)
+	return append(b, fixed...)
+}
+
+func appendBytes(b, v []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(v)))
+	return append(b, v...)
+}
+
+func appendStrings(b []byte, ss []string) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(ss)))
+	for _, s := range ss {
+		b = appendBytes(b, []byte(s))
+	}
+	return b
+}
+
+func bigBytes(i *big.Int) []byte {
+	if i == nil {
+		return nil
+	}
+	return i.Bytes()
+}
+
+// ID identifies the node of d by its hex identity key
+func (d *NodeDescriptor) ID() string {
+	return hex.EncodeToString(d.Identity.Identity)
+}
+
+// Pub is the NodeKey of the node
+func (d *NodeDescriptor) Pub() nacl.Key {
+	return d.Identity.NodePub
+}
+
+// Has checks if the node has role r
+func (d *NodeDescriptor) Has(r string) bool {
+	for _, dr := range d.Roles {
+		if dr == r {
+			return true
+		}
+	}
+	return false
+}
+
+// Supports checks if the node answers offers of signaling version v
+func (d *NodeDescriptor) Supports(v uint32) bool {
+	for _, dv := range d.Versions {
+		if dv == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Endpoint returns the first signaling URL of the node
+func (d *NodeDescriptor) Endpoint() (*url.URL, error) {
+	if len(d.Endpoints) == 0 {
+		return nil, ErrDescriptor
+	}
+	return parseEndpoint(d.Endpoints[0])
+}
+
+func parseEndpoint(s string) (*url.URL, error) {
+	ref, err := url.Parse(s)
+	if err != nil || (ref.Scheme != "http" && ref.Scheme != "https") || ref.Host == "" {
+		return nil, ErrDescriptor
+	}
+	return ref, nil
+}
+
+// Operator is the staking account of the node, if any
+func (d *NodeDescriptor) Operator() (common.Address, bool) {
+	if d.Account == nil {
+		return common.Address{}, false
+	}
+	return d.Account.Address, true
+}
+
+func (d *NodeDescriptor) expired(now time.Time) bool {
+	return now.Sub(time.Unix(d.Published, 0)) > MaxDescriptorAge
+}
+
+// Verify checks the signatures of d and that it is current at now
+func (d *NodeDescriptor) Verify(now time.Time) error {
+	if d == nil || d.Identity == nil || d.Identity.Verify() != nil {
+		return ErrDescriptor
+	}
+	err := crypto.VerifySignature(d.Identity.Identity, crypto.DomainNodeDescriptor, d.Canonical(), d.Sig)
+	if err != nil {
+		return err
+	}
+
+	published := time.Unix(d.Published, 0)
+	if published.After(now.Add(MaxClockSkew)) {
+		return ErrDescriptor
+	}
+	if d.expired(now) {
+		return ErrDescriptorExpired
+	}
+	if len(d.Endpoints) == 0 || len(d.Versions) == 0 || len(d.Roles) == 0 {
+		return ErrDescriptor
+	}
+	for _, e := range d.Endpoints {
+		if _, err := parseEndpoint(e); err != nil {
+			return err
+		}
+	}
+	for _, r := range d.Roles {
+		if r != RoleRelay && r != RoleExit {
+			return ErrDescriptor
+		}
+	}
+	if d.Has(RoleExit) && (d.ExitPolicy == nil || !d.ExitPolicy.IsExit()) {
+		return ErrDescriptor
+	}
+	if (d.Price != nil && d.Price.Sign() < 0) || (d.Stake != nil && d.Stake.Sign() < 0) {
+		return ErrDescriptor
+	}
+
+	if d.Account == nil {
+		if d.Stake != nil && d.Stake.Sign() != 0 {
+			return ErrDescriptorAccount
+		}
+		return nil
+	}
+	if !bytes.Equal(d.Account.Identity, d.Identity.Identity) {
+		return ErrDescriptorAccount
+	}
+	if d.Account.Binds(d.Account.Address, d.Identity.NodePub) != nil {
+		return ErrDescriptorAccount
+	}
+	return nil
+}
+
+// SignDescriptor returns the descriptor of a node with the fields of
+// template, signed by id for the current key of keys at now, with the
+// binding of account unless nil
+func SignDescriptor(template *NodeDescriptor, keys *crypto.KeySet, id *crypto.Identity, account *crypto.Account, now time.Time) (*NodeDescriptor, error) {
+	key := keys.Current(now)
+	if key == nil {
+		return nil, crypto.ErrNoValidKey
+	}
+	identity := id.For(key)
+	d := *template
+	d.Account = nil
+	if account != nil {
+		binding, err := crypto.NewAccountBinding(account, identity)
+		if err != nil {
+			return nil, err
+		}
+		d.Account = binding
+	}
+	return d.Sign(identity, now), nil
+}
+
+// DescriptorDocument serves the descriptor of a node signed by
+// SignDescriptor at the time of the request
+func DescriptorDocument(template *NodeDescriptor, keys *crypto.KeySet, id *crypto.Identity, account *crypto.Account) p2p.Document {
+	return p2p.Document{Path: DescriptorPath, Get: func() ([]byte, error) {
+		d, err := SignDescriptor(template, keys, id, account, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(d)
+	}}
+}
+
+// FetchDescriptor returns the verified descriptor served by the node at ref
+func FetchDescriptor(ref *url.URL) (*NodeDescriptor, error) {
+	descURL := *ref
+	descURL.Path = DescriptorPath
+	resp, err := p2p.FetchClient.Get(descURL.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching descriptor: HTTP status %d", resp.StatusCode)
+	}
+	d := new(NodeDescriptor)
+	err = json.NewDecoder(io.LimitReader(resp.Body, p2p.MaxSignalSize)).Decode(d)
+	if err != nil {
+		return nil, err
+	}
+	err = d.Verify(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
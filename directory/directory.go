@@ -0,0 +1,311 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package directory
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Gustav-Simonsson/orchid-lib/p2p"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+/* A Directory holds the current descriptor of every known node, keyed
+   by identity. Descriptors are loaded from a local file or fetched from
+   a directory server, which serves the descriptors it knows at Path as
+   a JSON list. Every entry is verified before it is added; invalid
+   entries are logged and skipped, so one bad entry does not hide the
+   other nodes of a list. A newer descriptor of the same identity
+   replaces the older one.
+
+   Descriptors are either configured, loaded from a file or directory
+   server the user chose, or gossiped by other nodes (see node/gossip.go),
+   including those of a cache file. Anyone can create identities, so
+   gossip could flood the directory with nodes of one operator to
+   eclipse the others. A directory therefore holds at most
+   MaxDescriptors; once full, gossip adds no new identities, while
+   configured descriptors replace gossiped ones, oldest first. Callers
+   limit how many identities each gossip peer adds (see AddGossiped), and
+   prefer the Configured descriptors when picking nodes.
+*/
+
+const (
+	// well-known path of the descriptor list of a directory server
+	Path = "/.well-known/orchid/directory.json"
+
+	// max size of a descriptor list
+	MaxListSize = 16 << 20
+
+	// max descriptors of a directory
+	MaxDescriptors = 4096
+)
+
+var ErrDirectoryFull = errors.New("directory full")
+
+type Directory struct {
+	mutex       sync.Mutex
+	descriptors map[string]*NodeDescriptor // by ID
+	configured  map[string]bool            // IDs not learned by gossip
+}
+
+func New() *Directory {
+	return &Directory{
+		descriptors: make(map[string]*NodeDescriptor),
+		configured:  make(map[string]bool),
+	}
+}
+
+// Add verifies d and adds it as configured unless a newer descriptor of
+// the same identity is known
+func (dir *Directory) Add(d *NodeDescriptor, now time.Time) error {
+	_, _, err := dir.add(d, now, true, true)
+	return err
+}
+
+// add adds d like Add, as configured or gossiped, and reports if it was
+// added and if its identity was new, which it only may be if canGrow
+func (dir *Directory) add(d *NodeDescriptor, now time.Time, configured, canGrow bool) (bool, bool, error) {
+	err := d.Verify(now)
+	if err != nil {
+		return false, false, err
+	}
+	dir.mutex.Lock()
+	defer dir.mutex.Unlock()
+	k := d.ID()
+	old, known := dir.descriptors[k]
+	if known && old.Published >= d.Published {
+		if configured {
+			dir.configured[k] = true
+		}
+		return false, false, nil
+	}
+	if !known {
+		if !canGrow {
+			return false, false, nil
+		}
+		if len(dir.descriptors) >= MaxDescriptors {
+			dir.expire(now)
+		}
+		if len(dir.descriptors) >= MaxDescriptors {
+			// gossip is dropped quietly, it is expected to overflow
+			if !configured {
+				return false, false, nil
+			}
+			if !dir.evictGossiped() {
+				return false, false, ErrDirectoryFull
+			}
+		}
+	}
+	dir.descriptors[k] = d
+	if configured {
+		dir.configured[k] = true
+	}
+	return true, !known, nil
+}
+
+// evictGossiped removes the gossiped descriptor published first, if any
+func (dir *Directory) evictGossiped() bool {
+	oldest := ""
+	for k, d := range dir.descriptors {
+		if !dir.configured[k] && (oldest == "" || d.Published < dir.descriptors[oldest].Published) {
+			oldest = k
+		}
+	}
+	if oldest == "" {
+		return false
+	}
+	delete(dir.descriptors, oldest)
+	return true
+}
+
+// expire removes the descriptors expired at now
+func (dir *Directory) expire(now time.Time) {
+	for k, d := range dir.descriptors {
+		if d.expired(now) {
+			delete(dir.descriptors, k)
+			delete(dir.configured, k)
+		}
+	}
+}
+
+// AddAll adds the valid descriptors of ds as configured and returns how
+// many were new, not known or newer than the known descriptor of their
+// node
+func (dir *Directory) AddAll(ds []*NodeDescriptor, now time.Time) int {
+	n, _ := dir.addAll(ds, now, true, MaxDescriptors)
+	return n
+}
+
+// AddGossiped adds the valid descriptors of ds like AddAll, but as
+// gossiped and with at most maxNew identities not known yet, and also
+// returns how many identities were new
+func (dir *Directory) AddGossiped(ds []*NodeDescriptor, now time.Time, maxNew int) (int, int) {
+	return dir.addAll(ds, now, false, maxNew)
+}
+
+func (dir *Directory) addAll(ds []*NodeDescriptor, now time.Time, configured bool, maxNew int) (int, int) {
+	n, ids := 0, 0
+	for _, d := range ds {
+		if d == nil {
+			log.Warn("Skipping null node descriptor")
+			continue
+		}
+		added, isNew, err := dir.add(d, now, configured, ids < maxNew)
+		if err != nil {
+			log.Warn("Skipping node descriptor", "endpoints", d.Endpoints, "err", err)
+			continue
+		}
+		if added {
+			n++
+		}
+		if isNew {
+			ids++
+		}
+	}
+	return n, ids
+}
+
+// All returns the descriptors current at now, sorted by identity
+func (dir *Directory) All(now time.Time) []*NodeDescriptor {
+	return dir.current(now, false)
+}
+
+// Configured returns the configured descriptors current at now, sorted
+// by identity
+func (dir *Directory) Configured(now time.Time) []*NodeDescriptor {
+	return dir.current(now, true)
+}
+
+func (dir *Directory) current(now time.Time, configured bool) []*NodeDescriptor {
+	dir.mutex.Lock()
+	defer dir.mutex.Unlock()
+	dir.expire(now)
+	keys := make([]string, 0, len(dir.descriptors))
+	for k := range dir.descriptors {
+		if !configured || dir.configured[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	ds := make([]*NodeDescriptor, 0, len(keys))
+	for _, k := range keys {
+		ds = append(ds, dir.descriptors[k])
+	}
+	return ds
+}
+
+// With returns the current descriptors of nodes with role r
+func (dir *Directory) With(r string, now time.Time) []*NodeDescriptor {
+	ds := []*NodeDescriptor{}
+	for _, d := range dir.All(now) {
+		if d.Has(r) {
+			ds = append(ds, d)
+		}
+	}
+	return ds
+}
+
+// Load adds the descriptors of the JSON list at path as configured
+func (dir *Directory) Load(path string) (int, error) {
+	return dir.load(path, true)
+}
+
+// LoadCache adds the descriptors of the JSON list at path as gossiped,
+// such as a cache of gossip saved by Save
+func (dir *Directory) LoadCache(path string) (int, error) {
+	return dir.load(path, false)
+}
+
+func (dir *Directory) load(path string, configured bool) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return dir.read(f, configured)
+}
+
+// Save writes the current descriptors to path
+func (dir *Directory) Save(path string) error {
+	b, err := json.MarshalIndent(dir.All(time.Now()), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Clean(path))
+}
+
+// Fetch adds the descriptors served by the directory server at ref
+func (dir *Directory) Fetch(ref *url.URL) (int, error) {
+	listURL := *ref
+	listURL.Path = Path
+	resp, err := p2p.FetchClient.Get(listURL.String())
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("fetching directory: HTTP status %d", resp.StatusCode)
+	}
+	return dir.read(resp.Body, true)
+}
+
+func (dir *Directory) read(r io.Reader, configured bool) (int, error) {
+	ds := []*NodeDescriptor{}
+	err := json.NewDecoder(io.LimitReader(r, MaxListSize)).Decode(&ds)
+	if err != nil {
+		return 0, err
+	}
+	if !configured {
+		n, _ := dir.AddGossiped(ds, time.Now(), MaxDescriptors)
+		return n, nil
+	}
+	return dir.AddAll(ds, time.Now()), nil
+}
+
+// Document serves the current descriptors of dir at Path
+func (dir *Directory) Document() p2p.Document {
+	return p2p.Document{Path: Path, Get: func() ([]byte, error) {
+		return json.Marshal(dir.All(time.Now()))
+	}}
+}
+
+// LoadOrFetch adds the descriptors at source, a directory server URL
+// or a file path
+func (dir *Directory) LoadOrFetch(source string) (int, error) {
+	ref, err := url.Parse(source)
+	if err == nil && (ref.Scheme == "http" || ref.Scheme == "https") {
+		return dir.Fetch(ref)
+	}
+	return dir.Load(source)
+}
@@ -0,0 +1,305 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package directory
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Gustav-Simonsson/orchid-lib/crypto"
+	"github.com/Gustav-Simonsson/orchid-lib/p2p"
+)
+
+func testIdentity(t *testing.T) *crypto.Identity {
+	idKey, err := crypto.NewIdentityKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := crypto.NewNodeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crypto.NewIdentity(idKey, key)
+}
+
+func testTemplate() *NodeDescriptor {
+	return &NodeDescriptor{
+		Endpoints:  []string{"http://127.0.0.1:3201"},
+		Versions:   []uint32{p2p.SignalingVersion},
+		Roles:      []string{RoleRelay, RoleExit},
+		Bandwidth:  1 << 20,
+		ExitPolicy: AcceptAll,
+		Price:      big.NewInt(1e9),
+	}
+}
+
+func testDescriptor(t *testing.T, id *crypto.Identity, account *crypto.AccountBinding, stake *big.Int, now time.Time) *NodeDescriptor {
+	d := testTemplate()
+	d.Account, d.Stake = account, stake
+	return d.Sign(id, now)
+}
+
+func TestExitPolicy(t *testing.T) {
+	p, err := ParseExitPolicy("accept 80,443,8000-8100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for port, ok := range map[uint16]bool{80: true, 443: true, 8050: true, 22: false, 8101: false} {
+		if p.Allows(port) != ok {
+			t.Errorf("port %d: allowed %v", port, !ok)
+		}
+	}
+	if p.String() != "accept 80,443,8000-8100" {
+		t.Fatal(p)
+	}
+	p, _ = ParseExitPolicy("reject 25")
+	if p.Allows(25) || !p.Allows(80) {
+		t.Fatal(p)
+	}
+	if p, _ := ParseExitPolicy(""); p.IsExit() || p.Allows(80) {
+		t.Fatal(p)
+	}
+	for _, s := range []string{"accept", "allow 80", "accept 0", "accept 90-80", "reject 70000"} {
+		if _, err := ParseExitPolicy(s); err != ErrExitPolicy {
+			t.Errorf("%q: %v", s, err)
+		}
+	}
+}
+
+func TestDescriptor(t *testing.T) {
+	now := time.Now()
+	id := testIdentity(t)
+	d := testDescriptor(t, id, nil, nil, now)
+
+	// survives JSON encoding
+	b, err := json.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d1 := new(NodeDescriptor)
+	if err := json.Unmarshal(b, d1); err != nil {
+		t.Fatal(err)
+	}
+	if err := d1.Verify(now); err != nil {
+		t.Fatal(err)
+	}
+	if !d1.ExitPolicy.Allows(443) || d1.Pub() == nil || !d1.Supports(p2p.SignalingVersion) || d1.Price.Cmp(d.Price) != 0 {
+		t.Fatal(d1)
+	}
+
+	// the signature does not depend on the JSON encoding
+	var fields map[string]interface{}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		t.Fatal(err)
+	}
+	b, _ = json.MarshalIndent(fields, "", "\t")
+	d2 := new(NodeDescriptor)
+	if err := json.Unmarshal(b, d2); err != nil {
+		t.Fatal(err)
+	}
+	if err := d2.Verify(now); err != nil || !bytes.Equal(d2.Canonical(), d.Canonical()) {
+		t.Fatal(err)
+	}
+
+	d1.Endpoints = []string{"http://127.0.0.1:3202"}
+	if err := d1.Verify(now); err != crypto.ErrSignature {
+		t.Fatal(err)
+	}
+	d2.Bandwidth++
+	if err := d2.Verify(now); err != crypto.ErrSignature {
+		t.Fatal(err)
+	}
+	if err := d.Verify(now.Add(MaxDescriptorAge + time.Second)); err != ErrDescriptorExpired {
+		t.Fatal(err)
+	}
+	if err := d.Verify(now.Add(-2 * MaxClockSkew)); err != ErrDescriptor {
+		t.Fatal(err)
+	}
+
+	// stake must be claimed by an account bound to the node
+	if err := testDescriptor(t, id, nil, big.NewInt(1), now).Verify(now); err != ErrDescriptorAccount {
+		t.Fatal(err)
+	}
+	account, err := crypto.NewAccount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	binding, err := crypto.NewAccountBinding(account, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testDescriptor(t, id, binding, big.NewInt(1), now).Verify(now); err != nil {
+		t.Fatal(err)
+	}
+	other := testIdentity(t)
+	if err := testDescriptor(t, other, binding, big.NewInt(1), now).Verify(now); err != ErrDescriptorAccount {
+		t.Fatal(err)
+	}
+}
+
+func TestDirectory(t *testing.T) {
+	now := time.Now()
+	ids := []*crypto.Identity{testIdentity(t), testIdentity(t), testIdentity(t)}
+	ds := []*NodeDescriptor{}
+	for _, id := range ids {
+		ds = append(ds, testDescriptor(t, id, nil, nil, now.Add(-time.Hour)))
+	}
+	// invalid and null entries are skipped
+	ds[2].Endpoints = []string{"http://127.0.0.1:1"}
+	ds = append(ds, nil)
+
+	path := filepath.Join(t.TempDir(), "directory.json")
+	b, _ := json.Marshal(ds)
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	dir := New()
+	if n, err := dir.LoadOrFetch(path); n != 2 || err != nil {
+		t.Fatal(n, err)
+	}
+
+	// newer descriptors replace older ones
+	newer := testTemplate()
+	newer.Roles = []string{RoleRelay}
+	newer = newer.Sign(ids[0], now)
+	if err := dir.Add(newer, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.Add(ds[0], now); err != nil {
+		t.Fatal(err)
+	}
+	if all, exits := dir.All(now), dir.With(RoleExit, now); len(all) != 2 || len(exits) != 1 || exits[0].ID() != ds[1].ID() {
+		t.Fatal(all, exits)
+	}
+
+	// served by a directory server
+	mux := http.NewServeMux()
+	doc := dir.Document()
+	mux.HandleFunc(doc.Path, func(w http.ResponseWriter, r *http.Request) {
+		b, _ := doc.Get()
+		w.Write(b)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	fetched := New()
+	if n, err := fetched.LoadOrFetch(server.URL); n != 2 || err != nil {
+		t.Fatal(n, err)
+	}
+
+	if err := dir.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded := New()
+	if n, err := loaded.Load(path); n != 2 || err != nil {
+		t.Fatal(n, err)
+	}
+	if len(loaded.All(now.Add(MaxDescriptorAge))) != 0 {
+		t.Fatal("expired descriptors not dropped")
+	}
+}
+
+func TestDirectoryGossip(t *testing.T) {
+	now := time.Now()
+	dir := New()
+	gossip := func(n int) []*NodeDescriptor {
+		ds := []*NodeDescriptor{}
+		for i := 0; i < n; i++ {
+			ds = append(ds, testDescriptor(t, testIdentity(t), nil, nil, now.Add(-time.Hour)))
+		}
+		return ds
+	}
+
+	// gossip adds a limited number of identities, but updates known ones
+	id := testIdentity(t)
+	ds := append([]*NodeDescriptor{testDescriptor(t, id, nil, nil, now.Add(-time.Hour))}, gossip(2)...)
+	if n, ids := dir.AddGossiped(ds, now, 2); n != 2 || ids != 2 || len(dir.Configured(now)) != 0 {
+		t.Fatal(n, ids)
+	}
+	newer := testDescriptor(t, id, nil, nil, now)
+	if n, ids := dir.AddGossiped([]*NodeDescriptor{ds[2], newer}, now, 0); n != 1 || ids != 0 {
+		t.Fatal(n, ids)
+	}
+
+	// a full directory takes no new gossiped identities, but configured
+	// ones replace gossiped ones
+	if n, ids := dir.AddGossiped(gossip(MaxDescriptors), now, MaxDescriptors); n != MaxDescriptors-2 || ids != n {
+		t.Fatal(n, ids)
+	}
+	if n, _ := dir.AddGossiped(ds[2:], now, 1); n != 0 {
+		t.Fatal(n)
+	}
+	if err := dir.Add(ds[2], now); err != nil {
+		t.Fatal(err)
+	}
+	if all, configured := dir.All(now), dir.Configured(now); len(all) != MaxDescriptors || len(configured) != 1 || configured[0] != ds[2] {
+		t.Fatal(len(all), configured)
+	}
+}
+
+func TestDescriptorDocument(t *testing.T) {
+	id := testIdentity(t)
+	keys := crypto.NewKeySet(&crypto.NodeKey{Pub: id.Binding.NodePub})
+	account, err := crypto.NewAccount()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	doc := DescriptorDocument(testTemplate(), keys, id, account)
+	mux.HandleFunc(doc.Path, func(w http.ResponseWriter, r *http.Request) {
+		b, err := doc.Get()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(b)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	ref, _ := url.Parse(server.URL)
+	d, err := FetchDescriptor(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op, ok := d.Operator(); !ok || op != account.Address || d.ID() != hex.EncodeToString(id.Key.Pub) {
+		t.Fatal(d)
+	}
+}
+
+func TestDirectoryNull(t *testing.T) {
+	dir := New()
+	if n, err := dir.read(strings.NewReader("[null]"), true); n != 0 || err != nil {
+		t.Fatal(n, err)
+	}
+	if err := dir.Add(nil, time.Now()); err != ErrDescriptor {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,138 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package directory
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+/* Exit policy summaries
+
+   The exit policy of a node is summarized, like Tor microdescriptors,
+   as either the destination ports it accepts or the ones it rejects:
+
+     "accept 80,443,8000-8100"
+     "reject 25,465,587"
+
+   The empty policy rejects all ports (the node is no exit).
+*/
+
+var (
+	ErrExitPolicy = errors.New("invalid exit policy")
+)
+
+type PortRange struct {
+	Low  uint16
+	High uint16
+}
+
+type ExitPolicy struct {
+	Accept bool
+	Ports  []PortRange
+}
+
+// AcceptAll is the policy of exits accepting any destination port
+var AcceptAll = &ExitPolicy{true, []PortRange{{1, 65535}}}
+
+func ParseExitPolicy(s string) (*ExitPolicy, error) {
+	if s == "" {
+		return &ExitPolicy{true, nil}, nil
+	}
+	fields := strings.Fields(s)
+	if len(fields) != 2 || (fields[0] != "accept" && fields[0] != "reject") {
+		return nil, ErrExitPolicy
+	}
+	p := &ExitPolicy{fields[0] == "accept", nil}
+	for _, r := range strings.Split(fields[1], ",") {
+		low, high := r, r
+		if i := strings.IndexByte(r, '-'); i >= 0 {
+			low, high = r[:i], r[i+1:]
+		}
+		l, err := strconv.ParseUint(low, 10, 16)
+		if err != nil {
+			return nil, ErrExitPolicy
+		}
+		h, err := strconv.ParseUint(high, 10, 16)
+		if err != nil || l == 0 || h < l {
+			return nil, ErrExitPolicy
+		}
+		p.Ports = append(p.Ports, PortRange{uint16(l), uint16(h)})
+	}
+	return p, nil
+}
+
+// Allows checks if p allows connections to port
+func (p *ExitPolicy) Allows(port uint16) bool {
+	for _, r := range p.Ports {
+		if port >= r.Low && port <= r.High {
+			return p.Accept
+		}
+	}
+	return !p.Accept
+}
+
+// IsExit checks if p allows any port
+func (p *ExitPolicy) IsExit() bool {
+	return !p.Accept || len(p.Ports) > 0
+}
+
+func (p *ExitPolicy) String() string {
+	if p.Accept && len(p.Ports) == 0 {
+		return ""
+	}
+	ranges := make([]string, 0, len(p.Ports))
+	for _, r := range p.Ports {
+		s := strconv.Itoa(int(r.Low))
+		if r.High != r.Low {
+			s += "-" + strconv.Itoa(int(r.High))
+		}
+		ranges = append(ranges, s)
+	}
+	if len(ranges) == 0 {
+		// reject nothing
+		return AcceptAll.String()
+	}
+	action := "reject"
+	if p.Accept {
+		action = "accept"
+	}
+	return action + " " + strings.Join(ranges, ",")
+}
+
+func (p *ExitPolicy) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.String())
+}
+
+func (p *ExitPolicy) UnmarshalJSON(j []byte) error {
+	var s string
+	err := json.Unmarshal(j, &s)
+	if err != nil {
+		return err
+	}
+	parsed, err := ParseExitPolicy(s)
+	if err != nil {
+		return err
+	}
+	*p = *parsed
+	return nil
+}
@@ -0,0 +1,290 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package node
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+
+	webrtc "github.com/Gustav-Simonsson/go-webrtc"
+	"github.com/Gustav-Simonsson/orchid-lib/chain"
+	"github.com/Gustav-Simonsson/orchid-lib/crypto"
+	"github.com/Gustav-Simonsson/orchid-lib/p2p"
+	"github.com/Gustav-Simonsson/orchid-lib/payment"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+/* A Circuit is a path from the source through zero or more relays
+   to an exit: s -> r1 -> r2 -> e (see comments in p2p/tcp.go).
+
+   The source only has a WebRTC peer connection to the first hop,
+   authenticated by a handshake with a fresh key of the circuit.
+   The circuit is extended one hop at a time over the control channel,
+   negotiating an onion layer with every hop, see control.go. Once built,
+   each stream of the circuit is a new DataChannel to the first hop which
+   every relay splices to the next hop, peeling its layer.
+*/
+
+var (
+	ErrNoHops      = errors.New("circuit needs at least one hop")
+	ErrTooManyHops = errors.New("circuit has too many hops")
+)
+
+// circuitPeer is the peer connection of a circuit to its first hop,
+// a *p2p.WebRTCPeer
+type circuitPeer interface {
+	NewDataChannel() (*webrtc.DataChannel, error)
+	Secure(*p2p.DCReadWriteCloser) (io.ReadWriteCloser, error)
+	Done() <-chan struct{}
+	Close() error
+}
+
+type Circuit struct {
+	Hops       []Hop
+	Reputation *Reputation // optional, records payment disputes
+
+	peer     circuitPeer
+	ctrl     *ctrlConn
+	onion    crypto.Onion
+	streamID uint32       // of the last stream
+	tab      *payment.Tab // bytes carried and paid for
+}
+
+// NewCircuit connects to the first hop of a new circuit, checking the
+// block of its BackResponse against head unless nil
+func NewCircuit(first Hop, head chain.HeadProvider) (*Circuit, error) {
+	peer, err := p2p.NewWebRTCPeer(first.URL, first.Pub, head)
+	if err != nil {
+		return nil, err
+	}
+	// the source is not identified by its NodeKey to the first hop
+	circuitKey, err := crypto.NewNodeKey()
+	if err != nil {
+		peer.Close()
+		return nil, err
+	}
+	_, err = peer.Handshake(circuitKey, ControlTimeout)
+	if err != nil {
+		peer.Close()
+		return nil, err
+	}
+	ctrl, err := peer.SecureControl(ControlTimeout)
+	if err != nil {
+		peer.Close()
+		return nil, err
+	}
+
+	c := &Circuit{
+		[]Hop{},
+		nil,
+		peer,
+		newCtrlConn(ctrl),
+		crypto.Onion{},
+		0,
+		new(payment.Tab),
+	}
+	err = c.create(first)
+	if err != nil {
+		peer.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// BuildCircuit connects to hops[0] and extends the circuit through
+// the remaining hops. The last hop should be an exit.
+func BuildCircuit(hops []Hop, head chain.HeadProvider) (*Circuit, error) {
+	if len(hops) == 0 {
+		return nil, ErrNoHops
+	}
+	c, err := NewCircuit(hops[0], head)
+	if err != nil {
+		return nil, err
+	}
+	for _, hop := range hops[1:] {
+		err = c.Extend(hop)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// request sends msg wrapped for the last hop of the circuit
+// and returns the peeled reply
+func (c *Circuit) request(msg *ControlMsg) (*ControlMsg, error) {
+	c.ctrl.wrap = c.onion.WrapForward
+	c.ctrl.peel = c.onion.PeelBackward
+	err := c.ctrl.send(msg)
+	if err != nil {
+		return nil, err
+	}
+	return c.ctrl.recv(ControlTimeout)
+}
+
+// create negotiates the onion layer of hop, the new last hop of the circuit
+func (c *Circuit) create(hop Hop) error {
+	ephKey, err := crypto.NewNodeKey()
+	if err != nil {
+		return err
+	}
+	layer := crypto.NewOnionLayer(hop.Pub, ephKey.Priv)
+
+	// the create message can only be wrapped by the previous hops,
+	// while the reply is also wrapped with the new layer
+	c.ctrl.wrap = c.onion.WrapForward
+	c.ctrl.peel = append(c.onion[:len(c.onion):len(c.onion)], layer).PeelBackward
+	err = c.ctrl.send(createMsg(ephKey))
+	if err != nil {
+		return err
+	}
+	reply, err := c.ctrl.recv(ControlTimeout)
+	if err != nil {
+		return err
+	}
+	err = reply.replyErr(CtrlCreated)
+	if err != nil {
+		return err
+	}
+
+	c.Hops = append(c.Hops, hop)
+	c.onion = append(c.onion, layer)
+	return nil
+}
+
+// Extend asks the last hop of the circuit to connect to next
+func (c *Circuit) Extend(next Hop) error {
+	// the layers of longer circuits do not fit the onion padding
+	if len(c.onion) >= crypto.MaxOnionLayers {
+		return ErrTooManyHops
+	}
+	log.Debug("Extending circuit", "hops", len(c.Hops), "next", next.URL)
+	reply, err := c.request(extendMsg(next))
+	if err != nil {
+		return err
+	}
+	err = reply.replyErr(CtrlExtended)
+	if err != nil {
+		return err
+	}
+	return c.create(next)
+}
+
+// NewStream opens a new onion wrapped stream through the circuit.
+// Can be used as TCPProxy.DstGen
+func (c *Circuit) NewStream() (io.ReadWriteCloser, error) {
+	dc, err := c.peer.NewDataChannel()
+	if err != nil {
+		return nil, err
+	}
+	rwc, err := c.peer.Secure(p2p.NewDCReadWriteCloser(dc, "src"))
+	if err != nil {
+		return nil, err
+	}
+	streamID := atomic.AddUint32(&c.streamID, 1)
+	return c.tab.Conn(sourceOnionConn(rwc, c.onion, streamID)), nil
+}
+
+// Gossip fetches node descriptors for g from the last hop of the
+// circuit and returns how many new descriptors it added to g. Like
+// Extend, it must not be called once the circuit pays.
+func (c *Circuit) Gossip(g *Gossip) (int, error) {
+	c.ctrl.wrap = c.onion.WrapForward
+	c.ctrl.peel = c.onion.PeelBackward
+	return g.request(c.ctrl)
+}
+
+// Ping checks that the last hop of the circuit answers. Like Extend,
+// it must not be called once the circuit pays.
+func (c *Circuit) Ping() error {
+	reply, err := c.request(&ControlMsg{Type: CtrlPing})
+	if err != nil {
+		return err
+	}
+	return reply.replyErr(CtrlPong)
+}
+
+// Pay answers the payment requests of the exit with tickets of payer
+// until the circuit is closed, as long as the budgets requested stay
+// within the bytes carried by its streams (see payment.Tab). The
+// circuit cannot be extended once it pays.
+func (c *Circuit) Pay(payer *payment.Payer) {
+	c.ctrl.wrap = c.onion.WrapForward
+	c.ctrl.peel = c.onion.PeelBackward
+	go c.servePayments(payer)
+}
+
+func (c *Circuit) servePayments(payer *payment.Payer) {
+	for {
+		msg, err := c.ctrl.recv(0)
+		if err != nil {
+			log.Debug("[source] control channel closed", "err", err)
+			return
+		}
+		if msg.Type != CtrlPay || msg.Payment == nil {
+			log.Debug("[source] unexpected control message", "type", msg.Type)
+			continue
+		}
+		t, err := c.pay(payer, msg.Payment)
+		if err != nil {
+			log.Error("[source] payment request", "err", err)
+			if c.Reputation != nil {
+				c.Reputation.Dispute(c.exit().key())
+			}
+			c.ctrl.send(errorMsg(p2p.ErrCodePayment, err.Error()))
+			continue
+		}
+		err = c.ctrl.send(ticketMsg(t))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// exit returns the last hop of the circuit
+func (c *Circuit) exit() Hop {
+	return c.Hops[len(c.Hops)-1]
+}
+
+// pay pays req with payer if the exit carried the bytes it charges for
+func (c *Circuit) pay(payer *payment.Payer, req *payment.Request) (*payment.Ticket, error) {
+	err := c.tab.Charge(req.Budget)
+	if err != nil {
+		return nil, err
+	}
+	t, err := payer.Pay(req, time.Now())
+	if err != nil {
+		c.tab.Refund(req.Budget)
+		return nil, err
+	}
+	return t, nil
+}
+
+// Done is closed when the connection to the first hop has failed or closed
+func (c *Circuit) Done() <-chan struct{} {
+	return c.peer.Done()
+}
+
+func (c *Circuit) Close() error {
+	return c.peer.Close()
+}
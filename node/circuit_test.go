@@ -0,0 +1,187 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package node
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/Gustav-Simonsson/orchid-lib/cell"
+	"github.com/Gustav-Simonsson/orchid-lib/crypto"
+	"github.com/Gustav-Simonsson/orchid-lib/p2p"
+	"github.com/Gustav-Simonsson/orchid-lib/payment"
+)
+
+// frameRecorder records all bytes written through it
+type frameRecorder struct {
+	io.ReadWriteCloser
+	mutex   sync.Mutex
+	written bytes.Buffer
+}
+
+func (r *frameRecorder) Write(p []byte) (int, error) {
+	r.mutex.Lock()
+	r.written.Write(p)
+	r.mutex.Unlock()
+	return r.ReadWriteCloser.Write(p)
+}
+
+func (r *frameRecorder) contains(b []byte) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return bytes.Contains(r.written.Bytes(), b)
+}
+
+func testHop(t *testing.T, port int) (Hop, *crypto.NodeKey) {
+	key, err := crypto.NewNodeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Hop{LocalURL(port), key.Pub, ""}, key
+}
+
+// Builds a source -> relay -> exit circuit over in-memory pipes, running
+// the relay and exit control logic without WebRTC peers.
+func TestCircuitOnion(t *testing.T) {
+	relayHop, relayKey := testHop(t, RelayHTTPPort)
+	exitHop, exitKey := testHop(t, ExitHTTPPort)
+	// next hop of an extend the exit must reject, and the relay never see
+	secretHop := Hop{&url.URL{Scheme: "http", Host: "secret.example:3201"}, exitKey.Pub, ""}
+
+	srcCtrl, relayCtrlIn := net.Pipe()
+	relayCtrlPipe, exitCtrl := net.Pipe()
+	relayCtrlOut := &frameRecorder{ReadWriteCloser: relayCtrlPipe}
+
+	relayLayer := make(chan *crypto.OnionLayer, 1)
+	go func() {
+		ctrl := newCtrlConn(relayCtrlIn)
+		layer, err := ctrl.acceptCreate(relayKey)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		relayLayer <- layer
+		msg, err := ctrl.recv(ControlTimeout)
+		if err != nil || msg.Type != CtrlExtend {
+			t.Errorf("unexpected relay ctrl msg: %v err: %v", msg, err)
+			return
+		}
+		next, err := msg.hop()
+		if err != nil || next.URL.String() != exitHop.URL.String() {
+			t.Errorf("unexpected relay next hop: %v err: %v", next, err)
+			return
+		}
+		ctrl.send(&ControlMsg{Type: CtrlExtended})
+		spliceOnion(relayCtrlIn, relayCtrlOut, layer)
+	}()
+
+	exitLayer := make(chan *crypto.OnionLayer, 1)
+	go func() {
+		ctrl := newCtrlConn(exitCtrl)
+		layer, err := ctrl.acceptCreate(exitKey)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		exitLayer <- layer
+		for {
+			_, err := ctrl.recv(0)
+			if err != nil {
+				return
+			}
+			ctrl.send(errorMsg(p2p.ErrCodeUnexpectedType, "exit does not extend circuits"))
+		}
+	}()
+
+	c := &Circuit{[]Hop{}, nil, nil, newCtrlConn(srcCtrl), crypto.Onion{}, 0, new(payment.Tab)}
+	err := c.create(relayHop)
+	if err != nil {
+		t.Fatalf("create err: %v", err)
+	}
+	err = c.Extend(exitHop)
+	if err != nil {
+		t.Fatalf("Extend err: %v", err)
+	}
+	if len(c.Hops) != 2 || len(c.onion) != 2 {
+		t.Fatalf("unexpected circuit hops: %v", c.Hops)
+	}
+
+	err = c.Extend(secretHop)
+	sigErr, ok := err.(*p2p.SignalingError)
+	if !ok || sigErr.Code != p2p.ErrCodeUnexpectedType {
+		t.Fatalf("unexpected Extend (beyond exit) err: %v", err)
+	}
+	if relayCtrlOut.contains([]byte(secretHop.URL.Host)) {
+		t.Fatalf("relay forwarded readable control message for the exit")
+	}
+
+	// data stream through the circuit
+	srcData, relayDataIn := net.Pipe()
+	relayDataPipe, exitData := net.Pipe()
+	relayDataOut := &frameRecorder{ReadWriteCloser: relayDataPipe}
+	go spliceOnion(relayDataIn, relayDataOut, <-relayLayer)
+
+	src := sourceOnionConn(srcData, c.onion, 1)
+	exit := hopOnionConn(exitData, <-exitLayer)
+
+	req := []byte("GET /orchid-node-test/ HTTP/1.1")
+	go src.Write(req)
+	buf := make([]byte, len(req))
+	_, err = io.ReadFull(exit, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, req) {
+		t.Fatalf("unexpected request at exit: %q", buf)
+	}
+	if relayDataOut.contains(req) {
+		t.Fatalf("relay forwarded readable exit-bound payload")
+	}
+	// frames keep their size through the relay
+	if relayDataOut.written.Len() != 4+cell.Size+crypto.OnionPadding {
+		t.Fatalf("unexpected relayed frame size: %d", relayDataOut.written.Len())
+	}
+
+	// responses longer than a cell are split
+	resp := bytes.Repeat([]byte("HTTP/1.1 200 OK"), cell.MaxPayload/10)
+	go exit.Write(resp)
+	buf = make([]byte, len(resp))
+	_, err = io.ReadFull(src, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, resp) {
+		t.Fatalf("unexpected response at source: %q", buf)
+	}
+
+	// end of stream is signaled through the circuit
+	go exit.Close()
+	_, err = src.Read(buf)
+	if err != io.EOF {
+		t.Fatalf("unexpected src.Read err after exit.Close: %v", err)
+	}
+	src.Close()
+	srcCtrl.Close()
+	exitCtrl.Close()
+}
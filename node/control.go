@@ -0,0 +1,359 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/Gustav-Simonsson/orchid-lib/cell"
+	"github.com/Gustav-Simonsson/orchid-lib/crypto"
+	"github.com/Gustav-Simonsson/orchid-lib/directory"
+	"github.com/Gustav-Simonsson/orchid-lib/p2p"
+	"github.com/Gustav-Simonsson/orchid-lib/payment"
+	nacl "github.com/kevinburke/nacl"
+)
+
+/* Control messages are exchanged as JSON in control cells (see the cell
+   package), one cell per frame, over the control DataChannel
+   (see p2p.ControlLabel) of a WebRTC peer. Messages too long for one
+   cell span up to MaxControlCells cells, the stream ID of each the
+   number of cells of the message still to follow.
+
+   Circuits are built hop by hop. For every hop, the source first sends a
+   create message with a fresh ephemeral public key, from which both derive
+   the onion layer of the hop (see crypto/onion.go). The hop confirms with
+   created, wrapped with the new layer. The source then sends an extend
+   message to the last hop of the circuit, which connects to the requested
+   next hop and replies with extended (or an error). The hop then splices
+   its inbound control channel to the control channel of the next hop,
+   peeling and wrapping its layer, so further control messages from the
+   source reach the new last hop and only it can read them.
+
+   Once the circuit is built, an exit charging for bandwidth sends pay
+   messages with payment requests to the source, which answers each with
+   a ticket message (see payment/meter.go).
+
+   Sources and the last hop of their circuit exchange node descriptors
+   with gossip and gossiped messages, see gossip.go, and sources check
+   that idle circuits still work with ping messages exits answer with
+   pong, see pool.go.
+*/
+
+const (
+	CtrlCreate   = "create"
+	CtrlCreated  = "created"
+	CtrlExtend   = "extend"
+	CtrlExtended = "extended"
+	CtrlError    = "error"
+	CtrlPay      = "pay"
+	CtrlTicket   = "ticket"
+
+	CtrlGossip   = "gossip"
+	CtrlGossiped = "gossiped"
+	CtrlPing     = "ping"
+	CtrlPong     = "pong"
+
+	// max time to wait for a control channel or a control reply
+	ControlTimeout = 30 * time.Second
+
+	// max cells of a control message
+	MaxControlCells = 64
+)
+
+var (
+	ErrCtrlUnexpected = errors.New("unexpected control message")
+	ErrCtrlSize       = errors.New("control message too large")
+)
+
+type ControlMsg struct {
+	Type string `json:"type"`
+
+	// create
+	Key string `json:"key,omitempty"` // URL base64 ephemeral NaCl public key
+
+	// extend
+	URL string `json:"url,omitempty"`
+	Pub string `json:"pub,omitempty"` // URL base64 NaCl public key
+
+	// pay
+	Payment *payment.Request `json:"payment,omitempty"`
+
+	// ticket
+	Ticket *payment.Ticket `json:"ticket,omitempty"`
+
+	// gossip, gossiped
+	Descriptors []*directory.NodeDescriptor `json:"descriptors,omitempty"`
+
+	// error
+	Error *p2p.SignalingError `json:"error,omitempty"`
+}
+
+// Hop is a node of a circuit: its signaling URL and NaCl public key
+type Hop struct {
+	URL *url.URL
+	Pub nacl.Key
+	ID  string // optional, the descriptor ID of the node
+}
+
+// key identifies the node of h by its descriptor ID or else its NodeKey
+func (h Hop) key() string {
+	if h.ID != "" {
+		return h.ID
+	}
+	return crypto.NACLKeyToURLBase64(h.Pub)
+}
+
+// DescriptorHop returns the hop of the node described by d
+func DescriptorHop(d *directory.NodeDescriptor) (Hop, error) {
+	ref, err := d.Endpoint()
+	if err != nil {
+		return Hop{}, err
+	}
+	return Hop{ref, d.Pub(), d.ID()}, nil
+}
+
+func createMsg(ephKey *crypto.NodeKey) *ControlMsg {
+	return &ControlMsg{
+		Type: CtrlCreate,
+		Key:  ephKey.URLBase64(),
+	}
+}
+
+func extendMsg(next Hop) *ControlMsg {
+	return &ControlMsg{
+		Type: CtrlExtend,
+		URL:  next.URL.String(),
+		Pub:  crypto.NACLKeyToURLBase64(next.Pub),
+	}
+}
+
+func payMsg(req *payment.Request) *ControlMsg {
+	return &ControlMsg{
+		Type:    CtrlPay,
+		Payment: req,
+	}
+}
+
+func ticketMsg(t *payment.Ticket) *ControlMsg {
+	return &ControlMsg{
+		Type:   CtrlTicket,
+		Ticket: t,
+	}
+}
+
+func gossipMsg(typ string, ds []*directory.NodeDescriptor) *ControlMsg {
+	return &ControlMsg{
+		Type:        typ,
+		Descriptors: ds,
+	}
+}
+
+func errorMsg(code p2p.ErrorCode, msg string) *ControlMsg {
+	return &ControlMsg{
+		Type:  CtrlError,
+		Error: &p2p.SignalingError{Code: code, Message: msg},
+	}
+}
+
+// hop returns the next hop of an extend message
+func (m *ControlMsg) hop() (Hop, error) {
+	ref, err := url.Parse(m.URL)
+	if err != nil {
+		return Hop{}, err
+	}
+	if ref.Scheme != "http" && ref.Scheme != "https" {
+		return Hop{}, errors.New("unsupported next hop URL scheme")
+	}
+	pub, err := crypto.URLBase64ToNACLKey(m.Pub)
+	if err != nil {
+		return Hop{}, err
+	}
+	return Hop{ref, pub, ""}, nil
+}
+
+// layer derives the onion layer of a hop holding key from a create message
+func (m *ControlMsg) layer(key *crypto.NodeKey) (*crypto.OnionLayer, error) {
+	ephPub, err := crypto.URLBase64ToNACLKey(m.Key)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.NewOnionLayer(ephPub, key.Priv), nil
+}
+
+// replyErr returns the error of an error reply, or ErrCtrlUnexpected
+// unless reply is of type expected
+func (m *ControlMsg) replyErr(expected string) error {
+	switch {
+	case m.Type == expected:
+		return nil
+	case m.Type == CtrlError && m.Error != nil:
+		return m.Error
+	}
+	return ErrCtrlUnexpected
+}
+
+// ctrlConn sends and receives control messages, optionally
+// onion wrapped, over a control channel.
+type ctrlConn struct {
+	rwc       io.ReadWriteCloser
+	wrap      func([]byte) []byte
+	peel      func([]byte) ([]byte, error)
+	sendMutex sync.Mutex
+	gossiped  int // new identities the peer added by gossip
+}
+
+// newCtrlConn returns a ctrlConn padding messages into onion frames
+// without layers, such as the create message of a hop
+func newCtrlConn(rwc io.ReadWriteCloser) *ctrlConn {
+	return &ctrlConn{rwc: rwc, wrap: crypto.PadOnion, peel: crypto.UnpadOnion}
+}
+
+// setLayer makes a hop wrap and peel control messages with its layer
+func (c *ctrlConn) setLayer(layer *crypto.OnionLayer) {
+	c.wrap = layer.SealBackward
+	c.peel = layer.OpenForward
+}
+
+func (c *ctrlConn) send(msg *ControlMsg) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	cells, err := cell.Split(cell.Control, 0, payload)
+	if err != nil {
+		return err
+	}
+	if len(cells) > MaxControlCells {
+		return ErrCtrlSize
+	}
+	frames := make([][]byte, len(cells))
+	for i, ce := range cells {
+		// cells of the message still to follow
+		ce.StreamID = uint32(len(cells) - 1 - i)
+		frames[i], err = ce.Encode()
+		if err != nil {
+			return err
+		}
+	}
+
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+	for _, b := range frames {
+		if c.wrap != nil {
+			b = c.wrap(b)
+		}
+		err = p2p.WriteFrame(c.rwc, b)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recv reads the next control message, giving up after timeout unless
+// timeout is zero. On timeout the ctrlConn can no longer be used.
+func (c *ctrlConn) recv(timeout time.Duration) (*ControlMsg, error) {
+	if timeout == 0 {
+		return c.read(c.peel)
+	}
+	type result struct {
+		msg *ControlMsg
+		err error
+	}
+	done := make(chan result, 1)
+	peel := c.peel
+	go func() {
+		msg, err := c.read(peel)
+		done <- result{msg, err}
+	}()
+	select {
+	case r := <-done:
+		return r.msg, r.err
+	case <-time.After(timeout):
+		return nil, p2p.ErrControlTimeout
+	}
+}
+
+// read reads the cells of the next control message, peeled with peel
+// unless nil
+func (c *ctrlConn) read(peel func([]byte) ([]byte, error)) (*ControlMsg, error) {
+	payload := []byte{}
+	for i := 0; ; i++ {
+		b, err := p2p.ReadFrame(c.rwc)
+		if err != nil {
+			return nil, err
+		}
+		if peel != nil {
+			b, err = peel(b)
+			if err != nil {
+				return nil, err
+			}
+		}
+		ce, err := cell.Decode(b)
+		if err != nil {
+			return nil, err
+		}
+		if ce.Command != cell.Control {
+			return nil, errUnexpectedCell
+		}
+		if i+int(ce.StreamID) >= MaxControlCells {
+			return nil, ErrCtrlSize
+		}
+		payload = append(payload, ce.Payload...)
+		if ce.StreamID == 0 {
+			break
+		}
+	}
+	msg := new(ControlMsg)
+	err := json.Unmarshal(payload, msg)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// acceptCreate reads a create message from the previous hop, derives the
+// onion layer of key and confirms with created wrapped with the new layer.
+func (c *ctrlConn) acceptCreate(key *crypto.NodeKey) (*crypto.OnionLayer, error) {
+	msg, err := c.recv(ControlTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Type != CtrlCreate {
+		c.send(errorMsg(p2p.ErrCodeUnexpectedType, "expected create"))
+		return nil, ErrCtrlUnexpected
+	}
+	layer, err := msg.layer(key)
+	if err != nil {
+		c.send(errorMsg(p2p.ErrCodeMalformed, err.Error()))
+		return nil, err
+	}
+	c.setLayer(layer)
+	err = c.send(&ControlMsg{Type: CtrlCreated})
+	if err != nil {
+		return nil, err
+	}
+	return layer, nil
+}
@@ -0,0 +1,165 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package node
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/Gustav-Simonsson/orchid-lib/crypto"
+	"github.com/Gustav-Simonsson/orchid-lib/directory"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+/* Gossip
+
+   Nodes learn of each other without a central directory by exchanging
+   node descriptors with the sources connected to them. Once a circuit
+   is built, the source sends a gossip message to the last hop, which
+   adds the valid descriptors of the message to its own directory and
+   answers with a gossiped message with a sample of its directory and
+   its own descriptor. A source knowing a single node thus learns of the
+   others through it.
+
+   Only nodes push samples of their directory: the gossip message of a
+   source is empty, so that it does not show the nodes it uses which
+   other nodes it knows (and so has likely used).
+
+   Descriptors are deduplicated by identity, keeping the newest, and
+   expire MaxDescriptorAge after they were published (see the directory
+   package), so nodes keep republishing. Both sides save their directory
+   to a cache file, if set, whenever gossip brings new descriptors, and
+   start from it.
+
+   Each peer adds at most MaxGossipNew identities to the directory per
+   connection, so a peer cannot fill it with identities of its own.
+   Descriptors of known identities are always updated.
+*/
+
+const (
+	// max descriptors of a gossip message
+	MaxGossip = 32
+	// max new identities gossiped by a peer per connection
+	MaxGossipNew = 16
+)
+
+type Gossip struct {
+	Dir   *directory.Directory
+	Cache string // optional, file Dir is saved to
+	// optional, the own descriptor of a node
+	Self func(now time.Time) (*directory.NodeDescriptor, error)
+}
+
+func NewGossip(dir *directory.Directory, cache string) *Gossip {
+	return &Gossip{dir, cache, nil}
+}
+
+// selfDescriptor signs the descriptor of a node as served at
+// directory.DescriptorPath
+func selfDescriptor(template *directory.NodeDescriptor, keys *crypto.KeySet, id *crypto.Identity, account *crypto.Account) func(time.Time) (*directory.NodeDescriptor, error) {
+	return func(now time.Time) (*directory.NodeDescriptor, error) {
+		return directory.SignDescriptor(template, keys, id, account, now)
+	}
+}
+
+// sample returns the own descriptor, if any, and random current
+// descriptors of Dir, at most MaxGossip
+func (g *Gossip) sample(now time.Time) []*directory.NodeDescriptor {
+	ds := []*directory.NodeDescriptor{}
+	selfID := ""
+	if g.Self != nil {
+		self, err := g.Self(now)
+		if err != nil {
+			log.Warn("Signing own descriptor", "err", err)
+		} else {
+			ds = append(ds, self)
+			selfID = self.ID()
+		}
+	}
+	all := g.Dir.All(now)
+	for _, i := range rand.Perm(len(all)) {
+		if len(ds) == MaxGossip {
+			break
+		}
+		if all[i].ID() != selfID {
+			ds = append(ds, all[i])
+		}
+	}
+	return ds
+}
+
+// merge adds the valid descriptors of ds to Dir, with at most maxNew new
+// identities, and saves it to Cache if any were new. It returns how
+// many were added and how many identities were new.
+func (g *Gossip) merge(ds []*directory.NodeDescriptor, now time.Time, maxNew int) (int, int) {
+	if len(ds) > MaxGossip {
+		ds = ds[:MaxGossip]
+	}
+	valid := make([]*directory.NodeDescriptor, 0, len(ds))
+	for _, d := range ds {
+		if d != nil {
+			valid = append(valid, d)
+		}
+	}
+	n, ids := g.Dir.AddGossiped(valid, now, maxNew)
+	if n == 0 || g.Cache == "" {
+		return n, ids
+	}
+	err := g.Dir.Save(g.Cache)
+	if err != nil {
+		log.Error("Saving node directory", "path", g.Cache, "err", err)
+	}
+	return n, ids
+}
+
+// request sends a gossip message over ctrl, with a sample of Dir only
+// if g gossips for a node, and merges the descriptors of the gossiped
+// reply
+func (g *Gossip) request(ctrl *ctrlConn) (int, error) {
+	var ds []*directory.NodeDescriptor
+	if g.Self != nil {
+		ds = g.sample(time.Now())
+	}
+	err := ctrl.send(gossipMsg(CtrlGossip, ds))
+	if err != nil {
+		return 0, err
+	}
+	reply, err := ctrl.recv(ControlTimeout)
+	if err != nil {
+		return 0, err
+	}
+	err = reply.replyErr(CtrlGossiped)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := g.merge(reply.Descriptors, time.Now(), MaxGossipNew)
+	return n, nil
+}
+
+// answer merges the descriptors of a gossip message received over
+// ctrl, up to the new identities left to the peer, and replies with
+// gossiped
+func (g *Gossip) answer(ctrl *ctrlConn, msg *ControlMsg) error {
+	now := time.Now()
+	n, ids := g.merge(msg.Descriptors, now, MaxGossipNew-ctrl.gossiped)
+	ctrl.gossiped += ids
+	log.Debug("Gossip", "received", len(msg.Descriptors), "new", n)
+	return ctrl.send(gossipMsg(CtrlGossiped, g.sample(now)))
+}
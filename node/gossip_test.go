@@ -0,0 +1,130 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package node
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Gustav-Simonsson/orchid-lib/crypto"
+	"github.com/Gustav-Simonsson/orchid-lib/directory"
+	"github.com/Gustav-Simonsson/orchid-lib/p2p"
+)
+
+func TestGossip(t *testing.T) {
+	now := time.Now()
+	relay := []string{directory.RoleRelay}
+	known := testNode(t, "10.1.0.1:3202", 1, relay, nil, nil)
+
+	// the source knows one node, the exit three others and itself
+	srcCache := filepath.Join(t.TempDir(), "directory.json")
+	src := NewGossip(directory.New(), srcCache)
+	src.Dir.Add(known, now)
+	exit := NewGossip(directory.New(), "")
+	for _, host := range []string{"10.2.0.1:3202", "10.3.0.1:3202", "10.4.0.1:3202"} {
+		exit.Dir.Add(testNode(t, host, 1, relay, nil, nil), now)
+	}
+	idKey, err := crypto.NewIdentityKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := crypto.NewNodeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &directory.NodeDescriptor{
+		Endpoints:  []string{"http://10.5.0.1:3201"},
+		Versions:   []uint32{p2p.SignalingVersion},
+		Roles:      []string{directory.RoleExit},
+		ExitPolicy: directory.AcceptAll,
+	}
+	exit.Self = selfDescriptor(template, crypto.NewKeySet(key), crypto.NewIdentity(idKey, key), nil)
+
+	srcConn, exitConn := net.Pipe()
+	defer srcConn.Close()
+	defer exitConn.Close()
+	exitCtrl := newCtrlConn(exitConn)
+	received := make(chan int, 1)
+	go func() {
+		msg, err := exitCtrl.recv(ControlTimeout)
+		if err == nil && msg.Type == CtrlGossip {
+			received <- len(msg.Descriptors)
+			exit.answer(exitCtrl, msg)
+		}
+	}()
+
+	// the reply spans several cells
+	n, err := src.request(newCtrlConn(srcConn))
+	if err != nil || n != 4 {
+		t.Fatal(n, err)
+	}
+	if n := <-received; n != 0 || len(exit.Dir.All(now)) != 3 {
+		t.Fatal("source uploaded its directory", n)
+	}
+
+	// the source bootstraps from its cache, the exit included
+	cached := directory.New()
+	if n, err := cached.Load(srcCache); n != 5 || err != nil {
+		t.Fatal(n, err)
+	}
+	if len(cached.With(directory.RoleExit, now)) != 1 {
+		t.Fatal("missing exit descriptor")
+	}
+
+	// known descriptors are not added again
+	if n, _ := src.merge(exit.sample(now), now, MaxGossipNew); n != 0 {
+		t.Fatal(n)
+	}
+}
+
+func TestGossipNull(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	exit := NewGossip(directory.New(), "")
+	exitCtrl := newCtrlConn(b)
+	go newCtrlConn(a).send(&ControlMsg{Type: CtrlGossip, Descriptors: []*directory.NodeDescriptor{nil}})
+	msg, err := exitCtrl.recv(ControlTimeout)
+	if err != nil || len(msg.Descriptors) != 1 || msg.Descriptors[0] != nil {
+		t.Fatal(msg, err)
+	}
+	go newCtrlConn(a).recv(ControlTimeout)
+	if err := exit.answer(exitCtrl, msg); err != nil {
+		t.Fatal(err)
+	}
+	if len(exit.Dir.All(time.Now())) != 0 {
+		t.Fatal("null descriptor added")
+	}
+}
+
+func TestControlSize(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	ds := []*directory.NodeDescriptor{}
+	for len(ds) < 2*MaxControlCells {
+		ds = append(ds, testNode(t, "10.1.0.1:3202", 1, []string{directory.RoleRelay}, nil, nil))
+	}
+	if err := newCtrlConn(a).send(gossipMsg(CtrlGossip, ds)); err != ErrCtrlSize {
+		t.Fatal(err)
+	}
+}
@@ -20,7 +20,9 @@
 package node
 
 import (
-	"errors"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
 	"io"
 	"net"
 	"net/url"
@@ -28,7 +30,11 @@ import (
 	"sync"
 	"time"
 
+	"github.com/Gustav-Simonsson/orchid-lib/chain"
+	"github.com/Gustav-Simonsson/orchid-lib/crypto"
+	"github.com/Gustav-Simonsson/orchid-lib/directory"
 	"github.com/Gustav-Simonsson/orchid-lib/p2p"
+	"github.com/Gustav-Simonsson/orchid-lib/payment"
 	"github.com/ethereum/go-ethereum/log"
 )
 
@@ -38,30 +44,88 @@ const (
 	ExitSOCKS5Port = 3202
 )
 
-func SimpleSource() error {
+// LocalURL returns the signaling URL of a node on localhost
+func LocalURL(port int) *url.URL {
+	return &url.URL{Scheme: "http", Host: "localhost:" + strconv.Itoa(port)}
+}
+
+// SimpleSource builds a circuit through hops, the last of which
+// must be an exit, and proxies local TCP connections through it.
+func SimpleSource(hops ...Hop) error {
+	return PayingSource(nil, hops...)
+}
+
+// PayingSource is a SimpleSource paying the exit with payer, if not nil
+func PayingSource(payer *payment.Payer, hops ...Hop) error {
+	return (&Source{payer, nil, nil, 0, nil, 0}).Serve(hops...)
+}
+
+type Source struct {
+	Payer      *payment.Payer // optional, pays the exit
+	Gossip     *Gossip        // optional, exchanges descriptors with the exit
+	Reputation *Reputation    // optional, records how the hops serve
+	PoolSize   int            // circuits kept ready, DefaultPoolSize if 0
+	// optional, checks the blocks of the BackResponses of the hops
+	Head chain.HeadProvider
+	Port int // of the local TCP proxy, SourceTCPPort if 0
+}
+
+// Serve builds circuits through hops, the last of which must be an
+// exit, and proxies local TCP connections through them.
+func (s *Source) Serve(hops ...Hop) error {
+	return s.ServePaths(func() ([]Hop, error) {
+		return hops, nil
+	})
+}
+
+// ServePaths proxies local TCP connections through a circuit along a
+// path returned by path, and through a circuit along the next path
+// once it fails. Circuits are built ahead of time by a Pool.
+func (s *Source) ServePaths(path func() ([]Hop, error)) error {
 	log.Info("Starting simple source node...")
 
-	ref, err := url.Parse("http://localhost:" + strconv.Itoa(ExitHTTPPort))
-	if err != nil {
-		return err
+	size := s.PoolSize
+	if size == 0 {
+		size = DefaultPoolSize
 	}
+	pool := NewPool(size, func() (*Circuit, error) {
+		hops, err := path()
+		if err != nil {
+			return nil, err
+		}
+		return s.dial(hops)
+	})
+	defer pool.Close()
 
-	wPeer, err := p2p.NewWebRTCPeer(ref)
+	var mutex sync.Mutex
+	circuit, err := s.take(pool)
 	if err != nil {
 		return err
 	}
 
-	proxy, err := p2p.NewTCPProxy(SourceTCPPort,
+	port := s.Port
+	if port == 0 {
+		port = SourceTCPPort
+	}
+	proxy, err := p2p.NewTCPProxy(port,
 		func() (io.ReadWriteCloser, error) {
-			dc, err := wPeer.NewDataChannel()
-			if err != nil {
-				log.Error("[source] CreateDataChannel (TCP proxy callback)", "err", err)
-				return nil, err
+			mutex.Lock()
+			defer mutex.Unlock()
+			for {
+				stream, err := circuit.NewStream()
+				if err == nil {
+					if s.Reputation != nil {
+						return s.Reputation.measure(stream, circuit.exit().key()), nil
+					}
+					return stream, nil
+				}
+				log.Error("[source] circuit.NewStream (TCP proxy callback)", "err", err)
+				circuit.Close()
+				circuit, err = s.take(pool)
+				if err != nil {
+					return nil, err
+				}
 			}
-
-			//time.Sleep(time.Millisecond * 200)
-			dcRWC := p2p.NewDCReadWriteCloser(dc, "src")
-			return dcRWC, nil
 		})
 	if err != nil {
 		log.Error("p2p.NewTCPProxy", "err", err)
@@ -105,65 +169,401 @@ func SimpleSource() error {
 	return nil
 }
 
-type simpleExit struct {
-	Mutex sync.Mutex
-	// TODO: generalize to multiple peers
-	LocalPeer *p2p.WebRTCPeer
+// build builds a circuit like BuildCircuit, recording the success of
+// adding each hop, and the failure of connecting to the first
+func (s *Source) build(hops []Hop) (*Circuit, error) {
+	if s.Reputation == nil {
+		return BuildCircuit(hops, s.Head)
+	}
+	if len(hops) == 0 {
+		return nil, ErrNoHops
+	}
+	start := time.Now()
+	c, err := NewCircuit(hops[0], s.Head)
+	s.record(hops[0], start, err)
+	if err != nil {
+		return nil, err
+	}
+	for _, hop := range hops[1:] {
+		start = time.Now()
+		err = c.Extend(hop)
+		if err != nil {
+			// Either the extending hop or hop may be at fault (or lie
+			// about the other), so neither is charged with the failure
+			log.Warn("[source] extending circuit", "hop", hop.URL, "err", err)
+			c.Close()
+			return nil, err
+		}
+		s.record(hop, start, nil)
+	}
+	return c, nil
 }
 
-func SimpleExit() error {
-	log.Info("Starting simple exit node...")
+// dial builds a circuit through hops and gossips with the exit.
+// If the NodeKey of a hop is no longer valid, the circuit is built
+// again once with the keys the hops announce.
+func (s *Source) dial(hops []Hop) (*Circuit, error) {
+	circuit, err := s.build(hops)
+	if staleKey(err) {
+		if fresh, ok := refreshKeys(hops); ok {
+			log.Info("[source] retrying with announced node keys")
+			circuit, err = s.build(fresh)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	circuit.Reputation = s.Reputation
+	if s.Gossip != nil {
+		n, err := circuit.Gossip(s.Gossip)
+		if err != nil {
+			log.Warn("[source] gossip", "err", err)
+		} else {
+			log.Info("[source] gossip", "new", n)
+		}
+	}
+	return circuit, nil
+}
+
+// staleKey checks if err is the error of a node which has no valid key
+// the offer to it was sealed to
+func staleKey(err error) bool {
+	sigErr, ok := err.(*p2p.SignalingError)
+	return ok && sigErr.Code == p2p.ErrCodeSealing
+}
+
+// refreshKeys returns hops with the current NodeKeys announced by the
+// nodes with a descriptor ID (see p2p.FetchKeys), and if any changed
+func refreshKeys(hops []Hop) ([]Hop, bool) {
+	fresh := make([]Hop, len(hops))
+	changed := false
+	for i, hop := range hops {
+		fresh[i] = hop
+		identity, err := hex.DecodeString(hop.ID)
+		if err != nil || len(identity) != ed25519.PublicKeySize {
+			continue
+		}
+		keys, err := p2p.FetchKeys(hop.URL, identity)
+		if err != nil || len(keys) == 0 {
+			log.Warn("[source] fetching node keys", "hop", hop.URL, "err", err)
+			continue
+		}
+		if !bytes.Equal(keys[0][:], hop.Pub[:]) {
+			fresh[i].Pub = keys[0]
+			changed = true
+		}
+	}
+	return fresh, changed
+}
 
-	exit := simpleExit{
-		sync.Mutex{},
-		nil}
+// take takes a circuit from pool to proxy through and pays its exit
+func (s *Source) take(pool *Pool) (*Circuit, error) {
+	circuit, err := pool.Get(PoolTimeout)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("[source] using circuit", "exit", circuit.exit().URL)
+	if s.Payer != nil {
+		circuit.Pay(s.Payer)
+	}
+	return circuit, nil
+}
+
+func (s *Source) record(hop Hop, start time.Time, err error) {
+	// a stale key of the source is not a failure of the node
+	if staleKey(err) {
+		return
+	}
+	if err != nil {
+		s.Reputation.Failure(hop.key(), time.Now())
+		return
+	}
+	s.Reputation.Success(hop.key(), time.Since(start))
+}
+
+type Exit struct {
+	Keys     *crypto.KeySet
+	Identity *crypto.Identity  // optional, signs BackResponses
+	Terms    *payment.Terms    // optional, charges for bandwidth
+	Wins     *payment.WinQueue // optional with Terms, saves winning tickets
+	// optional with Identity, template of the served NodeDescriptor
+	Descriptor *directory.NodeDescriptor
+	Account    *crypto.Account    // optional, bound in the NodeDescriptor
+	Gossip     *Gossip            // optional, exchanges descriptors with sources
+	Head       chain.HeadProvider // optional, stamps BackResponses
+	SOCKSPort  int                // of the local SOCKS5 proxy, ExitSOCKS5Port if 0
+	peers      *peerRegistry
+}
+
+// nodeDocuments returns the documents served by a node with keys and
+// id and, with desc, its NodeDescriptor
+func nodeDocuments(keys *crypto.KeySet, id *crypto.Identity, desc *directory.NodeDescriptor, account *crypto.Account) []p2p.Document {
+	if id == nil {
+		return nil
+	}
+	docs := []p2p.Document{p2p.KeyAnnouncementDocument(keys, id.Key)}
+	if desc != nil {
+		docs = append(docs, directory.DescriptorDocument(desc, keys, id, account))
+	}
+	return docs
+}
+
+func currentPub(keys *crypto.KeySet) string {
+	key := keys.Current(time.Now())
+	if key == nil {
+		return ""
+	}
+	return key.URLBase64()
+}
+
+func SimpleExit(keys *crypto.KeySet, id *crypto.Identity) error {
+	return PaidExit(keys, id, nil)
+}
+
+// PaidExit is a SimpleExit charging sources for bandwidth with terms,
+// if not nil
+func PaidExit(keys *crypto.KeySet, id *crypto.Identity, terms *payment.Terms) error {
+	return NewExit(keys, id, terms).ListenAndServe(ExitHTTPPort)
+}
+
+func NewExit(keys *crypto.KeySet, id *crypto.Identity, terms *payment.Terms) *Exit {
+	return &Exit{
+		keys,
+		id,
+		terms,
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+		0,
+		newPeerRegistry(MaxExitPeers),
+	}
+}
+
+func (exit *Exit) ListenAndServe(port int) error {
+	log.Info("Starting simple exit node...", "pub", currentPub(exit.Keys), "paid", exit.Terms != nil)
 
 	proxy, err := p2p.NewSOCKSProxy()
 	if err != nil {
 		return err
 	}
 
+	errc := make(chan error, 2)
 	go func() {
-		err := proxy.ListenAndServe(ExitSOCKS5Port)
-		if err != nil {
-			log.Error("SOCKS5 proxy ListenAndServe", "err", err)
-		}
+		errc <- proxy.ListenAndServe(exit.socksPort())
 	}()
 
+	if exit.Gossip != nil && exit.Descriptor != nil && exit.Identity != nil {
+		exit.Gossip.Self = selfDescriptor(exit.Descriptor, exit.Keys, exit.Identity, exit.Account)
+	}
+
 	log.Info("Exit ready...")
-	p2p.HTTPServer(ExitHTTPPort, func(b []byte) ([]byte, error) {
-		exit.Mutex.Lock()
+	go func() {
+		errc <- p2p.HTTPServer(port, exit.handleOffer, nodeDocuments(exit.Keys, exit.Identity, exit.Descriptor, exit.Account)...)
+	}()
+	return <-errc
+}
+
+func (exit *Exit) socksPort() int {
+	if exit.SOCKSPort == 0 {
+		return ExitSOCKS5Port
+	}
+	return exit.SOCKSPort
+}
+
+func (exit *Exit) handleOffer(b []byte) ([]byte, error) {
+	// cheap check before allocating a PeerConnection;
+	// the limit is enforced when the peer is added
+	if exit.peers.full() {
+		return nil, errPeersFull
+	}
+
+	dcReady := make(chan *p2p.DCReadWriteCloser, 70)
+
+	ethBlock, err := p2p.HeadBlock(exit.Head)
+	if err != nil {
+		log.Error("[exit] chain head", "err", err)
+		return nil, err
+	}
+	resp, peer, err := p2p.NewExit(b, exit.Keys, exit.Identity, ethBlock, dcReady)
+	if err != nil {
+		return nil, err
+	}
+
+	// peer is ourself, not the remote peer
+	err = exit.peers.add(peer)
+	if err != nil {
+		peer.Close()
+		return nil, err
+	}
+	log.Info("Exit added source peer", "peers", exit.peers.len())
 
-		// temp for testing. TODO: support multiple peers
-		if exit.LocalPeer != nil {
-			return nil, errors.New("already have source peer")
+	var meter *payment.Meter
+	if exit.Terms != nil {
+		meter, err = payment.NewMeter(exit.Terms)
+		if err != nil {
+			peer.Close()
+			return nil, err
 		}
+		go exit.meterPeer(peer, meter)
+	}
 
-		dcReady := make(chan *p2p.DCReadWriteCloser, 70)
-		go func() {
-			for {
-				dcRWC := <-dcReady
-				// stream (copyBuffer) from dcRWC to SOCKS5
-				conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(ExitSOCKS5Port))
-				if err != nil {
-					log.Error("net.Dial (to SOCKS5 proxy)", "err", err)
-					return
-				}
-				//_, _ = conn, dcRWC
-				go p2p.ServeConn(conn, dcRWC)
-				//log.Info("p2p.NewDCReadWriteCloser (exit)", "ns", time.Now().UnixNano())
+	layerReady := make(chan *crypto.OnionLayer, 1)
+	go exit.serveControl(peer, meter, layerReady)
+	go exit.serveDCs(peer, meter, layerReady, dcReady)
+	return resp, nil
+}
+
+// meterPeer disconnects peer when meter is closed for lack of
+// payment, and closes meter when peer is done.
+func (e *Exit) meterPeer(peer *p2p.WebRTCPeer, meter *payment.Meter) {
+	select {
+	case <-peer.Done():
+		meter.Close()
+	case <-meter.Done():
+		used, paid := meter.Used()
+		log.Info("[exit] disconnecting peer", "err", meter.Err(), "used", used, "paid", paid)
+		peer.Close()
+	}
+}
+
+// serveDCs streams each DataChannel opened by the source peer,
+// peeling the onion layer of the exit, to the local SOCKS5 proxy
+// until the peer is done. Streams are metered by meter, if not nil.
+func (e *Exit) serveDCs(peer *p2p.WebRTCPeer, meter *payment.Meter, layerReady chan *crypto.OnionLayer, dcReady chan *p2p.DCReadWriteCloser) {
+	var layer *crypto.OnionLayer
+	select {
+	case <-peer.Done():
+		return
+	case layer = <-layerReady:
+	}
+
+	for {
+		select {
+		case <-peer.Done():
+			return
+		case dcRWC := <-dcReady:
+			rwc, err := peer.Secure(dcRWC)
+			if err != nil {
+				log.Error("[exit] DataChannel", "err", err)
+				dcRWC.Close()
+				continue
 			}
-		}()
+			// stream (copyBuffer) from dcRWC to SOCKS5
+			conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(e.socksPort()))
+			if err != nil {
+				log.Error("net.Dial (to SOCKS5 proxy)", "err", err)
+				dcRWC.Close()
+				continue
+			}
+			var stream io.ReadWriteCloser = hopOnionConn(rwc, layer)
+			if meter != nil {
+				stream = meter.Conn(stream)
+			}
+			go p2p.ServeConn(conn, stream)
+		}
+	}
+}
+
+// serveControl negotiates the onion layer of the exit with the source,
+// then sends the payment requests of meter, if not nil, and accepts
+// tickets paying them. Other control requests are rejected; circuits
+// cannot be extended beyond the exit.
+func (e *Exit) serveControl(peer *p2p.WebRTCPeer, meter *payment.Meter, layerReady chan *crypto.OnionLayer) {
+	session, err := peer.AcceptHandshake(ControlTimeout)
+	if err != nil {
+		log.Error("[exit] handshake", "err", err)
+		peer.Close()
+		return
+	}
+	log.Debug("[exit] handshake", "peer", crypto.NACLKeyToURLBase64(session.PeerPub))
+	inCtrl, err := peer.SecureControl(ControlTimeout)
+	if err != nil {
+		log.Error("[exit] control channel", "err", err)
+		return
+	}
+	ctrl := newCtrlConn(inCtrl)
+
+	layer, err := ctrl.acceptCreate(peer.LocalKey())
+	if err != nil {
+		log.Error("[exit] create", "err", err)
+		peer.Close()
+		return
+	}
+	layerReady <- layer
 
-		resp, peer, err := p2p.NewExit(b, dcReady)
+	if meter != nil {
+		go sendPayRequests(ctrl, meter)
+	}
+	for {
+		msg, err := ctrl.recv(0)
 		if err != nil {
-			return nil, err
+			return
+		}
+		if msg.Type == CtrlTicket && meter != nil && msg.Ticket != nil {
+			win, err := meter.Pay(msg.Ticket, time.Now())
+			if err != nil {
+				log.Error("[exit] ticket", "err", err)
+				ctrl.send(errorMsg(p2p.ErrCodePayment, err.Error()))
+				return
+			}
+			if win {
+				log.Info("[exit] winning ticket", "hash", msg.Ticket.Hash().Hex(), "faceValue", msg.Ticket.FaceValue)
+				e.saveWin(meter)
+			}
+			continue
+		}
+		if msg.Type == CtrlPing {
+			err = ctrl.send(&ControlMsg{Type: CtrlPong})
+			if err != nil {
+				return
+			}
+			continue
 		}
-		exit.LocalPeer = peer // this is ourself, not the remote peer
-		exit.Mutex.Unlock()
+		if msg.Type == CtrlGossip && e.Gossip != nil {
+			err = e.Gossip.answer(ctrl, msg)
+			if err != nil {
+				return
+			}
+			continue
+		}
+		if msg.Type == CtrlError {
+			log.Error("[exit] control error from source", "err", msg.Error)
+			continue
+		}
+		err = ctrl.send(errorMsg(p2p.ErrCodeUnexpectedType, "exit does not extend circuits"))
+		if err != nil {
+			return
+		}
+	}
+}
 
-		return resp, err
+// saveWin queues the last win of meter, which is lost with the meter
+// when the peer disconnects unless saved
+func (e *Exit) saveWin(meter *payment.Meter) {
+	if e.Wins == nil {
+		log.Warn("[exit] no win queue, winning ticket not saved")
+		return
+	}
+	wins := meter.Wins()
+	err := e.Wins.Add(wins[len(wins)-1])
+	if err != nil {
+		log.Error("[exit] saving winning ticket", "err", err)
+	}
+}
 
-	})
-	return nil
+func sendPayRequests(ctrl *ctrlConn, meter *payment.Meter) {
+	for {
+		select {
+		case <-meter.Done():
+			return
+		case req := <-meter.Requests():
+			err := ctrl.send(payMsg(req))
+			if err != nil {
+				log.Debug("[exit] pay request", "err", err)
+				return
+			}
+		}
+	}
 }
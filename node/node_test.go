@@ -0,0 +1,106 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package node
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Gustav-Simonsson/orchid-lib/crypto"
+	"github.com/Gustav-Simonsson/orchid-lib/p2p"
+)
+
+func TestRefreshKeys(t *testing.T) {
+	old, err := crypto.NewNodeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := crypto.NewIdentityKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := crypto.NewKeySet(old)
+	next, err := keys.Rotate(time.Now(), -time.Minute, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc := p2p.KeyAnnouncementDocument(keys, id)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := doc.Get()
+		if err != nil || r.URL.Path != doc.Path {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(b)
+	}))
+	defer server.Close()
+	ref, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !staleKey(&p2p.SignalingError{Code: p2p.ErrCodeSealing}) || staleKey(p2p.ErrNoSession) {
+		t.Fatal("unexpected staleKey")
+	}
+
+	// only hops with a descriptor ID are refreshed
+	hops := []Hop{{ref, old.Pub, ""}, {ref, old.Pub, hex.EncodeToString(id.Pub)}}
+	fresh, changed := refreshKeys(hops)
+	if !changed || *fresh[0].Pub != *old.Pub || *fresh[1].Pub != *next.Key.Pub {
+		t.Fatal(fresh)
+	}
+	if _, changed := refreshKeys(fresh); changed {
+		t.Fatal("current key refreshed")
+	}
+}
+
+func TestPublicHop(t *testing.T) {
+	for _, private := range []string{
+		"http://localhost:3203",
+		"http://127.0.0.1",
+		"http://[::1]:3203",
+		"http://10.1.2.3:80",
+		"http://192.168.0.1",
+		"http://169.254.169.254/latest/meta-data",
+		"http://[fe80::1]",
+		"http://0.0.0.0:3203",
+	} {
+		ref, _ := url.Parse(private)
+		if _, err := publicHop(ref); err != ErrPrivateHop {
+			t.Fatal(private, err)
+		}
+	}
+
+	ref, _ := url.Parse("http://203.0.113.7:3203")
+	pinned, err := publicHop(ref)
+	if err != nil || pinned.Host != "203.0.113.7:3203" {
+		t.Fatal(pinned, err)
+	}
+	ref, _ = url.Parse("https://[2001:db8::7]")
+	pinned, err = publicHop(ref)
+	if err != nil || pinned.Host != "[2001:db8::7]" || pinned.Scheme != "https" {
+		t.Fatal(pinned, err)
+	}
+}
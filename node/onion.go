@@ -0,0 +1,166 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package node
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+
+	"github.com/Gustav-Simonsson/orchid-lib/cell"
+	"github.com/Gustav-Simonsson/orchid-lib/crypto"
+	"github.com/Gustav-Simonsson/orchid-lib/p2p"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+/* Onion wrapped streams, see crypto/onion.go
+
+   Writes to an onionConn are split into fixed-size data cells (see the
+   cell package), each wrapped and sent as one frame, and every frame read
+   is peeled and decoded. At the source, streams are wrapped with all layers
+   of the circuit and at the exit with the layer of the exit. Relays peel
+   or wrap their own layer of each frame (see spliceOnion) and therefore
+   only ever see the previous and next hop of a circuit, and frames of
+   the same size wherever they are in the circuit.
+*/
+
+var (
+	errUnexpectedCell = errors.New("unexpected cell command")
+)
+
+type onionConn struct {
+	rwc      io.ReadWriteCloser
+	wrap     func([]byte) []byte
+	peel     func([]byte) ([]byte, error)
+	streamID uint32 // set from the first received cell at the exit
+	readBuf  []byte
+}
+
+func sourceOnionConn(rwc io.ReadWriteCloser, onion crypto.Onion, streamID uint32) *onionConn {
+	return &onionConn{rwc, onion.WrapForward, onion.PeelBackward, streamID, nil}
+}
+
+func hopOnionConn(rwc io.ReadWriteCloser, layer *crypto.OnionLayer) *onionConn {
+	return &onionConn{rwc, layer.SealBackward, layer.OpenForward, 0, nil}
+}
+
+func (c *onionConn) Read(p []byte) (int, error) {
+	for len(c.readBuf) == 0 {
+		frame, err := p2p.ReadFrame(c.rwc)
+		if err != nil {
+			return 0, err
+		}
+		b, err := c.peel(frame)
+		if err != nil {
+			return 0, err
+		}
+		ce, err := cell.Decode(b)
+		if err != nil {
+			return 0, err
+		}
+		switch ce.Command {
+		case cell.Padding:
+			continue
+		case cell.Data:
+			atomic.StoreUint32(&c.streamID, ce.StreamID)
+			c.readBuf = ce.Payload
+		case cell.End:
+			return 0, io.EOF
+		default:
+			return 0, errUnexpectedCell
+		}
+	}
+	n := copy(p, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+func (c *onionConn) Write(p []byte) (int, error) {
+	cells, err := cell.Split(cell.Data, atomic.LoadUint32(&c.streamID), p)
+	if err != nil {
+		return 0, err
+	}
+	for i, ce := range cells {
+		err = c.writeCell(ce)
+		if err != nil {
+			return i * cell.MaxPayload, err
+		}
+	}
+	return len(p), nil
+}
+
+func (c *onionConn) writeCell(ce *cell.Cell) error {
+	b, err := ce.Encode()
+	if err != nil {
+		return err
+	}
+	return p2p.WriteFrame(c.rwc, c.wrap(b))
+}
+
+// Close signals the end of the stream to the other end before closing
+func (c *onionConn) Close() error {
+	end, err := cell.New(cell.End, atomic.LoadUint32(&c.streamID), nil)
+	if err == nil {
+		c.writeCell(end)
+	}
+	return c.rwc.Close()
+}
+
+// spliceOnion streams frames between the previous hop (in) and the next
+// hop (out) of a circuit, peeling and wrapping the layer of this hop,
+// until either is closed.
+func spliceOnion(in, out io.ReadWriteCloser, layer *crypto.OnionLayer) {
+	done := make(chan struct{}, 2)
+	go copyFrames(out, in, layer.PeelForward, done)
+	go copyFrames(in, out, func(b []byte) ([]byte, error) {
+		if len(b) < crypto.OnionPadding {
+			return nil, crypto.ErrOnionSize
+		}
+		return layer.WrapBackward(b), nil
+	}, done)
+
+	<-done
+	in.Close()
+	out.Close()
+	<-done
+}
+
+func copyFrames(dst io.Writer, src io.Reader, f func([]byte) ([]byte, error), done chan struct{}) {
+	defer func() { done <- struct{}{} }()
+	for {
+		frame, err := p2p.ReadFrame(src)
+		if err != nil {
+			if err != io.EOF {
+				log.Debug("copyFrames read", "err", err)
+			}
+			return
+		}
+		frame, err = f(frame)
+		if err != nil {
+			log.Error("copyFrames", "err", err)
+			return
+		}
+		err = p2p.WriteFrame(dst, frame)
+		if err != nil {
+			log.Debug("copyFrames write", "err", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,119 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package node
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Gustav-Simonsson/orchid-lib/crypto"
+	"github.com/Gustav-Simonsson/orchid-lib/p2p"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+const (
+	// max concurrent source peers of an exit
+	MaxExitPeers = 64
+	// peers not connected within this time after signaling are evicted
+	PeerConnectTimeout = 30 * time.Second
+)
+
+var (
+	errPeersFull = &p2p.SignalingError{Code: p2p.ErrCodeUnavailable, Message: "peer limit reached"}
+)
+
+// peerRegistry holds the WebRTC peers of a node.
+// Peers are evicted when their PeerConnection fails or closes, or if it
+// does not connect within PeerConnectTimeout.
+//
+// The limit is global only: sources seal each offer from a fresh
+// ephemeral key and signaling does not see their addresses, so there
+// is nothing stable to limit peers per source by. Offer PoW and
+// PeerConnectTimeout bound how fast one source can fill the registry.
+type peerRegistry struct {
+	mutex sync.Mutex
+	peers map[*p2p.WebRTCPeer]struct{}
+	max   int
+}
+
+func newPeerRegistry(max int) *peerRegistry {
+	return &peerRegistry{
+		sync.Mutex{},
+		make(map[*p2p.WebRTCPeer]struct{}),
+		max,
+	}
+}
+
+func (r *peerRegistry) full() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.peers) >= r.max
+}
+
+func (r *peerRegistry) len() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.peers)
+}
+
+// add registers peer and starts watching it for eviction
+func (r *peerRegistry) add(peer *p2p.WebRTCPeer) error {
+	id := crypto.NACLKeyToURLBase64(peer.PeerPub)
+
+	r.mutex.Lock()
+	if len(r.peers) >= r.max {
+		r.mutex.Unlock()
+		return errPeersFull
+	}
+	r.peers[peer] = struct{}{}
+	r.mutex.Unlock()
+
+	go r.evictWhenDead(id, peer)
+	return nil
+}
+
+func (r *peerRegistry) evictWhenDead(id string, peer *p2p.WebRTCPeer) {
+	select {
+	case <-peer.Connected():
+	case <-peer.Done():
+	case <-time.After(PeerConnectTimeout):
+		log.Info("Peer did not connect in time", "peer", id)
+		r.evict(id, peer)
+		return
+	}
+	<-peer.Done()
+	r.evict(id, peer)
+}
+
+func (r *peerRegistry) evict(id string, peer *p2p.WebRTCPeer) {
+	r.mutex.Lock()
+	_, ok := r.peers[peer]
+	delete(r.peers, peer)
+	r.mutex.Unlock()
+
+	if !ok {
+		return
+	}
+	log.Debug("Evicting peer", "peer", id)
+	err := peer.Close()
+	if err != nil {
+		log.Error("peer.Close", "err", err)
+	}
+}
@@ -0,0 +1,178 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package node
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+/* Circuit pool
+
+   Building a circuit takes ICE gathering and the signaling round trip
+   to the first hop, and a control round trip for every hop, before the
+   first byte flows. A Pool keeps Size circuits built ahead of time and
+   hands them out at once, so sources start and fail over to another
+   exit without waiting.
+
+   Every circuit of the pool is kept by a worker which builds it with
+   dial, retrying with exponential backoff, and holds it until it is
+   taken. While held, the worker pings the last hop every
+   PoolHealthInterval and drops the circuit if it fails to answer or its
+   peer connection fails. Once the circuit is taken or dropped, the
+   worker builds the next one.
+
+   Circuits are pinged over the control channel, so they must not pay
+   (see Circuit.Pay) before they are taken.
+*/
+
+const (
+	DefaultPoolSize = 2
+
+	PoolHealthInterval = 15 * time.Second
+	// max time to wait for a ready circuit
+	PoolTimeout = 2 * ControlTimeout
+
+	poolMinBackoff = time.Second
+	poolMaxBackoff = time.Minute
+)
+
+var (
+	ErrPoolClosed  = errors.New("circuit pool closed")
+	ErrPoolTimeout = errors.New("timeout waiting for a circuit")
+)
+
+type Pool struct {
+	Size   int
+	dial   func() (*Circuit, error)
+	health time.Duration // between pings of a held circuit
+
+	ready     chan *Circuit
+	closed    chan struct{}
+	closeOnce sync.Once
+	mutex     sync.Mutex
+	lastErr   error // of the last dial, if it failed
+}
+
+// NewPool starts keeping size circuits built by dial ready
+func NewPool(size int, dial func() (*Circuit, error)) *Pool {
+	return newPool(size, PoolHealthInterval, dial)
+}
+
+func newPool(size int, health time.Duration, dial func() (*Circuit, error)) *Pool {
+	p := &Pool{
+		Size:   size,
+		dial:   dial,
+		health: health,
+		ready:  make(chan *Circuit),
+		closed: make(chan struct{}),
+	}
+	for i := 0; i < size; i++ {
+		go p.keep()
+	}
+	return p
+}
+
+// Get takes a ready circuit from p, waiting up to timeout for one
+func (p *Pool) Get(timeout time.Duration) (*Circuit, error) {
+	select {
+	case c := <-p.ready:
+		return c, nil
+	case <-p.closed:
+		return nil, ErrPoolClosed
+	case <-time.After(timeout):
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.lastErr != nil {
+		return nil, p.lastErr
+	}
+	return nil, ErrPoolTimeout
+}
+
+// Close stops p and closes the circuits not taken
+func (p *Pool) Close() {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
+}
+
+// keep keeps a ready circuit until p is closed
+func (p *Pool) keep() {
+	backoff := poolMinBackoff
+	for {
+		select {
+		case <-p.closed:
+			return
+		default:
+		}
+
+		c, err := p.dial()
+		if err != nil {
+			log.Warn("[pool] building circuit", "err", err, "retry", backoff)
+			p.mutex.Lock()
+			p.lastErr = err
+			p.mutex.Unlock()
+			select {
+			case <-p.closed:
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > poolMaxBackoff {
+				backoff = poolMaxBackoff
+			}
+			continue
+		}
+		backoff = poolMinBackoff
+		p.mutex.Lock()
+		p.lastErr = nil
+		p.mutex.Unlock()
+		p.hold(c)
+	}
+}
+
+// hold offers c until it is taken, fails or p is closed
+func (p *Pool) hold(c *Circuit) {
+	health := time.NewTicker(p.health)
+	defer health.Stop()
+	for {
+		select {
+		case p.ready <- c:
+			return
+		case <-c.Done():
+			log.Debug("[pool] circuit closed")
+			return
+		case <-health.C:
+			err := c.Ping()
+			if err != nil {
+				log.Warn("[pool] dropping circuit", "err", err)
+				c.Close()
+				return
+			}
+		case <-p.closed:
+			c.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,165 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package node
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	webrtc "github.com/Gustav-Simonsson/go-webrtc"
+	"github.com/Gustav-Simonsson/orchid-lib/crypto"
+	"github.com/Gustav-Simonsson/orchid-lib/p2p"
+	"github.com/Gustav-Simonsson/orchid-lib/payment"
+)
+
+// testPeer is a circuitPeer without DataChannels
+type testPeer struct {
+	done chan struct{}
+	once sync.Once
+}
+
+func (p *testPeer) NewDataChannel() (*webrtc.DataChannel, error) {
+	return nil, errors.New("no DataChannels")
+}
+
+func (p *testPeer) Secure(*p2p.DCReadWriteCloser) (io.ReadWriteCloser, error) {
+	return nil, errors.New("no DataChannels")
+}
+
+func (p *testPeer) Done() <-chan struct{} {
+	return p.done
+}
+
+func (p *testPeer) Close() error {
+	p.once.Do(func() { close(p.done) })
+	return nil
+}
+
+// testCircuit returns a circuit to a hop answering pings until the
+// returned conn is closed
+func testCircuit() (*Circuit, net.Conn) {
+	src, hop := net.Pipe()
+	go func() {
+		ctrl := newCtrlConn(hop)
+		for {
+			msg, err := ctrl.recv(0)
+			if err != nil || msg.Type != CtrlPing {
+				return
+			}
+			if ctrl.send(&ControlMsg{Type: CtrlPong}) != nil {
+				return
+			}
+		}
+	}()
+	peer := &testPeer{done: make(chan struct{})}
+	return &Circuit{[]Hop{}, nil, peer, newCtrlConn(src), crypto.Onion{}, 0, new(payment.Tab)}, hop
+}
+
+func TestPoolDialError(t *testing.T) {
+	errDial := errors.New("exit unavailable")
+	var dials int32
+	pool := NewPool(2, func() (*Circuit, error) {
+		atomic.AddInt32(&dials, 1)
+		return nil, errDial
+	})
+
+	// the pool keeps retrying and reports why it has no circuit
+	if _, err := pool.Get(100 * time.Millisecond); err != errDial {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&dials); n != 2 {
+		t.Fatal("dials before backoff", n)
+	}
+
+	pool.Close()
+	if _, err := pool.Get(time.Second); err != ErrPoolClosed {
+		t.Fatal(err)
+	}
+}
+
+func TestPoolGet(t *testing.T) {
+	circuits := make(chan *Circuit, 1)
+	pool := newPool(1, 10*time.Millisecond, func() (*Circuit, error) {
+		c, hop := testCircuit()
+		go func() {
+			<-c.Done()
+			hop.Close()
+		}()
+		circuits <- c
+		return c, nil
+	})
+	defer pool.Close()
+
+	// held circuits answering pings are handed out
+	built := <-circuits
+	time.Sleep(50 * time.Millisecond)
+	if c, err := pool.Get(time.Second); c != built || err != nil {
+		t.Fatal(c, err)
+	}
+	select {
+	case <-built.Done():
+		t.Fatal("healthy circuit dropped")
+	default:
+	}
+	built.Close()
+}
+
+func TestPoolPingFailure(t *testing.T) {
+	var dials int32
+	hops := make(chan net.Conn, 2)
+	pool := newPool(1, 10*time.Millisecond, func() (*Circuit, error) {
+		// the first dial fails, so the pool has an error to forget
+		if atomic.AddInt32(&dials, 1) == 1 {
+			return nil, errors.New("exit unavailable")
+		}
+		c, hop := testCircuit()
+		hops <- hop
+		return c, nil
+	})
+	defer pool.Close()
+
+	// the first circuit stops answering pings and is rebuilt
+	first := <-hops
+	first.Close()
+	second := <-hops
+	c, err := pool.Get(time.Second)
+	if err != nil || atomic.LoadInt32(&dials) < 3 {
+		t.Fatal(err, dials)
+	}
+	select {
+	case <-c.Done():
+		t.Fatal("got dropped circuit")
+	default:
+	}
+	c.Close()
+	second.Close()
+
+	// the error of the failed dial is forgotten once a circuit is built
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if pool.lastErr != nil {
+		t.Fatal(pool.lastErr)
+	}
+}
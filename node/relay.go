@@ -0,0 +1,275 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package node
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/Gustav-Simonsson/orchid-lib/chain"
+	"github.com/Gustav-Simonsson/orchid-lib/crypto"
+	"github.com/Gustav-Simonsson/orchid-lib/directory"
+	"github.com/Gustav-Simonsson/orchid-lib/p2p"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+/* A relay accepts inbound WebRTC peers and, when asked to extend a circuit
+   over the control channel (see control.go), opens an outbound WebRTC peer
+   to the requested next hop (a relay or an exit).
+   Every DataChannel opened by the inbound peer is then spliced to a new
+   DataChannel on the outbound peer, peeling the onion layer of the relay.
+   See comments in p2p/tcp.go.
+
+   A relay only extends to next hops at public addresses, so sources
+   cannot make it send requests to its loopback interface or private
+   network. The host of a next hop is resolved once and the relay
+   connects to the checked address, so a name cannot resolve to a
+   public address for the check and to a private one for the request.
+*/
+
+const (
+	RelayHTTPPort = 3203
+)
+
+var ErrPrivateHop = errors.New("next hop not at a public address")
+
+type Relay struct {
+	Keys     *crypto.KeySet
+	Identity *crypto.Identity // optional, signs BackResponses
+	// optional with Identity, template of the served NodeDescriptor
+	Descriptor *directory.NodeDescriptor
+	Account    *crypto.Account    // optional, bound in the NodeDescriptor
+	Gossip     *Gossip            // optional, exchanges descriptors with sources
+	Head       chain.HeadProvider // optional, stamps and checks BackResponses
+	// dev testing: extend to loopback and private addresses
+	PrivateHops bool
+	peers       *peerRegistry
+}
+
+func NewRelay(keys *crypto.KeySet, id *crypto.Identity) *Relay {
+	return &Relay{
+		keys,
+		id,
+		nil,
+		nil,
+		nil,
+		nil,
+		false,
+		newPeerRegistry(MaxExitPeers),
+	}
+}
+
+func (r *Relay) ListenAndServe(port int) error {
+	if r.Gossip != nil && r.Descriptor != nil && r.Identity != nil {
+		r.Gossip.Self = selfDescriptor(r.Descriptor, r.Keys, r.Identity, r.Account)
+	}
+	log.Info("Relay ready...", "pub", currentPub(r.Keys))
+	return p2p.HTTPServer(port, r.handleOffer, nodeDocuments(r.Keys, r.Identity, r.Descriptor, r.Account)...)
+}
+
+func (r *Relay) handleOffer(b []byte) ([]byte, error) {
+	if r.peers.full() {
+		return nil, errPeersFull
+	}
+
+	dcReady := make(chan *p2p.DCReadWriteCloser, 70)
+
+	ethBlock, err := p2p.HeadBlock(r.Head)
+	if err != nil {
+		log.Error("[relay] chain head", "err", err)
+		return nil, err
+	}
+	resp, in, err := p2p.NewExit(b, r.Keys, r.Identity, ethBlock, dcReady)
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.peers.add(in)
+	if err != nil {
+		in.Close()
+		return nil, err
+	}
+	log.Info("Relay added peer", "peers", r.peers.len())
+
+	go r.serve(in, dcReady)
+	return resp, nil
+}
+
+// serve negotiates the onion layer of the relay with the source, waits
+// for it to extend the circuit and then splices it to the next hop.
+func (r *Relay) serve(in *p2p.WebRTCPeer, dcReady chan *p2p.DCReadWriteCloser) {
+	defer in.Close()
+
+	_, err := in.AcceptHandshake(ControlTimeout)
+	if err != nil {
+		log.Error("[relay] handshake", "err", err)
+		return
+	}
+	inCtrl, err := in.SecureControl(ControlTimeout)
+	if err != nil {
+		log.Error("[relay] control channel", "err", err)
+		return
+	}
+	ctrl := newCtrlConn(inCtrl)
+
+	layer, err := ctrl.acceptCreate(in.LocalKey())
+	if err != nil {
+		log.Error("[relay] create", "err", err)
+		return
+	}
+
+	// as the last hop, the relay may gossip before extending
+	msg, err := ctrl.recv(ControlTimeout)
+	for err == nil && msg.Type == CtrlGossip && r.Gossip != nil {
+		err = r.Gossip.answer(ctrl, msg)
+		if err == nil {
+			msg, err = ctrl.recv(ControlTimeout)
+		}
+	}
+	if err != nil {
+		log.Error("[relay] reading extend", "err", err)
+		return
+	}
+	if msg.Type != CtrlExtend {
+		ctrl.send(errorMsg(p2p.ErrCodeUnexpectedType, "expected extend"))
+		return
+	}
+	next, err := msg.hop()
+	if err != nil {
+		ctrl.send(errorMsg(p2p.ErrCodeMalformed, err.Error()))
+		return
+	}
+	if !r.PrivateHops {
+		ref, err := publicHop(next.URL)
+		if err != nil {
+			log.Warn("[relay] refusing next hop", "next", next.URL, "err", err)
+			ctrl.send(errorMsg(p2p.ErrCodeUnavailable, err.Error()))
+			return
+		}
+		next.URL = ref
+	}
+
+	out, err := p2p.NewWebRTCPeer(next.URL, next.Pub, r.Head)
+	if err != nil {
+		log.Error("[relay] connecting to next hop", "next", next.URL, "err", err)
+		// sources refresh the key of the next hop on sealing errors
+		if staleKey(err) {
+			ctrl.send(errorMsg(p2p.ErrCodeSealing, "next hop key not valid"))
+		} else {
+			ctrl.send(errorMsg(p2p.ErrCodeUnavailable, "next hop unavailable"))
+		}
+		return
+	}
+	defer out.Close()
+
+	// relays identify themselves to the next hop with their current key
+	key := r.Keys.Current(time.Now())
+	if key == nil {
+		ctrl.send(errorMsg(p2p.ErrCodeUnavailable, "no valid node key"))
+		return
+	}
+	_, err = out.Handshake(key, ControlTimeout)
+	if err != nil {
+		log.Error("[relay] next hop handshake", "err", err)
+		ctrl.send(errorMsg(p2p.ErrCodeUnavailable, "next hop unavailable"))
+		return
+	}
+	outCtrl, err := out.SecureControl(ControlTimeout)
+	if err != nil {
+		log.Error("[relay] next hop control channel", "err", err)
+		ctrl.send(errorMsg(p2p.ErrCodeUnavailable, "next hop unavailable"))
+		return
+	}
+
+	err = ctrl.send(&ControlMsg{Type: CtrlExtended})
+	if err != nil {
+		log.Error("[relay] writing extended", "err", err)
+		return
+	}
+	log.Debug("[relay] extended circuit", "next", next.URL)
+
+	// further control messages are for the next hop
+	go spliceOnion(inCtrl, outCtrl, layer)
+	r.splice(in, out, layer, dcReady)
+}
+
+// splice opens a DataChannel to the next hop for every DataChannel
+// of the inbound peer and streams between them, until either peer is done.
+func (r *Relay) splice(in, out *p2p.WebRTCPeer, layer *crypto.OnionLayer, dcReady chan *p2p.DCReadWriteCloser) {
+	for {
+		select {
+		case <-in.Done():
+			return
+		case <-out.Done():
+			return
+		case inRWC := <-dcReady:
+			dc, err := out.NewDataChannel()
+			if err != nil {
+				log.Error("[relay] CreateDataChannel", "err", err)
+				inRWC.Close()
+				continue
+			}
+			inSec, err := in.Secure(inRWC)
+			if err != nil {
+				log.Error("[relay] inbound DataChannel", "err", err)
+				inRWC.Close()
+				continue
+			}
+			outSec, err := out.Secure(p2p.NewDCReadWriteCloser(dc, "relay"))
+			if err != nil {
+				log.Error("[relay] outbound DataChannel", "err", err)
+				inRWC.Close()
+				continue
+			}
+			go spliceOnion(inSec, outSec, layer)
+		}
+	}
+}
+
+// publicHop resolves the host of ref and returns ref at its address,
+// or ErrPrivateHop unless all its addresses are public
+func publicHop(ref *url.URL) (*url.URL, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ControlTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, ref.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if !addr.IP.IsGlobalUnicast() || addr.IP.IsPrivate() {
+			return nil, ErrPrivateHop
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, ErrPrivateHop
+	}
+	host := addrs[0].IP.String()
+	if port := ref.Port(); port != "" {
+		host = net.JoinHostPort(host, port)
+	} else if addrs[0].IP.To4() == nil {
+		host = "[" + host + "]"
+	}
+	pinned := *ref
+	pinned.Host = host
+	return &pinned, nil
+}
@@ -0,0 +1,290 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package node
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+/* Reputation
+
+   Sources remember how the nodes they used served them, so they stop
+   picking nodes which fail. For every node, by descriptor ID, a
+   Reputation records connection successes and failures, the latency of
+   adding the node to a circuit and the throughput of streams through
+   it, both as moving averages, and payment disputes: payment requests
+   of an exit the source refused.
+
+   Node selection weighs the stake of a node by its score (see Score):
+   the rate of successful connections, assuming one success and one
+   failure to begin with, halved for every dispute and for a throughput
+   below SlowThroughput. Nodes which failed within FailureBackoff or
+   score below MinScore are not picked at all.
+
+   Successes, failures and disputes decay with ReputationHalfLife, so
+   that a node which failed for a while (or was blamed for failures of
+   others) is rated by how it serves now, not by its whole history.
+
+   The records are saved as JSON, with every failure or dispute and at
+   most every SaveInterval otherwise.
+*/
+
+const (
+	// nodes which failed are not picked again for this long
+	FailureBackoff = 10 * time.Minute
+	// nodes scoring less are not picked
+	MinScore = 0.1
+	// bytes per second below which nodes score less
+	SlowThroughput = 16 << 10
+	// min bytes of a stream to measure throughput
+	MinThroughputBytes = 64 << 10
+	// longer gaps between reads of a stream are not measured
+	IdleGap = time.Second
+	// successes, failures and disputes count half as much after this long
+	ReputationHalfLife = 24 * time.Hour
+
+	// weight of a new measurement in the moving averages
+	reputationAlpha = 0.2
+
+	SaveInterval = time.Minute
+)
+
+type Record struct {
+	Successes   float64       `json:"successes"`             // decayed to Updated
+	Failures    float64       `json:"failures"`              // decayed to Updated
+	Updated     int64         `json:"updated,omitempty"`     // unix seconds
+	LastFailure int64         `json:"lastFailure,omitempty"` // unix seconds
+	Latency     time.Duration `json:"latency,omitempty"`     // nanoseconds
+	Throughput  float64       `json:"throughput,omitempty"`  // bytes per second
+	Disputes    float64       `json:"disputes"`              // decayed to Updated
+}
+
+// Score rates the node of r between 0 and 1 at now
+func (r *Record) Score(now time.Time) float64 {
+	if r.Failures > 0 && now.Sub(time.Unix(r.LastFailure, 0)) < FailureBackoff {
+		return 0
+	}
+	successes, failures, disputes := r.decayed(now)
+	score := (successes + 1) / (successes + failures + 2)
+	score *= math.Pow(0.5, disputes)
+	if r.Throughput > 0 && r.Throughput < SlowThroughput {
+		score /= 2
+	}
+	return score
+}
+
+// decayed returns the successes, failures and disputes of r decayed
+// to now
+func (r *Record) decayed(now time.Time) (float64, float64, float64) {
+	age := now.Sub(time.Unix(r.Updated, 0))
+	if r.Updated == 0 || age <= 0 {
+		return r.Successes, r.Failures, r.Disputes
+	}
+	f := math.Pow(0.5, age.Seconds()/ReputationHalfLife.Seconds())
+	return r.Successes * f, r.Failures * f, r.Disputes * f
+}
+
+type Reputation struct {
+	mutex    sync.Mutex
+	records  map[string]*Record // by descriptor ID
+	path     string             // optional, file the records are saved to
+	lastSave time.Time
+}
+
+func NewReputation(path string) *Reputation {
+	return &Reputation{records: make(map[string]*Record), path: path}
+}
+
+// LoadReputation returns the reputation saved at path, or a new one
+// if there is none yet
+func LoadReputation(path string) (*Reputation, error) {
+	r := NewReputation(path)
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &r.records)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Get returns a copy of the record of the node with id
+func (r *Reputation) Get(id string) Record {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if rec, ok := r.records[id]; ok {
+		return *rec
+	}
+	return Record{}
+}
+
+// Score rates the node with id, 1/2 if unknown
+func (r *Reputation) Score(id string, now time.Time) float64 {
+	rec := r.Get(id)
+	return rec.Score(now)
+}
+
+// Success records a connection to the node with id taking latency
+func (r *Reputation) Success(id string, latency time.Duration) {
+	r.update(id, false, time.Now(), func(rec *Record) {
+		rec.Successes++
+		rec.Latency = time.Duration(average(float64(rec.Latency), float64(latency)))
+	})
+}
+
+// Failure records a failed connection to the node with id
+func (r *Reputation) Failure(id string, now time.Time) {
+	r.update(id, true, now, func(rec *Record) {
+		rec.Failures++
+		rec.LastFailure = now.Unix()
+	})
+}
+
+// Transfer records a stream through the node with id carrying n
+// bytes in d, if long enough to measure throughput
+func (r *Reputation) Transfer(id string, n int64, d time.Duration) {
+	if n < MinThroughputBytes || d <= 0 {
+		return
+	}
+	r.update(id, false, time.Now(), func(rec *Record) {
+		rec.Throughput = average(rec.Throughput, float64(n)/d.Seconds())
+	})
+}
+
+// Dispute records a payment dispute with the node with id
+func (r *Reputation) Dispute(id string) {
+	r.update(id, true, time.Now(), func(rec *Record) {
+		rec.Disputes++
+	})
+}
+
+func average(avg, x float64) float64 {
+	if avg == 0 {
+		return x
+	}
+	return (1-reputationAlpha)*avg + reputationAlpha*x
+}
+
+// update decays the record of id to now, applies f to it and saves
+// the records if urgent or not saved for SaveInterval
+func (r *Reputation) update(id string, urgent bool, now time.Time, f func(*Record)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	rec, ok := r.records[id]
+	if !ok {
+		rec = new(Record)
+		r.records[id] = rec
+	}
+	rec.Successes, rec.Failures, rec.Disputes = rec.decayed(now)
+	rec.Updated = now.Unix()
+	f(rec)
+
+	if r.path == "" || (!urgent && time.Since(r.lastSave) < SaveInterval) {
+		return
+	}
+	err := r.save()
+	if err != nil {
+		log.Error("Saving reputation", "path", r.path, "err", err)
+	}
+}
+
+// Save writes the records to the file of r, if any
+func (r *Reputation) Save() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.path == "" {
+		return nil
+	}
+	return r.save()
+}
+
+func (r *Reputation) save() error {
+	b, err := json.MarshalIndent(r.records, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	err = os.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return err
+	}
+	r.lastSave = time.Now()
+	return os.Rename(tmp, filepath.Clean(r.path))
+}
+
+// measuredConn records the throughput of a stream through the node
+// with id when closed. Only the time spent transferring counts: gaps
+// of more than IdleGap between reads are idle time of the stream
+// (e.g. a keep-alive connection), not slowness of the node.
+type measuredConn struct {
+	io.ReadWriteCloser
+	rep    *Reputation
+	id     string
+	mutex  sync.Mutex
+	last   time.Time     // of the last read returning bytes
+	active time.Duration // spent transferring
+	n      int64         // bytes read
+	once   sync.Once
+}
+
+func (r *Reputation) measure(rwc io.ReadWriteCloser, id string) *measuredConn {
+	return &measuredConn{ReadWriteCloser: rwc, rep: r, id: id}
+}
+
+func (c *measuredConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	if n > 0 {
+		c.add(n, time.Now())
+	}
+	return n, err
+}
+
+func (c *measuredConn) add(n int, now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if gap := now.Sub(c.last); !c.last.IsZero() && gap <= IdleGap {
+		c.active += gap
+	}
+	c.last = now
+	c.n += int64(n)
+}
+
+func (c *measuredConn) Close() error {
+	c.once.Do(func() {
+		c.mutex.Lock()
+		n, active := c.n, c.active
+		c.mutex.Unlock()
+		c.rep.Transfer(c.id, n, active)
+	})
+	return c.ReadWriteCloser.Close()
+}
@@ -0,0 +1,137 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package node
+
+import (
+	"math"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Gustav-Simonsson/orchid-lib/directory"
+)
+
+func TestReputation(t *testing.T) {
+	now := time.Now()
+	path := filepath.Join(t.TempDir(), "reputation.json")
+	rep := NewReputation(path)
+	if score := rep.Score("new", now); score != 0.5 {
+		t.Fatal(score)
+	}
+
+	for i := 0; i < 8; i++ {
+		rep.Success("good", 100*time.Millisecond)
+	}
+	rep.Transfer("good", 1<<20, time.Second)
+	rep.Failure("bad", now)
+	rep.Success("disputed", time.Second)
+	rep.Dispute("disputed")
+	rep.Transfer("slow", 1<<20, 2*time.Minute)
+
+	if score := rep.Score("good", now); !approx(score, 0.9) {
+		t.Fatal(score)
+	}
+	if rep.Score("bad", now) != 0 || !approx(rep.Score("bad", now.Add(FailureBackoff)), 1.0/3) {
+		t.Fatal(rep.Get("bad"))
+	}
+	if score := rep.Score("disputed", now); !approx(score, 1.0/3) {
+		t.Fatal(score)
+	}
+	if score := rep.Score("slow", now); score != 0.25 {
+		t.Fatal(score)
+	}
+
+	// failures and disputes are saved right away
+	loaded, err := LoadReputation(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := loaded.Get("good"); !approx(r.Successes, 8) || r.Latency != 100*time.Millisecond || r.Throughput != 1<<20 {
+		t.Fatal(r)
+	}
+	if r := loaded.Get("disputed"); !approx(r.Disputes, 1) {
+		t.Fatal(r)
+	}
+
+	// failures decay, so nodes recover from past failures
+	for i := 0; i < 8; i++ {
+		rep.Failure("recovered", now)
+	}
+	rep.Success("recovered", 0)
+	if score := rep.Score("recovered", now.Add(FailureBackoff)); score > 0.2 {
+		t.Fatal(score)
+	}
+	if score := rep.Score("recovered", now.Add(4*ReputationHalfLife)); score < 0.4 {
+		t.Fatal(score)
+	}
+
+	// as do disputes
+	for i := 0; i < 4; i++ {
+		rep.Dispute("disputed")
+	}
+	if score := rep.Score("disputed", now); !approx(score, 2.0/3/32) {
+		t.Fatal(score)
+	}
+	if score := rep.Score("disputed", now.Add(8*ReputationHalfLife)); score < 0.45 {
+		t.Fatal(score)
+	}
+}
+
+func approx(a, b float64) bool {
+	return math.Abs(a-b) < 1e-3
+}
+
+func TestSelectReputation(t *testing.T) {
+	exit := []string{directory.RoleExit}
+	good := testNode(t, "10.1.0.1:3201", 100, exit, directory.AcceptAll, nil)
+	bad := testNode(t, "10.2.0.1:3201", 1e6, exit, directory.AcceptAll, nil)
+	nodes := []*directory.NodeDescriptor{good, bad}
+
+	s := testSelector(1)
+	s.Reputation = NewReputation("")
+	s.Reputation.Failure(bad.ID(), time.Now())
+	for i := 0; i < 100; i++ {
+		path, err := s.Path(nodes, 0, PathConstraints{})
+		if err != nil || path[0] != good {
+			t.Fatal("picked node which failed", err)
+		}
+	}
+	s.Reputation.Failure(good.ID(), time.Now())
+	if _, err := s.Path(nodes, 0, PathConstraints{}); err != ErrNoCandidates {
+		t.Fatal(err)
+	}
+}
+
+func TestMeasuredConnIdle(t *testing.T) {
+	rep := NewReputation("")
+	a, b := net.Pipe()
+	defer b.Close()
+	c := rep.measure(a, "idle")
+	start := time.Now()
+	// two bursts of 64 KiB in 1/2s each, an hour apart
+	for _, at := range []time.Duration{0, time.Second / 2, time.Hour, time.Hour + time.Second/2} {
+		c.add(32<<10, start.Add(at))
+	}
+	c.Close()
+	if r := rep.Get("idle"); !approx(r.Throughput, 128<<10) {
+		t.Fatal(r.Throughput)
+	}
+}
@@ -0,0 +1,235 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package node
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"time"
+
+	crand "crypto/rand"
+
+	"github.com/Gustav-Simonsson/orchid-lib/directory"
+	"github.com/Gustav-Simonsson/orchid-lib/p2p"
+	"github.com/Gustav-Simonsson/orchid-lib/payment"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+/* Node selection
+
+   Sources pick the nodes of a circuit from the directory at random,
+   weighted by stake, so an adversary needs stake in proportion to the
+   share of circuits it wants to see. The stake a descriptor claims only
+   counts once a StakeProvider confirms the operator holds it; the
+   weight is the smaller of both. Nodes without verified stake get the
+   weight of MinStake and are only picked by chance when staked nodes
+   exist, and without a StakeProvider all nodes are picked uniformly.
+   The Lottery deposits of operators serve as their stake (see
+   payment.Deposits), read once per operator and cached, so picking a
+   path does not cost a call per candidate.
+
+   Only nodes answering offers of our SignalingVersion are picked. The
+   exit is picked first, among exits whose policy allows the
+   destination port, and then the relays. No two nodes of a circuit may
+   share an operator (staking account) or a subnet (/16 for IPv4, /32
+   for IPv6, the host name otherwise), so a single operator or network
+   cannot both see where a circuit comes from and where it goes.
+
+   With a Reputation, the stake of every node is weighed by its score,
+   and nodes which failed recently or score below MinScore are skipped
+   (see reputation.go).
+*/
+
+var (
+	ErrNoCandidates = errors.New("no node satisfies the path constraints")
+
+	// weight of nodes without verified stake
+	MinStake = big.NewInt(1)
+)
+
+const (
+	// max time to look up the stake of a node
+	StakeTimeout = 5 * time.Second
+
+	// resolution of reputation scores in weights
+	scoreScale = 1000
+)
+
+// StakeProvider returns the stake held by a staking account, e.g. as
+// recorded by a staking contract
+type StakeProvider interface {
+	Stake(ctx context.Context, account common.Address) (*big.Int, error)
+}
+
+var _ StakeProvider = (*payment.Deposits)(nil)
+
+type PathConstraints struct {
+	Port    uint16          // destination port the exit must allow, any if 0
+	Exclude map[string]bool // by descriptor ID
+}
+
+type Selector struct {
+	Rand       io.Reader     // randomness of the selection
+	Reputation *Reputation   // optional, weighs nodes by their score
+	Stakes     StakeProvider // optional, verifies the stake of nodes
+}
+
+func NewSelector() *Selector {
+	return &Selector{crand.Reader, nil, nil}
+}
+
+// Path picks an exit and relays nodes preceding it from nodes, and
+// returns them in circuit order, the exit last
+func (s *Selector) Path(nodes []*directory.NodeDescriptor, relays int, c PathConstraints) ([]*directory.NodeDescriptor, error) {
+	path := []*directory.NodeDescriptor{}
+	exit, err := s.pick(nodes, path, c, func(d *directory.NodeDescriptor) bool {
+		return d.Has(directory.RoleExit) && d.ExitPolicy != nil && (c.Port == 0 || d.ExitPolicy.Allows(c.Port))
+	})
+	if err != nil {
+		return nil, err
+	}
+	path = append(path, exit)
+	for i := 0; i < relays; i++ {
+		relay, err := s.pick(nodes, path, c, func(d *directory.NodeDescriptor) bool {
+			return d.Has(directory.RoleRelay)
+		})
+		if err != nil {
+			return nil, err
+		}
+		path = append([]*directory.NodeDescriptor{relay}, path...)
+	}
+	return path, nil
+}
+
+// PathHops is Path returning the hops of the picked nodes
+func (s *Selector) PathHops(nodes []*directory.NodeDescriptor, relays int, c PathConstraints) ([]Hop, error) {
+	path, err := s.Path(nodes, relays, c)
+	if err != nil {
+		return nil, err
+	}
+	hops := make([]Hop, len(path))
+	for i, d := range path {
+		hops[i], err = DescriptorHop(d)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return hops, nil
+}
+
+// pick picks one of nodes satisfying ok and c which shares neither an
+// operator nor a subnet with the nodes of path, weighted by stake
+func (s *Selector) pick(nodes, path []*directory.NodeDescriptor, c PathConstraints, ok func(*directory.NodeDescriptor) bool) (*directory.NodeDescriptor, error) {
+	now := time.Now()
+	candidates := []*directory.NodeDescriptor{}
+	weights := []*big.Int{}
+	total := new(big.Int)
+	for _, d := range nodes {
+		if c.Exclude[d.ID()] || !d.Supports(p2p.SignalingVersion) || !ok(d) || !distinct(d, path) {
+			continue
+		}
+		w := s.stake(d)
+		if s.Reputation != nil {
+			score := s.Reputation.Score(d.ID(), now)
+			if score < MinScore {
+				continue
+			}
+			w = new(big.Int).Mul(w, big.NewInt(int64(score*scoreScale)))
+		}
+		candidates = append(candidates, d)
+		weights = append(weights, w)
+		total.Add(total, w)
+	}
+	if len(candidates) == 0 {
+		return nil, ErrNoCandidates
+	}
+
+	r, err := crand.Int(s.Rand, total)
+	if err != nil {
+		return nil, err
+	}
+	for i, w := range weights {
+		if r.Cmp(w) < 0 {
+			return candidates[i], nil
+		}
+		r.Sub(r, w)
+	}
+	panic("unreachable")
+}
+
+// stake returns the claimed stake of d as far as verified by Stakes,
+// at least MinStake
+func (s *Selector) stake(d *directory.NodeDescriptor) *big.Int {
+	op, ok := d.Operator()
+	if s.Stakes == nil || !ok || d.Stake == nil || d.Stake.Cmp(MinStake) <= 0 {
+		return MinStake
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), StakeTimeout)
+	defer cancel()
+	verified, err := s.Stakes.Stake(ctx, op)
+	if err != nil {
+		log.Warn("Verifying stake", "operator", op, "err", err)
+		return MinStake
+	}
+	switch {
+	case verified.Cmp(MinStake) <= 0:
+		return MinStake
+	case verified.Cmp(d.Stake) < 0:
+		return verified
+	}
+	return d.Stake
+}
+
+// distinct checks that d shares no node, operator or subnet with path
+func distinct(d *directory.NodeDescriptor, path []*directory.NodeDescriptor) bool {
+	op, hasOp := d.Operator()
+	sub := subnet(d)
+	for _, p := range path {
+		if p.ID() == d.ID() || subnet(p) == sub {
+			return false
+		}
+		if pOp, ok := p.Operator(); hasOp && ok && pOp == op {
+			return false
+		}
+	}
+	return true
+}
+
+// subnet returns the /16 (IPv4) or /32 (IPv6) subnet of the signaling
+// host of d, or the host name
+func subnet(d *directory.NodeDescriptor) string {
+	ref, err := d.Endpoint()
+	if err != nil {
+		return d.ID()
+	}
+	host := ref.Hostname()
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return host
+	case ip.To4() != nil:
+		return ip.Mask(net.CIDRMask(16, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(32, 128)).String()
+}
@@ -0,0 +1,206 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package node
+
+import (
+	"context"
+	"math"
+	"math/big"
+	"math/rand"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Gustav-Simonsson/orchid-lib/crypto"
+	"github.com/Gustav-Simonsson/orchid-lib/directory"
+	"github.com/Gustav-Simonsson/orchid-lib/p2p"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func testNode(t *testing.T, host string, stake int64, roles []string, policy *directory.ExitPolicy, account *crypto.Account) *directory.NodeDescriptor {
+	idKey, err := crypto.NewIdentityKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := crypto.NewNodeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := crypto.NewIdentity(idKey, key)
+	if account == nil {
+		account, err = crypto.NewAccount()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	binding, err := crypto.NewAccountBinding(account, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := &url.URL{Scheme: "http", Host: host}
+	d := (&directory.NodeDescriptor{
+		Account:    binding,
+		Endpoints:  []string{ref.String()},
+		Versions:   []uint32{p2p.SignalingVersion},
+		Roles:      roles,
+		ExitPolicy: policy,
+		Stake:      big.NewInt(stake),
+	}).Sign(id, time.Now())
+	err = d.Verify(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func testSelector(seed int64) *Selector {
+	return &Selector{rand.New(rand.NewSource(seed)), nil, nil}
+}
+
+// testStakes holds the stake of operators
+type testStakes map[common.Address]*big.Int
+
+func (s testStakes) Stake(ctx context.Context, account common.Address) (*big.Int, error) {
+	if stake, ok := s[account]; ok {
+		return stake, nil
+	}
+	return new(big.Int), nil
+}
+
+// stakes of nodes as claimed
+func claimedStakes(nodes ...*directory.NodeDescriptor) testStakes {
+	s := testStakes{}
+	for _, d := range nodes {
+		op, _ := d.Operator()
+		s[op] = d.Stake
+	}
+	return s
+}
+
+func TestSelectStakeWeighted(t *testing.T) {
+	exits := []*directory.NodeDescriptor{
+		testNode(t, "10.1.0.1:3201", 1e3, []string{directory.RoleExit}, directory.AcceptAll, nil),
+		testNode(t, "10.2.0.1:3201", 3e3, []string{directory.RoleExit}, directory.AcceptAll, nil),
+		testNode(t, "10.3.0.1:3201", 6e3, []string{directory.RoleExit}, directory.AcceptAll, nil),
+		testNode(t, "10.4.0.1:3201", 0, []string{directory.RoleExit}, directory.AcceptAll, nil),
+	}
+	s := testSelector(1)
+	s.Stakes = claimedStakes(exits...)
+	const n = 20000
+	counts := map[string]int{}
+	for i := 0; i < n; i++ {
+		path, err := s.Path(exits, 0, PathConstraints{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[path[0].ID()]++
+	}
+	// each count is within 4 standard deviations of its expectation
+	total := 1e3 + 3e3 + 6e3 + 1.0
+	for _, d := range exits {
+		p := float64(d.Stake.Int64()) / total
+		if d.Stake.Sign() == 0 {
+			p = 1 / total
+		}
+		expected := p * n
+		dev := 4 * math.Sqrt(n*p*(1-p))
+		if got := float64(counts[d.ID()]); got < expected-dev-1 || got > expected+dev+1 {
+			t.Errorf("%s: picked %v times, expected %.0f +- %.0f", d.Endpoints[0], got, expected, dev)
+		}
+	}
+}
+
+func TestSelectUnverifiedStake(t *testing.T) {
+	honest := testNode(t, "10.1.0.1:3201", 100, []string{directory.RoleExit}, directory.AcceptAll, nil)
+	claimer := testNode(t, "10.2.0.1:3201", 1e18, []string{directory.RoleExit}, directory.AcceptAll, nil)
+	nodes := []*directory.NodeDescriptor{honest, claimer}
+
+	// without a StakeProvider nodes are picked uniformly, and with one
+	// only by the stake they hold
+	s := testSelector(3)
+	for _, c := range []struct {
+		stakes testStakes
+		max    int
+	}{
+		{nil, 600},
+		{claimedStakes(honest), 50},
+	} {
+		if c.stakes != nil {
+			s.Stakes = c.stakes
+		}
+		picked := 0
+		for i := 0; i < 1000; i++ {
+			path, err := s.Path(nodes, 0, PathConstraints{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if path[0] == claimer {
+				picked++
+			}
+		}
+		if picked > c.max {
+			t.Fatal("unverified stake counted", picked)
+		}
+	}
+}
+
+func TestSelectConstraints(t *testing.T) {
+	operator, err := crypto.NewAccount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	web, _ := directory.ParseExitPolicy("accept 80,443")
+	exitWeb := testNode(t, "10.1.0.1:3201", 100, []string{directory.RoleExit}, web, operator)
+	exitAll := testNode(t, "10.2.0.1:3201", 100, []string{directory.RoleExit}, directory.AcceptAll, nil)
+	sameOperator := testNode(t, "10.3.0.1:3201", 100, []string{directory.RoleRelay}, nil, operator)
+	sameSubnet := testNode(t, "10.1.7.7:3201", 100, []string{directory.RoleRelay}, nil, nil)
+	relay := testNode(t, "10.4.0.1:3201", 1, []string{directory.RoleRelay}, nil, nil)
+	nodes := []*directory.NodeDescriptor{exitWeb, exitAll, sameOperator, sameSubnet, relay}
+
+	s := testSelector(2)
+	for i := 0; i < 200; i++ {
+		// only exitAll allows port 22
+		path, err := s.Path(nodes, 1, PathConstraints{Port: 22})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path[1] != exitAll || path[0] == exitAll {
+			t.Fatal("unexpected path", path[0].Endpoints, path[1].Endpoints)
+		}
+
+		// relays of exitWeb must not share its operator or subnet
+		path, err = s.Path(nodes, 1, PathConstraints{Port: 443, Exclude: map[string]bool{exitAll.ID(): true}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path[1] != exitWeb || path[0] != relay {
+			t.Fatal("unexpected path", path[0].Endpoints, path[1].Endpoints)
+		}
+	}
+
+	_, err = s.Path(nodes, 2, PathConstraints{Port: 443, Exclude: map[string]bool{exitAll.ID(): true}})
+	if err != ErrNoCandidates {
+		t.Fatal(err)
+	}
+	_, err = s.Path(nodes, 0, PathConstraints{Port: 22, Exclude: map[string]bool{exitAll.ID(): true}})
+	if err != ErrNoCandidates {
+		t.Fatal(err)
+	}
+}
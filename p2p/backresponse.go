@@ -0,0 +1,257 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/bits"
+	"time"
+
+	"github.com/Gustav-Simonsson/orchid-lib/chain"
+	"github.com/Gustav-Simonsson/orchid-lib/crypto"
+	nacl "github.com/kevinburke/nacl"
+)
+
+/* BackResponse is returned (sealed) by a node in response to an Offer.
+
+   Alongside the answer SignalingMsg, the node includes its NaCl public key,
+   a recent Ethereum block number and a proof-of-work over these fields.
+   The source verifies all of them before it applies the answer with
+   SetRemoteDescription.
+
+   As in orchid-core, answerSDP holds the SDP of the answer; the whole
+   answer SignalingMsg, with its ICE candidates, is in the separate
+   answer field. Sources check that both carry the same SDP.
+
+   The block number is taken from the chain.HeadProvider of the node.
+   Sources with a chain.HeadProvider reject BackResponses stamped with a block more than MaxBlockAge blocks
+   behind their head, or more than MaxBlockAhead blocks ahead of it, so
+   a node cannot replay old answers.
+
+   Nodes with an identity key (see crypto/identity.go) additionally sign
+   the BackResponse and include the binding of their NodeKey, so sources
+   learn which identity they connected to.
+*/
+
+const (
+	// required leading zero bits of the BackResponse PoW hash
+	backResponsePoWBits = 16
+
+	MaxBlockAge   = 32 // ~6 minutes
+	MaxBlockAhead = 2  // heads of nodes may be ahead of the source
+
+	// max time to wait for the chain head
+	HeadTimeout = 5 * time.Second
+)
+
+var (
+	ErrBlockRange = errors.New("chain head beyond BackResponse block range")
+)
+
+// HeadBlock returns the block number to stamp BackResponses with,
+// the head of the chain of head or 0 if nil
+func HeadBlock(head chain.HeadProvider) (uint32, error) {
+	if head == nil {
+		return 0, nil
+	}
+	block, err := headBlock(head)
+	if err != nil {
+		return 0, err
+	}
+	if block > math.MaxUint32 {
+		return 0, ErrBlockRange
+	}
+	return uint32(block), nil
+}
+
+func headBlock(head chain.HeadProvider) (uint64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), HeadTimeout)
+	defer cancel()
+	return head.BlockNumber(ctx)
+}
+
+// checkBlock checks the block of r against the head of the chain of
+// head, unless nil
+func (r *BackResponse) checkBlock(head chain.HeadProvider) error {
+	if head == nil {
+		return nil
+	}
+	block, err := headBlock(head)
+	if err != nil {
+		return err
+	}
+	return r.VerifyBlock(block)
+}
+
+// see orchid-core/src/index.ts interface BackResponse
+type BackResponse struct {
+	Pub         string `json:"nodePub"`
+	ETHBlock    uint32 `json:"ethBlock"`
+	PoWSolution uint64 `json:"powSolution"` // hashcash nonce, see validPoW
+	AnswerSDP   string `json:"answerSDP"`   // SDP of Answer
+	Answer      string `json:"answer"`      // JSON encoded answer SignalingMsg
+
+	Identity *crypto.KeyBinding `json:"identity,omitempty"`
+	Sig      []byte             `json:"sig,omitempty"` // by Identity, see Sign
+}
+
+// NewBackResponse wraps answer in a BackResponse from key and
+// solves its PoW.
+func NewBackResponse(key *crypto.NodeKey, ethBlock uint32, answer *SignalingMsg) (*BackResponse, error) {
+	b, err := json.Marshal(answer)
+	if err != nil {
+		return nil, err
+	}
+	r := &BackResponse{
+		key.URLBase64(),
+		ethBlock,
+		0,
+		answer.SDPAndIce.Description.Sdp,
+		string(b),
+		nil,
+		nil,
+	}
+	for !r.validPoW() {
+		r.PoWSolution++
+	}
+	return r, nil
+}
+
+// Sign signs r, after its PoW is solved, with the identity of the node
+func (r *BackResponse) Sign(id *crypto.Identity) {
+	h := r.powHash()
+	r.Identity = id.Binding
+	r.Sig = id.Sign(crypto.DomainBackResponse, h[:])
+}
+
+// verifySig checks the optional identity signature of r from sender
+func (r *BackResponse) verifySig(sender nacl.Key) error {
+	if r.Identity == nil && r.Sig == nil {
+		return nil
+	}
+	if r.Identity == nil || r.Identity.Binds(sender) != nil {
+		return signalingErr(ErrCodeIdentityMismatch, "BackResponse identity does not bind node pub")
+	}
+	h := r.powHash()
+	err := crypto.VerifySignature(r.Identity.Identity, crypto.DomainBackResponse, h[:], r.Sig)
+	if err != nil {
+		return signalingErr(ErrCodeInvalidSignature, "BackResponse: %v", err)
+	}
+	return nil
+}
+
+// VerifyBlock checks that the block of r is recent at head
+func (r *BackResponse) VerifyBlock(head uint64) error {
+	block := uint64(r.ETHBlock)
+	if block > head+MaxBlockAhead {
+		return signalingErr(ErrCodeStaleBlock, "BackResponse block %d ahead of head %d", block, head)
+	}
+	if block+MaxBlockAge < head {
+		return signalingErr(ErrCodeStaleBlock, "BackResponse block %d too old at head %d", block, head)
+	}
+	return nil
+}
+
+func (r *BackResponse) powHash() [sha256.Size]byte {
+	answerHash := sha256.Sum256([]byte(r.Answer))
+	buf := make([]byte, 0, len(r.Pub)+4+sha256.Size+8)
+	buf = append(buf, r.Pub...)
+	buf = binary.BigEndian.AppendUint32(buf, r.ETHBlock)
+	buf = append(buf, answerHash[:]...)
+	buf = binary.BigEndian.AppendUint64(buf, r.PoWSolution)
+	return sha256.Sum256(buf)
+}
+
+func (r *BackResponse) validPoW() bool {
+	h := r.powHash()
+	zeros := 0
+	for i := 0; i < len(h); i += 8 {
+		n := bits.LeadingZeros64(binary.BigEndian.Uint64(h[i : i+8]))
+		zeros += n
+		if n < 64 {
+			break
+		}
+	}
+	return zeros >= backResponsePoWBits
+}
+
+// Verify checks that r was created by the holder of the private key
+// of sender (the key the BackResponse was sealed with), that its PoW
+// and signature, if signed, are valid and returns the validated
+// answer SignalingMsg.
+// All errors are returned as *SignalingError.
+func (r *BackResponse) Verify(sender nacl.Key) (*SignalingMsg, error) {
+	if r.Pub != crypto.NACLKeyToURLBase64(sender) {
+		return nil, signalingErr(ErrCodeIdentityMismatch, "BackResponse node pub does not match sealing key")
+	}
+	if !r.validPoW() {
+		return nil, signalingErr(ErrCodeMalformed, "BackResponse PoW invalid")
+	}
+	err := r.verifySig(sender)
+	if err != nil {
+		return nil, err
+	}
+
+	answer := new(SignalingMsg)
+	err = json.Unmarshal([]byte(r.Answer), answer)
+	if err != nil {
+		return nil, signalingErr(ErrCodeMalformed, "BackResponse answer: %v", err)
+	}
+	err = answer.Validate(MsgTypeAnswer, sender, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if r.AnswerSDP != answer.SDPAndIce.Description.Sdp {
+		return nil, signalingErr(ErrCodeInvalidSDP, "BackResponse answerSDP does not match answer")
+	}
+	return answer, nil
+}
+
+// OpenBackResponse opens a sealed BackResponse addressed to key,
+// which must be sealed by the holder of the private key of peerPub.
+func OpenBackResponse(b []byte, key *crypto.NodeKey, peerPub nacl.Key) (*BackResponse, *SignalingMsg, error) {
+	if len(b) > MaxSignalSize {
+		return nil, nil, signalingErr(ErrCodeMalformed, "payload exceeds %d bytes", MaxSignalSize)
+	}
+	r := new(BackResponse)
+	sender, err := OpenSignal(b, key, r)
+	if err == crypto.ErrSealedOpen {
+		return nil, nil, signalingErr(ErrCodeSealing, "could not open sealed payload")
+	}
+	if err != nil {
+		return nil, nil, signalingErr(ErrCodeMalformed, "%v", err)
+	}
+	// Box authenticates the sender of the BackResponse as the holder
+	// of the private key of the advertised sender public key
+	if !bytes.Equal(sender[:], peerPub[:]) {
+		return nil, nil, ErrSignalSender
+	}
+	answer, err := r.Verify(sender)
+	if err != nil {
+		return nil, nil, err
+	}
+	return r, answer, nil
+}
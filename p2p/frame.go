@@ -0,0 +1,70 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+/* Frames delimit messages over byte streams such as DCReadWriteCloser,
+   which does not preserve DataChannel message boundaries.
+   A frame is a 4 byte big endian length followed by the payload.
+*/
+
+const (
+	MaxFrameSize = 1 << 20
+	frameHdrSize = 4
+)
+
+var (
+	ErrFrameSize = errors.New("frame exceeds max size")
+)
+
+// WriteFrame writes b as one frame with a single Write
+func WriteFrame(w io.Writer, b []byte) error {
+	if len(b) > MaxFrameSize {
+		return ErrFrameSize
+	}
+	buf := make([]byte, frameHdrSize+len(b))
+	binary.BigEndian.PutUint32(buf, uint32(len(b)))
+	copy(buf[frameHdrSize:], b)
+	_, err := w.Write(buf)
+	return err
+}
+
+func ReadFrame(r io.Reader) ([]byte, error) {
+	hdr := make([]byte, frameHdrSize)
+	_, err := io.ReadFull(r, hdr)
+	if err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(hdr)
+	if size > MaxFrameSize {
+		return nil, ErrFrameSize
+	}
+	b := make([]byte, size)
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,169 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package p2p
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"github.com/Gustav-Simonsson/orchid-lib/crypto"
+	nacl "github.com/kevinburke/nacl"
+)
+
+/* Before any other message, the two ends of a WebRTC peer run an
+   authenticated handshake (see crypto/handshake.go) as the first two
+   frames on the control DataChannel: the peer that sent the offer
+   initiates with the static key the signaling was sealed to, and the
+   peer that answered responds with that NodeKey.
+
+   Signaling only authenticates the offer and answer SDP; the handshake
+   authenticates the DataChannels themselves and yields per-session keys,
+   with which Secure encrypts every DataChannel of the peer, including
+   the control channel.
+*/
+
+var (
+	ErrHandshakeTimeout = errors.New("timeout waiting for handshake")
+	ErrNoSession        = errors.New("no handshake with peer")
+)
+
+// Handshake authenticates the control DataChannel of a peer created with
+// NewWebRTCPeer, proving key to the remote peer and verifying the remote
+// peer holds the private key of PeerPub.
+func (p *WebRTCPeer) Handshake(key *crypto.NodeKey, timeout time.Duration) (*crypto.Session, error) {
+	ctrl, err := p.Control(timeout)
+	if err != nil {
+		return nil, err
+	}
+	session, err := InitiateHandshake(ctrl, key, p.PeerPub, timeout)
+	if err != nil {
+		return nil, err
+	}
+	p.setSession(session)
+	return session, nil
+}
+
+// AcceptHandshake is the responder side of Handshake, for peers created
+// with NewExit, with the key the offer was sealed to
+func (p *WebRTCPeer) AcceptHandshake(timeout time.Duration) (*crypto.Session, error) {
+	ctrl, err := p.Control(timeout)
+	if err != nil {
+		return nil, err
+	}
+	session, err := AcceptHandshake(ctrl, p.localKey, timeout)
+	if err != nil {
+		return nil, err
+	}
+	p.setSession(session)
+	return session, nil
+}
+
+// Session returns the result of the handshake, or nil before
+func (p *WebRTCPeer) Session() *crypto.Session {
+	p.Mutex.Lock()
+	defer p.Mutex.Unlock()
+	return p.session
+}
+
+// Secure encrypts rwc, a DataChannel of p, with the session keys of p
+func (p *WebRTCPeer) Secure(rwc *DCReadWriteCloser) (io.ReadWriteCloser, error) {
+	session := p.Session()
+	if session == nil {
+		return nil, ErrNoSession
+	}
+	return crypto.NewSecureConn(rwc, session, rwc.Label()), nil
+}
+
+// SecureControl returns the control DataChannel of p, encrypted by Secure
+func (p *WebRTCPeer) SecureControl(timeout time.Duration) (io.ReadWriteCloser, error) {
+	ctrl, err := p.Control(timeout)
+	if err != nil {
+		return nil, err
+	}
+	return p.Secure(ctrl)
+}
+
+func (p *WebRTCPeer) setSession(s *crypto.Session) {
+	p.Mutex.Lock()
+	p.session = s
+	p.Mutex.Unlock()
+}
+
+// InitiateHandshake runs the initiator side of the handshake over rwc
+func InitiateHandshake(rwc io.ReadWriter, key *crypto.NodeKey, peerPub nacl.Key, timeout time.Duration) (*crypto.Session, error) {
+	hs := crypto.NewHandshakeInitiator(key, peerPub)
+	msg, err := hs.WriteInit()
+	if err != nil {
+		return nil, err
+	}
+	err = WriteFrame(rwc, msg)
+	if err != nil {
+		return nil, err
+	}
+	msg, err = readFrameTimeout(rwc, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return hs.ReadResponse(msg)
+}
+
+// AcceptHandshake runs the responder side of the handshake over rwc.
+// The authenticated key of the initiator is Session.PeerPub.
+func AcceptHandshake(rwc io.ReadWriter, key *crypto.NodeKey, timeout time.Duration) (*crypto.Session, error) {
+	hs := crypto.NewHandshakeResponder(key)
+	msg, err := readFrameTimeout(rwc, timeout)
+	if err != nil {
+		return nil, err
+	}
+	err = hs.ReadInit(msg)
+	if err != nil {
+		return nil, err
+	}
+	msg, session, err := hs.WriteResponse()
+	if err != nil {
+		return nil, err
+	}
+	err = WriteFrame(rwc, msg)
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// readFrameTimeout reads a frame, giving up after timeout.
+// On timeout r can no longer be used.
+func readFrameTimeout(r io.Reader, timeout time.Duration) ([]byte, error) {
+	type result struct {
+		frame []byte
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		frame, err := ReadFrame(r)
+		done <- result{frame, err}
+	}()
+	select {
+	case r := <-done:
+		return r.frame, r.err
+	case <-time.After(timeout):
+		return nil, ErrHandshakeTimeout
+	}
+}
@@ -20,20 +20,54 @@
 package p2p
 
 import (
+	"crypto/ed25519"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strconv"
+	"time"
 
+	"github.com/Gustav-Simonsson/orchid-lib/crypto"
 	"github.com/ethereum/go-ethereum/log"
+	nacl "github.com/kevinburke/nacl"
+)
+
+const (
+	// well-known path of the KeyAnnouncement of a node
+	KeysPath = "/.well-known/orchid/keys.json"
+
+	// max time to fetch a document, such as a KeyAnnouncement
+	FetchTimeout = 10 * time.Second
+)
+
+var (
+	// FetchClient fetches documents served by nodes and directory servers
+	FetchClient = &http.Client{Timeout: FetchTimeout}
 )
 
 type HTTPRespHandler func([]byte) ([]byte, error)
 
-func HTTPServer(port int, handler HTTPRespHandler) error {
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+// Document is a JSON document served on GET requests to Path,
+// such as the KeyAnnouncement of a node
+type Document struct {
+	Path string
+	Get  func() ([]byte, error)
+}
+
+// HTTPServer serves signaling requests on port, and docs. Each server has
+// its own ServeMux so several nodes (e.g. a relay and an exit) can run
+// in one process.
+func HTTPServer(port int, handler HTTPRespHandler, docs ...Document) error {
+	mux := http.NewServeMux()
+	for _, doc := range docs {
+		mux.HandleFunc(doc.Path, serveDocument(doc))
+	}
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
-		b, err := ioutil.ReadAll(r.Body)
+		b, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxSignalSize+1))
 		if err != nil {
 			log.Error("HTTP REQ", "err", err)
 			return
@@ -43,11 +77,81 @@ func HTTPServer(port int, handler HTTPRespHandler) error {
 		resp, err := handler(b)
 		if err != nil {
 			log.Error("HTTP handler", "err", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeSignalingError(w, err)
 			return
 		}
 		fmt.Fprint(w, string(resp))
 	})
 
-	return http.ListenAndServe(":"+strconv.Itoa(port), nil)
+	return http.ListenAndServe(":"+strconv.Itoa(port), mux)
+}
+
+func serveDocument(doc Document) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		b, err := doc.Get()
+		if err != nil {
+			log.Error("HTTP document", "path", doc.Path, "err", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	}
+}
+
+// KeyAnnouncementDocument serves the keys of keys valid at the time of
+// the request, signed by id
+func KeyAnnouncementDocument(keys *crypto.KeySet, id *crypto.IdentityKey) Document {
+	return Document{KeysPath, func() ([]byte, error) {
+		a, err := keys.Announce(id, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(a)
+	}}
+}
+
+// FetchKeys returns the keys of the node at ref valid now, as announced
+// by the node and signed by identity, newest first. Sources use it to
+// learn the successor of a cached node key.
+func FetchKeys(ref *url.URL, identity ed25519.PublicKey) ([]nacl.Key, error) {
+	keysURL := *ref
+	keysURL.Path = KeysPath
+	resp, err := FetchClient.Get(keysURL.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching keys: HTTP status %d", resp.StatusCode)
+	}
+	a := new(crypto.KeyAnnouncement)
+	err = json.NewDecoder(io.LimitReader(resp.Body, MaxSignalSize)).Decode(a)
+	if err != nil {
+		return nil, err
+	}
+	return a.Verify(identity, time.Now())
+}
+
+// writeSignalingError reports err to the peer as a JSON SignalingError.
+// Errors other than *SignalingError are internal and not detailed.
+func writeSignalingError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	sigErr, ok := err.(*SignalingError)
+	if !ok {
+		status = http.StatusInternalServerError
+		sigErr = signalingErr(ErrCodeInternal, "internal error")
+	}
+	b, err := json.Marshal(sigErr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
 }
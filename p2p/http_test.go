@@ -0,0 +1,73 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package p2p
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Gustav-Simonsson/orchid-lib/crypto"
+)
+
+func TestFetchKeys(t *testing.T) {
+	key, err := crypto.NewNodeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := crypto.NewIdentityKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := crypto.NewIdentityKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := crypto.NewKeySet(key)
+	next, err := keys.Rotate(time.Now(), -time.Minute, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc := KeyAnnouncementDocument(keys, id)
+	mux := http.NewServeMux()
+	mux.HandleFunc(doc.Path, serveDocument(doc))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	ref, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pubs, err := FetchKeys(ref, id.Pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pubs) != 2 || *pubs[0] != *next.Key.Pub || *pubs[1] != *key.Pub {
+		t.Fatalf("unexpected keys: %v", pubs)
+	}
+
+	_, err = FetchKeys(ref, other.Pub)
+	if err != crypto.ErrAnnouncement {
+		t.Fatalf("unexpected FetchKeys (other identity) err: %v", err)
+	}
+}
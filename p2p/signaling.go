@@ -0,0 +1,409 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package p2p
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	webrtc "github.com/Gustav-Simonsson/go-webrtc"
+	"github.com/Gustav-Simonsson/orchid-lib/crypto"
+	"github.com/Gustav-Simonsson/orchid-lib/crypto/pow"
+	nacl "github.com/kevinburke/nacl"
+)
+
+/* Signaling payloads (Offer / Answer) are sealed with NaCl box so that
+   only the addressed node can read the SDP and ICE candidates.
+
+   The source seals the Offer from a fresh ephemeral key to the (known)
+   public key of the node it connects to, and includes the ephemeral
+   public key in the envelope. The node seals its Answer from its own
+   key back to the ephemeral key. As box is authenticated, a source that
+   can open the Answer knows it was sealed by the holder of the private
+   key of the node it addressed.
+*/
+
+/* Signaling message schema
+
+   Inside the sealed envelope, every signaling message is a SignalingMsg
+   carrying the protocol version, the message type, the identity of the
+   sending node and the time it was created, alongside the SDP and ICE
+   candidates.
+
+   Forward compatibility rules:
+
+   1. Receivers ignore JSON fields they do not know. New optional fields
+      can be added without bumping SignalingVersion.
+   2. Any change to the meaning of existing fields, or a new field that
+      receivers must understand, bumps SignalingVersion.
+   3. Receivers reject messages with a version they do not support with
+      ErrCodeUnsupportedVersion, so the sender can fall back or upgrade.
+   4. Unknown message types are rejected with ErrCodeUnexpectedType.
+
+   Errors are returned to the peer as a (unsealed) SignalingError with
+   a numeric code; the message is informational only.
+
+   Offers carry an Equihash solution over the rest of the message as
+   received, unknown fields included (see powInput), so that a source
+   pays a CPU cost before a node allocates a PeerConnection.
+*/
+
+const (
+	SignalingVersion = 2
+
+	MsgTypeOffer  = "offer"
+	MsgTypeAnswer = "answer"
+
+	// max accepted difference between a message timestamp and local time
+	MaxSignalClockSkew = 2 * time.Minute
+	// max size of a (sealed) signaling payload
+	MaxSignalSize = 64 * 1024
+	// max offers remembered for replay rejection
+	MaxSeenOffers = 64 * 1024
+
+	maxIceCandidates   = 32
+	maxIceCandidateLen = 512
+)
+
+type ErrorCode int
+
+const (
+	ErrCodeMalformed ErrorCode = iota + 1
+	ErrCodeUnsupportedVersion
+	ErrCodeUnexpectedType
+	ErrCodeIdentityMismatch
+	ErrCodeBadTimestamp
+	ErrCodeInvalidSDP
+	ErrCodeInvalidCandidate
+	ErrCodeSealing
+	ErrCodeUnavailable
+	ErrCodeInternal
+	ErrCodeInvalidPoW
+	ErrCodeInvalidSignature
+	ErrCodePayment
+	ErrCodeStaleBlock
+	ErrCodeReplay
+)
+
+type SignalingError struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+func (e *SignalingError) Error() string {
+	return fmt.Sprintf("signaling error %d: %s", e.Code, e.Message)
+}
+
+func signalingErr(code ErrorCode, format string, a ...interface{}) *SignalingError {
+	return &SignalingError{code, fmt.Sprintf(format, a...)}
+}
+
+var (
+	ErrSignalSender = errors.New("signaling payload not sealed by expected peer")
+
+	// Equihash params offers must be solved with
+	OfferPoWParams = pow.DefaultParams
+)
+
+type SDPAndIce struct {
+	Description webrtc.SessionDescription `json:"description"`
+	Candidates  []*webrtc.IceCandidate    `json:"candidates"`
+}
+
+type SignalingMsg struct {
+	Version   uint32    `json:"version"`
+	Type      string    `json:"type"`
+	NodeID    string    `json:"nodeID"`    // URL base64 NaCl public key of sender
+	Timestamp int64     `json:"timestamp"` // unix seconds
+	SDPAndIce SDPAndIce `json:"sdpAndIce"`
+
+	PoW *pow.Solution `json:"pow,omitempty"` // required for offers
+
+	raw []byte // JSON the message was decoded from, if any
+}
+
+// UnmarshalJSON decodes m and keeps b, so the PoW is verified over
+// fields this version does not know
+func (m *SignalingMsg) UnmarshalJSON(b []byte) error {
+	type plain SignalingMsg
+	err := json.Unmarshal(b, (*plain)(m))
+	if err != nil {
+		return err
+	}
+	m.raw = append([]byte{}, b...)
+	return nil
+}
+
+func NewSignalingMsg(msgType string, key *crypto.NodeKey, sdp webrtc.SessionDescription, cands []*webrtc.IceCandidate) *SignalingMsg {
+	return &SignalingMsg{
+		SignalingVersion,
+		msgType,
+		key.URLBase64(),
+		time.Now().Unix(),
+		SDPAndIce{sdp, cands},
+		nil,
+		nil,
+	}
+}
+
+// powInput hashes the JSON m was decoded from, or else its encoding,
+// without the PoW. The top-level members are re-encoded sorted by name
+// with their values as received, so unknown fields are covered too.
+func (m *SignalingMsg) powInput() ([]byte, error) {
+	b := m.raw
+	if b == nil {
+		var err error
+		b, err = json.Marshal(m)
+		if err != nil {
+			return nil, err
+		}
+	}
+	fields := make(map[string]json.RawMessage)
+	err := json.Unmarshal(b, &fields)
+	if err != nil {
+		return nil, err
+	}
+	delete(fields, "pow")
+	b, err = json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256(b)
+	return h[:], nil
+}
+
+// SolvePoW sets the PoW of m to a solution over the rest of m.
+// Any later change to m invalidates the solution.
+func (m *SignalingMsg) SolvePoW(p pow.Params) error {
+	input, err := m.powInput()
+	if err != nil {
+		return err
+	}
+	m.PoW, err = pow.Solve(p, input)
+	return err
+}
+
+// VerifyPoW returns a *SignalingError unless m carries a valid PoW
+func (m *SignalingMsg) VerifyPoW(p pow.Params) error {
+	if m.PoW == nil {
+		return signalingErr(ErrCodeInvalidPoW, "missing PoW, required: %v", p)
+	}
+	input, err := m.powInput()
+	if err != nil {
+		return signalingErr(ErrCodeMalformed, "%v", err)
+	}
+	err = pow.Verify(p, input, m.PoW)
+	if err != nil {
+		return signalingErr(ErrCodeInvalidPoW, "%v, required: %v", err, p)
+	}
+	return nil
+}
+
+// Validate checks that m is a well formed message of msgType
+// sent by the holder of sender at about time now.
+func (m *SignalingMsg) Validate(msgType string, sender nacl.Key, now time.Time) error {
+	if m.Version != SignalingVersion {
+		return signalingErr(ErrCodeUnsupportedVersion, "version %d not supported, have: %d", m.Version, SignalingVersion)
+	}
+	if m.Type != MsgTypeOffer && m.Type != MsgTypeAnswer {
+		return signalingErr(ErrCodeUnexpectedType, "unknown message type %q", m.Type)
+	}
+	if m.Type != msgType {
+		return signalingErr(ErrCodeUnexpectedType, "message type %q, expected: %q", m.Type, msgType)
+	}
+
+	nodeID, err := crypto.URLBase64ToNACLKey(m.NodeID)
+	if err != nil {
+		return signalingErr(ErrCodeMalformed, "node ID: %v", err)
+	}
+	if !bytes.Equal(nodeID[:], sender[:]) {
+		return signalingErr(ErrCodeIdentityMismatch, "node ID does not match sealing key")
+	}
+
+	ts := time.Unix(m.Timestamp, 0)
+	if ts.Before(now.Add(-MaxSignalClockSkew)) || ts.After(now.Add(MaxSignalClockSkew)) {
+		return signalingErr(ErrCodeBadTimestamp, "timestamp %d outside allowed clock skew", m.Timestamp)
+	}
+
+	desc := m.SDPAndIce.Description
+	if desc.Type != m.Type {
+		return signalingErr(ErrCodeInvalidSDP, "SDP type %q, expected: %q", desc.Type, m.Type)
+	}
+	if !strings.HasPrefix(desc.Sdp, "v=0") {
+		return signalingErr(ErrCodeInvalidSDP, "SDP does not start with version line")
+	}
+
+	cands := m.SDPAndIce.Candidates
+	if len(cands) == 0 || len(cands) > maxIceCandidates {
+		return signalingErr(ErrCodeInvalidCandidate, "ICE candidate count %d not in [1, %d]", len(cands), maxIceCandidates)
+	}
+	for i, c := range cands {
+		if c == nil {
+			return signalingErr(ErrCodeInvalidCandidate, "ICE candidate %d is null", i)
+		}
+		if !strings.HasPrefix(c.Candidate, "candidate:") || len(c.Candidate) > maxIceCandidateLen {
+			return signalingErr(ErrCodeInvalidCandidate, "ICE candidate %d malformed", i)
+		}
+	}
+
+	return nil
+}
+
+type SealedSignal struct {
+	Sender string `json:"sender"` // URL base64 NaCl public key
+	Box    []byte `json:"box"`    // nonce + ciphertext
+}
+
+// SealSignal JSON encodes v and seals it from key to peerPub
+func SealSignal(v interface{}, key *crypto.NodeKey, peerPub nacl.Key) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	sealed := SealedSignal{
+		key.URLBase64(),
+		key.SealTo(peerPub, b),
+	}
+	return json.Marshal(sealed)
+}
+
+// OpenSignal opens a payload sealed with SealSignal to key and JSON
+// decodes it into v. Returns the public key of the sender.
+func OpenSignal(b []byte, key *crypto.NodeKey, v interface{}) (nacl.Key, error) {
+	sealed := new(SealedSignal)
+	err := json.Unmarshal(b, sealed)
+	if err != nil {
+		return nil, err
+	}
+	sender, err := crypto.URLBase64ToNACLKey(sealed.Sender)
+	if err != nil {
+		return nil, err
+	}
+	inner, err := key.OpenFrom(sender, sealed.Box)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(inner, v)
+	if err != nil {
+		return nil, err
+	}
+	return sender, nil
+}
+
+// OpenSignalingMsg opens and validates a sealed SignalingMsg of msgType.
+// All errors are returned as *SignalingError to be reported to the peer.
+func OpenSignalingMsg(b []byte, key *crypto.NodeKey, msgType string) (*SignalingMsg, nacl.Key, error) {
+	if len(b) > MaxSignalSize {
+		return nil, nil, signalingErr(ErrCodeMalformed, "payload exceeds %d bytes", MaxSignalSize)
+	}
+	msg := new(SignalingMsg)
+	sender, err := OpenSignal(b, key, msg)
+	if err == crypto.ErrSealedOpen {
+		return nil, nil, signalingErr(ErrCodeSealing, "could not open sealed payload")
+	}
+	if err != nil {
+		return nil, nil, signalingErr(ErrCodeMalformed, "%v", err)
+	}
+	err = msg.Validate(msgType, sender, time.Now())
+	if err != nil {
+		return nil, nil, err
+	}
+	return msg, sender, nil
+}
+
+// OpenOffer opens an offer sealed to any key of keys valid now and
+// returns the offer, its sender and the key it was sealed to.
+// During key rotation, offers to both the old and new key are accepted.
+func OpenOffer(b []byte, keys *crypto.KeySet) (*SignalingMsg, nacl.Key, *crypto.NodeKey, error) {
+	valid := keys.Valid(time.Now())
+	if len(valid) == 0 {
+		return nil, nil, nil, signalingErr(ErrCodeUnavailable, "no valid node key")
+	}
+	var err error
+	for _, key := range valid {
+		var offer *SignalingMsg
+		var sender nacl.Key
+		offer, sender, err = OpenSignalingMsg(b, key, MsgTypeOffer)
+		if sigErr, ok := err.(*SignalingError); ok && sigErr.Code == ErrCodeSealing {
+			continue
+		}
+		return offer, sender, key, err
+	}
+	return nil, nil, nil, err
+}
+
+// offerCache remembers offers until their timestamp is too old to validate
+type offerCache struct {
+	mutex   sync.Mutex
+	size    int
+	expires map[[sha256.Size]byte]time.Time
+}
+
+func newOfferCache(size int) *offerCache {
+	return &offerCache{sync.Mutex{}, size, make(map[[sha256.Size]byte]time.Time)}
+}
+
+// seenOffers holds the offers accepted by NewExit
+var seenOffers = newOfferCache(MaxSeenOffers)
+
+// add returns a *SignalingError if m was seen before, or if the cache
+// is full of offers that have not yet expired.
+func (c *offerCache) add(m *SignalingMsg, now time.Time) error {
+	input, err := m.powInput()
+	if err != nil {
+		return signalingErr(ErrCodeMalformed, "%v", err)
+	}
+	var h [sha256.Size]byte
+	copy(h[:], input)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if exp, ok := c.expires[h]; ok && now.Before(exp) {
+		return signalingErr(ErrCodeReplay, "offer already seen")
+	}
+	if len(c.expires) >= c.size {
+		for k, exp := range c.expires {
+			if !now.Before(exp) {
+				delete(c.expires, k)
+			}
+		}
+	}
+	if len(c.expires) >= c.size {
+		return signalingErr(ErrCodeUnavailable, "too many recent offers")
+	}
+	c.expires[h] = time.Unix(m.Timestamp, 0).Add(MaxSignalClockSkew)
+	return nil
+}
+
+// DecodeSignalingError decodes an error response from a peer
+func DecodeSignalingError(b []byte) error {
+	sigErr := new(SignalingError)
+	err := json.Unmarshal(b, sigErr)
+	if err != nil || sigErr.Code == 0 {
+		return signalingErr(ErrCodeMalformed, "undecodable error response: %q", b)
+	}
+	return sigErr
+}
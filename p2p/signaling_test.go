@@ -0,0 +1,424 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package p2p
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	webrtc "github.com/Gustav-Simonsson/go-webrtc"
+	"github.com/Gustav-Simonsson/orchid-lib/chain"
+	"github.com/Gustav-Simonsson/orchid-lib/crypto"
+	"github.com/Gustav-Simonsson/orchid-lib/crypto/pow"
+)
+
+var (
+	testPoWParams = pow.Params{N: 48, K: 5}
+)
+
+func testSignalingMsg(t *testing.T, key *crypto.NodeKey) *SignalingMsg {
+	sdp := webrtc.SessionDescription{Type: MsgTypeOffer, Sdp: "v=0\r\n"}
+	cands := []*webrtc.IceCandidate{
+		{Candidate: "candidate:1 1 udp 2122260223 192.168.1.2 50000 typ host"},
+	}
+	return NewSignalingMsg(MsgTypeOffer, key, sdp, cands)
+}
+
+func TestSignalingMsgSealOpen(t *testing.T) {
+	src, err := crypto.NewNodeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exit, err := crypto.NewNodeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offer := testSignalingMsg(t, src)
+	err = offer.SolvePoW(testPoWParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := SealSignal(offer, src, exit.Pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, sender, err := OpenSignalingMsg(b, exit, MsgTypeOffer)
+	if err != nil {
+		t.Fatalf("OpenSignalingMsg err: %v", err)
+	}
+	err = msg.VerifyPoW(testPoWParams)
+	if err != nil {
+		t.Fatalf("VerifyPoW err: %v", err)
+	}
+
+	// PoW is bound to the rest of the offer
+	tampered := *offer
+	tampered.Timestamp++
+	err = tampered.VerifyPoW(testPoWParams)
+	if sigErr, ok := err.(*SignalingError); !ok || sigErr.Code != ErrCodeInvalidPoW {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if crypto.NACLKeyToURLBase64(sender) != src.URLBase64() {
+		t.Fatalf("unexpected sender: %v", sender)
+	}
+	if msg.SDPAndIce.Description.Sdp != "v=0\r\n" {
+		t.Fatalf("unexpected SDP: %v", msg.SDPAndIce.Description)
+	}
+
+	_, _, err = OpenSignalingMsg(b, exit, MsgTypeAnswer)
+	if sigErr, ok := err.(*SignalingError); !ok || sigErr.Code != ErrCodeUnexpectedType {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// not addressed to src
+	_, _, err = OpenSignalingMsg(b, src, MsgTypeOffer)
+	if sigErr, ok := err.(*SignalingError); !ok || sigErr.Code != ErrCodeSealing {
+		t.Fatalf("unexpected err: %v", err)
+	}
+}
+
+// offers of newer versions with fields this version does not know
+// keep a valid PoW, while changed fields invalidate it
+func TestSignalingMsgUnknownField(t *testing.T) {
+	key, err := crypto.NewNodeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(testSignalingMsg(t, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(b, &fields); err != nil {
+		t.Fatal(err)
+	}
+	fields["relayHint"] = json.RawMessage(`{"via":["a","b"]}`)
+
+	// a newer sender solves over its message, new field included
+	b, _ = json.Marshal(fields)
+	newer := new(SignalingMsg)
+	if err := json.Unmarshal(b, newer); err != nil {
+		t.Fatal(err)
+	}
+	if err := newer.SolvePoW(testPoWParams); err != nil {
+		t.Fatal(err)
+	}
+	fields["pow"], _ = json.Marshal(newer.PoW)
+	b, _ = json.Marshal(fields)
+
+	msg := new(SignalingMsg)
+	if err := json.Unmarshal(b, msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := msg.VerifyPoW(testPoWParams); err != nil {
+		t.Fatalf("unknown field: %v", err)
+	}
+
+	fields["relayHint"] = json.RawMessage(`{"via":["c"]}`)
+	b, _ = json.Marshal(fields)
+	msg = new(SignalingMsg)
+	if err := json.Unmarshal(b, msg); err != nil {
+		t.Fatal(err)
+	}
+	err = msg.VerifyPoW(testPoWParams)
+	if sigErr, ok := err.(*SignalingError); !ok || sigErr.Code != ErrCodeInvalidPoW {
+		t.Fatalf("changed unknown field: %v", err)
+	}
+}
+
+// offers to the old and new key are accepted while both are valid
+func TestOpenOfferRotation(t *testing.T) {
+	src, err := crypto.NewNodeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := crypto.NewNodeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := crypto.NewKeySet(old)
+	next, err := keys.Rotate(time.Now(), -time.Minute, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, to := range []*crypto.NodeKey{old, next.Key} {
+		b, err := SealSignal(testSignalingMsg(t, src), src, to.Pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, sender, key, err := OpenOffer(b, keys)
+		if err != nil {
+			t.Fatalf("OpenOffer err: %v", err)
+		}
+		if *sender != *src.Pub || key != to {
+			t.Fatalf("unexpected sender or key")
+		}
+	}
+
+	// expired old key
+	keys.Prune(time.Now().Add(2 * time.Hour))
+	b, err := SealSignal(testSignalingMsg(t, src), src, old.Pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, err = OpenOffer(b, keys)
+	if sigErr, ok := err.(*SignalingError); !ok || sigErr.Code != ErrCodeSealing {
+		t.Fatalf("unexpected err: %v", err)
+	}
+}
+
+func TestSignalingMsgValidate(t *testing.T) {
+	key, err := crypto.NewNodeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := crypto.NewNodeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		modify func(m *SignalingMsg)
+		code   ErrorCode
+	}{
+		{"version", func(m *SignalingMsg) { m.Version = SignalingVersion + 1 }, ErrCodeUnsupportedVersion},
+		{"type", func(m *SignalingMsg) { m.Type = "renegotiate" }, ErrCodeUnexpectedType},
+		{"node ID", func(m *SignalingMsg) { m.NodeID = other.URLBase64() }, ErrCodeIdentityMismatch},
+		{"bad node ID", func(m *SignalingMsg) { m.NodeID = "foo" }, ErrCodeMalformed},
+		{"old", func(m *SignalingMsg) { m.Timestamp = now.Add(-time.Hour).Unix() }, ErrCodeBadTimestamp},
+		{"future", func(m *SignalingMsg) { m.Timestamp = now.Add(time.Hour).Unix() }, ErrCodeBadTimestamp},
+		{"SDP type", func(m *SignalingMsg) { m.SDPAndIce.Description.Type = MsgTypeAnswer }, ErrCodeInvalidSDP},
+		{"SDP", func(m *SignalingMsg) { m.SDPAndIce.Description.Sdp = "" }, ErrCodeInvalidSDP},
+		{"no candidates", func(m *SignalingMsg) { m.SDPAndIce.Candidates = nil }, ErrCodeInvalidCandidate},
+		{"nil candidate", func(m *SignalingMsg) { m.SDPAndIce.Candidates[0] = nil }, ErrCodeInvalidCandidate},
+		{"candidate", func(m *SignalingMsg) { m.SDPAndIce.Candidates[0].Candidate = "" }, ErrCodeInvalidCandidate},
+	}
+
+	err = testSignalingMsg(t, key).Validate(MsgTypeOffer, key.Pub, now)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	for _, test := range tests {
+		msg := testSignalingMsg(t, key)
+		test.modify(msg)
+		err := msg.Validate(MsgTypeOffer, key.Pub, now)
+		sigErr, ok := err.(*SignalingError)
+		if !ok || sigErr.Code != test.code {
+			t.Fatalf("%s: unexpected err: %v", test.name, err)
+		}
+	}
+}
+
+func TestBackResponse(t *testing.T) {
+	src, err := crypto.NewNodeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exit, err := crypto.NewNodeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := crypto.NewNodeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	answer := testSignalingMsg(t, exit)
+	answer.Type = MsgTypeAnswer
+	answer.SDPAndIce.Description.Type = MsgTypeAnswer
+
+	r, err := NewBackResponse(exit, 42, answer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := SealSignal(r, exit, src.Pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r1, answer1, err := OpenBackResponse(b, src, exit.Pub)
+	if err != nil {
+		t.Fatalf("OpenBackResponse err: %v", err)
+	}
+	if r1.ETHBlock != 42 || answer1.NodeID != exit.URLBase64() {
+		t.Fatalf("unexpected BackResponse: %v", r1)
+	}
+
+	_, _, err = OpenBackResponse(b, src, other.Pub)
+	if err != ErrSignalSender {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// answerSDP holds the SDP of the answer, as in orchid-core
+	var fields map[string]interface{}
+	j, _ := json.Marshal(r)
+	if err := json.Unmarshal(j, &fields); err != nil || fields["answerSDP"] != answer.SDPAndIce.Description.Sdp {
+		t.Fatalf("unexpected answerSDP: %v", fields["answerSDP"])
+	}
+	r.AnswerSDP += " "
+	_, err = r.Verify(exit.Pub)
+	if sigErr, ok := err.(*SignalingError); !ok || sigErr.Code != ErrCodeInvalidSDP {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// tampering with any PoW covered field invalidates the PoW
+	r.ETHBlock++
+	_, err = r.Verify(exit.Pub)
+	if sigErr, ok := err.(*SignalingError); !ok || sigErr.Code != ErrCodeMalformed {
+		t.Fatalf("unexpected err: %v", err)
+	}
+}
+
+func TestBackResponseBlock(t *testing.T) {
+	r := &BackResponse{ETHBlock: 1000}
+	for head, ok := range map[uint64]bool{
+		1000:                 true,
+		1000 - MaxBlockAhead: true,
+		999 - MaxBlockAhead:  false,
+		1000 + MaxBlockAge:   true,
+		1001 + MaxBlockAge:   false,
+	} {
+		err := r.VerifyBlock(head)
+		if ok != (err == nil) {
+			t.Errorf("head %d: unexpected err: %v", head, err)
+		}
+		if sigErr, isSigErr := err.(*SignalingError); err != nil && (!isSigErr || sigErr.Code != ErrCodeStaleBlock) {
+			t.Errorf("head %d: unexpected err: %v", head, err)
+		}
+	}
+
+	head := chain.NewFakeHead(1000, 0)
+	if block, err := HeadBlock(head); block != 1000 || err != nil {
+		t.Fatal(block, err)
+	}
+	if err := r.checkBlock(head); err != nil {
+		t.Fatal(err)
+	}
+	head.Set(2000)
+	if err := r.checkBlock(head); err == nil {
+		t.Fatal("stale block accepted")
+	}
+	head.Set(math.MaxUint32 + 1)
+	if _, err := HeadBlock(head); err != ErrBlockRange {
+		t.Fatal(err)
+	}
+}
+
+func TestBackResponseSigned(t *testing.T) {
+	src, err := crypto.NewNodeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exit, err := crypto.NewNodeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idKey, err := crypto.NewIdentityKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := crypto.NewIdentity(idKey, exit)
+
+	answer := testSignalingMsg(t, exit)
+	answer.Type = MsgTypeAnswer
+	answer.SDPAndIce.Description.Type = MsgTypeAnswer
+	r, err := NewBackResponse(exit, 42, answer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Sign(id)
+	b, err := SealSignal(r, exit, src.Pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r1, _, err := OpenBackResponse(b, src, exit.Pub)
+	if err != nil {
+		t.Fatalf("OpenBackResponse err: %v", err)
+	}
+	if r1.Identity == nil || !bytes.Equal(r1.Identity.Identity, idKey.Pub) {
+		t.Fatalf("unexpected BackResponse identity: %v", r1.Identity)
+	}
+
+	// signature by an identity binding another node key
+	other, err := crypto.NewNodeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r1.Identity = idKey.Bind(other.Pub)
+	_, err = r1.Verify(exit.Pub)
+	if sigErr, ok := err.(*SignalingError); !ok || sigErr.Code != ErrCodeIdentityMismatch {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	r1.Identity = id.Binding
+	r1.Sig[0] ^= 1
+	_, err = r1.Verify(exit.Pub)
+	if sigErr, ok := err.(*SignalingError); !ok || sigErr.Code != ErrCodeInvalidSignature {
+		t.Fatalf("unexpected err: %v", err)
+	}
+}
+
+func TestOfferCache(t *testing.T) {
+	key, err := crypto.NewNodeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	c := newOfferCache(2)
+
+	a := testSignalingMsg(t, key)
+	if err := c.add(a, now); err != nil {
+		t.Fatal(err)
+	}
+	err = c.add(a, now)
+	if sigErr, ok := err.(*SignalingError); !ok || sigErr.Code != ErrCodeReplay {
+		t.Fatalf("replayed offer: %v", err)
+	}
+
+	b := testSignalingMsg(t, key)
+	b.Timestamp = a.Timestamp + 1
+	if err := c.add(b, now); err != nil {
+		t.Fatal(err)
+	}
+	d := testSignalingMsg(t, key)
+	d.Timestamp = a.Timestamp + 2
+	err = c.add(d, now)
+	if sigErr, ok := err.(*SignalingError); !ok || sigErr.Code != ErrCodeUnavailable {
+		t.Fatalf("offer beyond cache size: %v", err)
+	}
+
+	// Expired offers make room, and would fail Validate anyway
+	later := now.Add(MaxSignalClockSkew + 3*time.Second)
+	if err := c.add(d, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.add(a, later); err != nil {
+		t.Fatal(err)
+	}
+}
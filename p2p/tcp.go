@@ -97,7 +97,9 @@ func (ts *TCPProxy) ListenAndServe() error {
 	return nil
 }
 
-func ServeConn(src net.Conn, dst io.ReadWriteCloser) {
+// ServeConn streams between src and dst until either is closed.
+// src is typically a net.Conn, or a DataChannel on relays.
+func ServeConn(src, dst io.ReadWriteCloser) {
 	srcDone := make(chan struct{}, 1)
 	dstDone := make(chan struct{}, 1)
 
@@ -21,17 +21,20 @@ package p2p
 
 import (
 	"bytes"
-	"encoding/json"
-	"fmt"
+	"errors"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strconv"
 	"sync"
+	"time"
 
 	webrtc "github.com/Gustav-Simonsson/go-webrtc"
+	"github.com/Gustav-Simonsson/orchid-lib/chain"
+	"github.com/Gustav-Simonsson/orchid-lib/crypto"
 	"github.com/ethereum/go-ethereum/log"
+	nacl "github.com/kevinburke/nacl"
 )
 
 /* WebRTC 1.0 Protocol
@@ -46,40 +49,83 @@ import (
 const (
 	// TODO: remove when Orchid nodes implement STUN
 	stunServer = "stun:stun.l.google.com:19302"
+
+	// label of the first DataChannel of a peer, used for control messages
+	ControlLabel = "0"
+)
+
+var (
+	ErrPeerDone       = errors.New("WebRTC peer connection failed or closed")
+	ErrControlTimeout = errors.New("timeout waiting for control DataChannel")
 )
 
 type WebRTCPeer struct {
 	Mutex    sync.Mutex
 	RefURL   *url.URL
+	PeerPub  nacl.Key // remote NaCl key the signaling was sealed with
 	PC       *webrtc.PeerConnection
 	DCs      []*webrtc.DataChannel
 	DCLabel  uint64
 	IceCands []*webrtc.IceCandidate
+
+	state    *peerState
+	session  *crypto.Session    // set by Handshake or AcceptHandshake
+	identity *crypto.KeyBinding // verified identity of the remote node, if signed
+	localKey *crypto.NodeKey    // the offer was sealed to, set by NewExit
 }
 
-// TODO: this JSON schema is temp in lieu of first protocol spec lockdown
-type SDPAndIce struct {
-	Description webrtc.SessionDescription `json:"description"`
-	Candidates  []*webrtc.IceCandidate
+// peerState tracks the PeerConnection state transitions
+// users of a WebRTCPeer can wait on
+type peerState struct {
+	connectedOnce sync.Once
+	connected     chan struct{}
+	doneOnce      sync.Once
+	done          chan struct{}
+
+	ctrlOnce sync.Once
+	ctrlOpen chan struct{}
+	ctrl     *DCReadWriteCloser
 }
 
-type Offer struct {
-	Inner SDPAndIce `json:"offer"`
+func newPeerState() *peerState {
+	return &peerState{
+		sync.Once{},
+		make(chan struct{}),
+		sync.Once{},
+		make(chan struct{}),
+
+		sync.Once{},
+		make(chan struct{}),
+		nil,
+	}
 }
 
-type Answer struct {
-	Inner SDPAndIce `json:"answer"`
+func (s *peerState) onControlOpen(dc *webrtc.DataChannel) {
+	s.ctrlOnce.Do(func() {
+		s.ctrl = NewDCReadWriteCloser(dc, "ctrl")
+		close(s.ctrlOpen)
+	})
 }
 
-// see orchid-core/src/index.ts interface BackResponse
-type BackResponse struct {
-	Pub         string `json:"nodePub"`
-	ETHBlock    uint32 `json:"ethBlock"`
-	PoWSolution uint64 `json:"powSolution"` // TODO: Equihash
-	Answer      string `json:"answerSDP"`
+func (s *peerState) onConnectionStateChange(state webrtc.PeerConnectionState) {
+	switch state {
+	case webrtc.PeerConnectionStateConnected:
+		s.connectedOnce.Do(func() { close(s.connected) })
+	case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+		// Disconnected can be transient and is not treated as done
+		s.doneOnce.Do(func() { close(s.done) })
+	}
 }
 
-func NewWebRTCPeer(ref *url.URL) (*WebRTCPeer, error) {
+// NewWebRTCPeer connects to the node at ref which must hold the private
+// key of peerPub. Signaling is sealed from a fresh ephemeral key.
+// The block of the BackResponse is checked against head, unless nil.
+func NewWebRTCPeer(ref *url.URL, peerPub nacl.Key, head chain.HeadProvider) (*WebRTCPeer, error) {
+	ephKey, err := crypto.NewNodeKey()
+	if err != nil {
+		return nil, err
+	}
+
 	// Prior to step 1:
 	// configure go-webrtc lib, create a new PeerConnection and add
 	// event listeners for Ice, signaling and connection events.
@@ -121,17 +167,24 @@ func NewWebRTCPeer(ref *url.URL) (*WebRTCPeer, error) {
 	pc.OnSignalingStateChange = func(s webrtc.SignalingState) {
 		log.Debug("OnSignalingStateChange ", "state", s)
 	}
+	state := newPeerState()
 	pc.OnConnectionStateChange = func(s webrtc.PeerConnectionState) {
 		log.Debug("OnConnectionStateChange ", "state", s)
+		state.onConnectionStateChange(s)
 	}
 
 	// To trigger ICE, we have to create a RTCDataChannel before
 	// we create the signaling offer
-	dc, err := pc.CreateDataChannel("0")
+	// It is then used as the control channel of the peer,
+	// starting with the handshake (see handshake.go).
+	dc, err := pc.CreateDataChannel(ControlLabel)
 	if err != nil {
 		log.Error("CreateDataChannel", "err", err)
 		return nil, err
 	}
+	dc.OnOpen = func() {
+		state.onControlOpen(dc)
+	}
 
 	// Step 1:
 	offerSDP, err := pc.CreateOffer()
@@ -153,9 +206,14 @@ func NewWebRTCPeer(ref *url.URL) (*WebRTCPeer, error) {
 	}
 
 	// Step 3: transmit WebRTC offer and ICE candidates over signaling channel;
-	//         HTTP(S) for now
-	response := Offer{SDPAndIce{*offerSDP, cands}}
-	b, err := json.Marshal(response)
+	//         HTTP(S) for now, sealed to the public key of the remote node
+	offer := NewSignalingMsg(MsgTypeOffer, ephKey, *offerSDP, cands)
+	err = offer.SolvePoW(OfferPoWParams)
+	if err != nil {
+		log.Error("Offer PoW", "err", err)
+		return nil, err
+	}
+	b, err := SealSignal(offer, ephKey, peerPub)
 	if err != nil {
 		return nil, err
 	}
@@ -167,23 +225,30 @@ func NewWebRTCPeer(ref *url.URL) (*WebRTCPeer, error) {
 		return nil, err
 	}
 	// Step 9: receive the answer (validate response)
+	defer resp.Body.Close()
+	b, err = ioutil.ReadAll(io.LimitReader(resp.Body, MaxSignalSize+1))
+	if err != nil {
+		log.Error("Could not read HTTP response body", "err", err)
+		return nil, err
+	}
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("WebRTC signaling over HTTP failed, resp.StatusCode: %d\n", resp.StatusCode)
+		err = DecodeSignalingError(b)
+		log.Error("WebRTC signaling over HTTP failed", "status", resp.StatusCode, "err", err)
+		return nil, err
 	}
 
-	b, err = ioutil.ReadAll(resp.Body)
+	backResp, answer, err := OpenBackResponse(b, ephKey, peerPub)
 	if err != nil {
-		log.Error("Could not read HTTP response body", "err", err)
+		log.Error("Could not open signaling BackResponse", "err", err)
 		return nil, err
 	}
-
-	answer := new(Answer)
-	err = json.Unmarshal(b, &answer)
-	sdpAndIce := answer.Inner
+	log.Debug("BackResponse", "nodePub", backResp.Pub, "ethBlock", backResp.ETHBlock, "signed", backResp.Identity != nil)
+	err = backResp.checkBlock(head)
 	if err != nil {
-		log.Error("Could not decode HTTP response body JSON", "err", err)
+		log.Error("BackResponse block", "err", err)
 		return nil, err
 	}
+	sdpAndIce := answer.SDPAndIce
 	answerSDP := sdpAndIce.Description
 
 	// Step 10: (validates the received SDP)
@@ -195,9 +260,6 @@ func NewWebRTCPeer(ref *url.URL) (*WebRTCPeer, error) {
 
 	// Add candidates from peer
 	for _, c := range sdpAndIce.Candidates {
-		if c == nil || c.Candidate == "" {
-			continue // TODO: verify if correct behaviour
-		}
 		err = pc.AddIceCandidate(*c)
 		if err != nil {
 			log.Error("AddIceCandidate", "err", err)
@@ -208,10 +270,15 @@ func NewWebRTCPeer(ref *url.URL) (*WebRTCPeer, error) {
 	peer := WebRTCPeer{
 		sync.Mutex{},
 		ref,
+		peerPub,
 		pc,
 		[]*webrtc.DataChannel{dc},
 		0,
 		cands,
+		state,
+		nil,
+		backResp.Identity,
+		nil,
 	}
 
 	return &peer, nil
@@ -230,22 +297,33 @@ func (p *WebRTCPeer) NewDataChannel() (*webrtc.DataChannel, error) {
 	return dc, nil
 }
 
-func NewExit(b []byte, dcReady chan *DCReadWriteCloser) ([]byte, *WebRTCPeer, error) {
-	offer := new(Offer)
-	err := json.Unmarshal(b, offer)
+// NewExit handles a sealed Offer addressed to a valid key of keys and
+// returns a BackResponse, stamped with ethBlock and signed by id unless nil,
+// sealed back to the sender of the Offer.
+// Invalid offers are rejected with a *SignalingError.
+func NewExit(b []byte, keys *crypto.KeySet, id *crypto.Identity, ethBlock uint32, dcReady chan *DCReadWriteCloser) ([]byte, *WebRTCPeer, error) {
+	offer, sender, key, err := OpenOffer(b, keys)
 	if err != nil {
-		log.Error("Parsing WebRTC Offer", "err", err)
+		log.Error("Opening WebRTC Offer", "err", err)
+		return nil, nil, err
+	}
+	// Verify the source paid the PoW, and did not pay it for an offer
+	// seen before, before allocating a PeerConnection
+	err = offer.VerifyPoW(OfferPoWParams)
+	if err != nil {
+		log.Error("WebRTC Offer PoW", "err", err)
+		return nil, nil, err
+	}
+	err = seenOffers.add(offer, time.Now())
+	if err != nil {
+		log.Error("WebRTC Offer replay", "err", err)
 		return nil, nil, err
 	}
 	log.Debug("offer", "struct", offer)
-	sdpAndIce := offer.Inner
+	sdpAndIce := offer.SDPAndIce
 	//log.Debug("WebRTC Offer", "type", sdpAndIce.Description.Type, "sdp", sdpAndIce.Description.Sdp)
 	for i, c := range sdpAndIce.Candidates {
-		if c != nil {
-			log.Debug("RECEIVED ICE", "index", i, "candidate", c.Candidate, "sdpMid", c.SdpMid, "SdpMLineIndex", c.SdpMLineIndex)
-		} else {
-			log.Warn("Received nil ICE Candidate")
-		}
+		log.Debug("RECEIVED ICE", "index", i, "candidate", c.Candidate, "sdpMid", c.SdpMid, "SdpMLineIndex", c.SdpMLineIndex)
 	}
 
 	// At this point we have what looks like a valid WebRTC offer SDP,
@@ -260,17 +338,26 @@ func NewExit(b []byte, dcReady chan *DCReadWriteCloser) ([]byte, *WebRTCPeer, er
 		return nil, nil, err
 	}
 
+	state := newPeerState()
 	pc.OnDataChannel = func(d *webrtc.DataChannel) {
-		if d.Label() == "0" {
+		if d.Label() == ControlLabel {
+			d.OnOpen = func() {
+				state.onControlOpen(d)
+			}
 			return
 		}
+		// nobody receives from dcReady once the peer is done
 		d.OnOpen = func() {
-			dcReady <- NewDCReadWriteCloser(d, "exit")
+			select {
+			case dcReady <- NewDCReadWriteCloser(d, "exit"):
+			case <-state.done:
+				d.Close()
+			}
 		}
 	}
 
 	// Listen to our own candidates
-	cands := make([]*webrtc.IceCandidate, 2)
+	cands := make([]*webrtc.IceCandidate, 0, 2)
 	candChan := make(chan webrtc.IceCandidate, 2)
 	// ICE Events
 	pc.OnIceCandidate = func(c webrtc.IceCandidate) {
@@ -294,8 +381,9 @@ func NewExit(b []byte, dcReady chan *DCReadWriteCloser) ([]byte, *WebRTCPeer, er
 	pc.OnSignalingStateChange = func(s webrtc.SignalingState) {
 		log.Debug("OnSignalingStateChange: ", "state", s)
 	}
-	pc.OnConnectionStateChange = func(webrtc.PeerConnectionState) {
-		log.Debug("OnConnectionStateChange: ")
+	pc.OnConnectionStateChange = func(s webrtc.PeerConnectionState) {
+		log.Debug("OnConnectionStateChange: ", "state", s)
+		state.onConnectionStateChange(s)
 	}
 
 	err = pc.SetRemoteDescription(&sdpAndIce.Description)
@@ -306,9 +394,6 @@ func NewExit(b []byte, dcReady chan *DCReadWriteCloser) ([]byte, *WebRTCPeer, er
 
 	// Add candidates from peer
 	for _, c := range sdpAndIce.Candidates {
-		if c == nil || c.Candidate == "" {
-			continue // TODO: verify if should we skip here
-		}
 		log.Debug("ICE", "adding", c, "c.candidate", c.Candidate)
 		err = pc.AddIceCandidate(*c)
 		if err != nil {
@@ -339,11 +424,17 @@ func NewExit(b []byte, dcReady chan *DCReadWriteCloser) ([]byte, *WebRTCPeer, er
 		cands = append(cands, &cand)
 	}
 
-	// Step 8:
-	// TODO: for now we send back Orchid specific fields alongside
-	//       the answer SDP. For live network everything must be encrypted
-	resp := Answer{SDPAndIce{*answerSDP, cands}}
-	respBuf, err := json.Marshal(resp)
+	// Step 8: answer, with Orchid specific fields in a BackResponse,
+	//         sealed back to the (ephemeral) key of the sender
+	answer := NewSignalingMsg(MsgTypeAnswer, key, *answerSDP, cands)
+	resp, err := NewBackResponse(key, ethBlock, answer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if id != nil {
+		resp.Sign(id.For(key))
+	}
+	respBuf, err := SealSignal(resp, key, sender)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -352,15 +443,71 @@ func NewExit(b []byte, dcReady chan *DCReadWriteCloser) ([]byte, *WebRTCPeer, er
 	peer := WebRTCPeer{
 		sync.Mutex{},
 		nil,
+		sender,
 		pc,
 		[]*webrtc.DataChannel{},
 		0,
 		cands,
+		state,
+		nil,
+		nil,
+		key,
 	}
 
 	return respBuf, &peer, nil
 }
 
+// Connected is closed when the PeerConnection is established
+func (p *WebRTCPeer) Connected() <-chan struct{} {
+	return p.state.connected
+}
+
+// Identity is the verified identity the remote node signed its
+// BackResponse with, or nil if unsigned or not known
+func (p *WebRTCPeer) Identity() *crypto.KeyBinding {
+	return p.identity
+}
+
+// LocalKey is the key of the node the remote peer sent its offer to,
+// for peers created with NewExit
+func (p *WebRTCPeer) LocalKey() *crypto.NodeKey {
+	return p.localKey
+}
+
+// Done is closed when the PeerConnection has failed or is closed
+func (p *WebRTCPeer) Done() <-chan struct{} {
+	return p.state.done
+}
+
+// Control returns the control DataChannel of the peer once it is open
+func (p *WebRTCPeer) Control(timeout time.Duration) (*DCReadWriteCloser, error) {
+	select {
+	case <-p.state.ctrlOpen:
+		return p.state.ctrl, nil
+	case <-p.state.done:
+		return nil, ErrPeerDone
+	case <-time.After(timeout):
+		return nil, ErrControlTimeout
+	}
+}
+
+// Close closes all DataChannels and the PeerConnection
+func (p *WebRTCPeer) Close() error {
+	p.Mutex.Lock()
+	for _, dc := range p.DCs {
+		err := dc.Close()
+		if err != nil {
+			log.Debug("DataChannel.Close", "err", err)
+		}
+	}
+	p.Mutex.Unlock()
+
+	err := p.PC.Close()
+	// OnConnectionStateChange is not guaranteed to fire after Close
+	p.state.doneOnce.Do(func() { close(p.state.done) })
+	return err
+}
+
 /* DCReadWriteCloser wraps webrtc.DataChannel with a mutex for
    concurrent access and a byte buffer and closed flag to implement
    the io.ReadWriterCloser interface as a more generic way of interfacing
@@ -416,6 +563,11 @@ func NewDCReadWriteCloser(dc *webrtc.DataChannel, dbg string) *DCReadWriteCloser
 	return d
 }
 
+// Label is the label of the DataChannel, unique within its peer
+func (d *DCReadWriteCloser) Label() string {
+	return d.dc.Label()
+}
+
 func (d *DCReadWriteCloser) Read(p []byte) (n int, err error) {
 	//label := d.dc.Label()
 	d.stateMutex.Lock()
@@ -0,0 +1,144 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package payment
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/* Deposits
+
+   A ticket is only worth its face value if the Lottery can pay it from
+   the deposit of its source when it wins. An exit checks the deposit of
+   the signer of each ticket before accepting it: the balance must cover
+   the face value, and the deposit must not be unlocking, since a source
+   withdraws UNLOCK_DELAY after unlocking and tickets it paid would then
+   not pay out. Ticket lifetimes are bounded well below UNLOCK_DELAY
+   (see MaxTicketLifetime), so a ticket accepted before an unlock can
+   still be redeemed after it.
+
+   The deposits are read from the contract at most once per CacheAge per
+   source, so a metered peer does not cost a call per ticket.
+
+   Deposits also serve as the stake of node operators (see Stake and
+   node/select.go): a deposit is ether an operator holds at risk in the
+   Lottery, and one that is unlocking counts as no stake.
+*/
+
+const (
+	DefaultDepositCacheAge = time.Minute
+	DepositTimeout         = 5 * time.Second
+)
+
+var (
+	ErrDepositBalance   = errors.New("deposit does not cover ticket face value")
+	ErrDepositUnlocking = errors.New("deposit unlocking")
+)
+
+// Deposits checks the deposits of sources with the Lottery contract
+type Deposits struct {
+	lottery  *LotteryCaller
+	CacheAge time.Duration
+
+	mutex sync.Mutex
+	cache map[common.Address]*deposit
+}
+
+type deposit struct {
+	balance *big.Int
+	unlock  *big.Int
+	checked time.Time
+}
+
+func NewDeposits(address common.Address, caller bind.ContractCaller) (*Deposits, error) {
+	lottery, err := NewLotteryCaller(address, caller)
+	if err != nil {
+		return nil, err
+	}
+	return &Deposits{lottery, DefaultDepositCacheAge, sync.Mutex{}, make(map[common.Address]*deposit)}, nil
+}
+
+// Check checks that the deposit of source covers faceValue and is not
+// unlocking
+func (d *Deposits) Check(source common.Address, faceValue *big.Int, now time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DepositTimeout)
+	defer cancel()
+	dep, err := d.get(ctx, source, now)
+	if err != nil {
+		return err
+	}
+	if dep.unlock.Sign() != 0 {
+		return ErrDepositUnlocking
+	}
+	if dep.balance.Cmp(faceValue) < 0 {
+		return ErrDepositBalance
+	}
+	return nil
+}
+
+// Stake returns the deposit of account unless it is unlocking, and
+// satisfies node.StakeProvider
+func (d *Deposits) Stake(ctx context.Context, account common.Address) (*big.Int, error) {
+	dep, err := d.get(ctx, account, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if dep.unlock.Sign() != 0 {
+		return new(big.Int), nil
+	}
+	return new(big.Int).Set(dep.balance), nil
+}
+
+func (d *Deposits) get(ctx context.Context, source common.Address, now time.Time) (*deposit, error) {
+	d.mutex.Lock()
+	dep, ok := d.cache[source]
+	d.mutex.Unlock()
+	if ok && now.Sub(dep.checked) < d.CacheAge {
+		return dep, nil
+	}
+
+	opts := &bind.CallOpts{Context: ctx}
+	balance, err := d.lottery.Balances(opts, source)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := d.lottery.Unlocks(opts, source)
+	if err != nil {
+		return nil, err
+	}
+	dep = &deposit{balance, unlock, now}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for a, old := range d.cache {
+		if now.Sub(old.checked) >= d.CacheAge {
+			delete(d.cache, a)
+		}
+	}
+	d.cache[source] = dep
+	return dep, nil
+}
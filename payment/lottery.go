@@ -0,0 +1,1060 @@
+// Code generated - DO NOT EDIT.
+// This file is a generated binding and any manual changes will be lost.
+
+package payment
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/event"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var (
+	_ = errors.New
+	_ = big.NewInt
+	_ = strings.NewReader
+	_ = ethereum.NotFound
+	_ = bind.Bind
+	_ = common.Big1
+	_ = types.BloomLookup
+	_ = event.NewSubscription
+	_ = abi.ConvertType
+	_ = time.Tick
+	_ = context.Background
+)
+
+// LotteryMetaData contains all meta data concerning the Lottery contract.
+var LotteryMetaData = &bind.MetaData{
+	ABI: "[{\"anonymous\":false,\"inputs\":[{\"indexed\":true,\"internalType\":\"address\",\"name\":\"source\",\"type\":\"address\"},{\"indexed\":false,\"internalType\":\"uint256\",\"name\":\"amount\",\"type\":\"uint256\"}],\"name\":\"Deposited\",\"type\":\"event\"},{\"anonymous\":false,\"inputs\":[{\"indexed\":true,\"internalType\":\"bytes32\",\"name\":\"ticket\",\"type\":\"bytes32\"},{\"indexed\":true,\"internalType\":\"address\",\"name\":\"source\",\"type\":\"address\"},{\"indexed\":true,\"internalType\":\"address\",\"name\":\"recipient\",\"type\":\"address\"},{\"indexed\":false,\"internalType\":\"uint256\",\"name\":\"amount\",\"type\":\"uint256\"}],\"name\":\"Redeemed\",\"type\":\"event\"},{\"anonymous\":false,\"inputs\":[{\"indexed\":true,\"internalType\":\"address\",\"name\":\"source\",\"type\":\"address\"},{\"indexed\":false,\"internalType\":\"uint256\",\"name\":\"at\",\"type\":\"uint256\"}],\"name\":\"Unlocked\",\"type\":\"event\"},{\"anonymous\":false,\"inputs\":[{\"indexed\":true,\"internalType\":\"address\",\"name\":\"source\",\"type\":\"address\"},{\"indexed\":false,\"internalType\":\"uint256\",\"name\":\"amount\",\"type\":\"uint256\"}],\"name\":\"Withdrawn\",\"type\":\"event\"},{\"inputs\":[],\"name\":\"UNLOCK_DELAY\",\"outputs\":[{\"internalType\":\"uint256\",\"name\":\"\",\"type\":\"uint256\"}],\"stateMutability\":\"view\",\"type\":\"function\"},{\"inputs\":[{\"internalType\":\"address\",\"name\":\"\",\"type\":\"address\"}],\"name\":\"balances\",\"outputs\":[{\"internalType\":\"uint256\",\"name\":\"\",\"type\":\"uint256\"}],\"stateMutability\":\"view\",\"type\":\"function\"},{\"inputs\":[],\"name\":\"deposit\",\"outputs\":[],\"stateMutability\":\"payable\",\"type\":\"function\"},{\"inputs\":[{\"internalType\":\"bytes32\",\"name\":\"secret\",\"type\":\"bytes32\"},{\"internalType\":\"address\",\"name\":\"recipient\",\"type\":\"address\"},{\"internalType\":\"uint256\",\"name\":\"faceValue\",\"type\":\"uint256\"},{\"internalType\":\"uint64\",\"name\":\"winProb\",\"type\":\"uint64\"},{\"internalType\":\"bytes32\",\"name\":\"nonce\",\"type\":\"bytes32\"},{\"internalType\":\"uint64\",\"name\":\"expiry\",\"type\":\"uint64\"},{\"internalType\":\"uint8\",\"name\":\"v\",\"type\":\"uint8\"},{\"internalType\":\"bytes32\",\"name\":\"r\",\"type\":\"bytes32\"},{\"internalType\":\"bytes32\",\"name\":\"s\",\"type\":\"bytes32\"}],\"name\":\"redeem\",\"outputs\":[],\"stateMutability\":\"nonpayable\",\"type\":\"function\"},{\"inputs\":[{\"internalType\":\"bytes32\",\"name\":\"\",\"type\":\"bytes32\"}],\"name\":\"spent\",\"outputs\":[{\"internalType\":\"bool\",\"name\":\"\",\"type\":\"bool\"}],\"stateMutability\":\"view\",\"type\":\"function\"},{\"inputs\":[{\"internalType\":\"bytes32\",\"name\":\"commit\",\"type\":\"bytes32\"},{\"internalType\":\"address\",\"name\":\"recipient\",\"type\":\"address\"},{\"internalType\":\"uint256\",\"name\":\"faceValue\",\"type\":\"uint256\"},{\"internalType\":\"uint64\",\"name\":\"winProb\",\"type\":\"uint64\"},{\"internalType\":\"bytes32\",\"name\":\"nonce\",\"type\":\"bytes32\"},{\"internalType\":\"uint64\",\"name\":\"expiry\",\"type\":\"uint64\"}],\"name\":\"ticketHash\",\"outputs\":[{\"internalType\":\"bytes32\",\"name\":\"\",\"type\":\"bytes32\"}],\"stateMutability\":\"pure\",\"type\":\"function\"},{\"inputs\":[],\"name\":\"unlock\",\"outputs\":[],\"stateMutability\":\"nonpayable\",\"type\":\"function\"},{\"inputs\":[{\"internalType\":\"address\",\"name\":\"\",\"type\":\"address\"}],\"name\":\"unlocks\",\"outputs\":[{\"internalType\":\"uint256\",\"name\":\"\",\"type\":\"uint256\"}],\"stateMutability\":\"view\",\"type\":\"function\"},{\"inputs\":[],\"name\":\"withdraw\",\"outputs\":[],\"stateMutability\":\"nonpayable\",\"type\":\"function\"}]",
+	Bin: "0x608060405234801561001057600080fd5b506109f9806100206000396000f3fe6080604052600436106100865760003560e01c806393203e671161005957806393203e6714610122578063a69df4b514610139578063ae20bed31461014e578063d0e30db01461018e578063eb8844f91461019657600080fd5b806313d2e2f61461008b57806327e235e3146100ad5780633ccfd60b146100ed57806376e95c3314610102575b600080fd5b34801561009757600080fd5b506100ab6100a6366004610858565b6101c3565b005b3480156100b957600080fd5b506100da6100c83660046108e7565b60006020819052908152604090205481565b6040519081526020015b60405180910390f35b3480156100f957600080fd5b506100ab610597565b34801561010e57600080fd5b506100da61011d366004610909565b6106d5565b34801561012e57600080fd5b506100da6201518081565b34801561014557600080fd5b506100ab610760565b34801561015a57600080fd5b5061017e610169366004610968565b60026020526000908152604090205460ff1681565b60405190151581526020016100e4565b6100ab6107bc565b3480156101a257600080fd5b506100da6101b13660046108e7565b60016020526000908152604090205481565b8367ffffffffffffffff1642106102125760405162461bcd60e51b815260206004820152600e60248201526d1d1a58dad95d08195e1c1a5c995960921b60448201526064015b60405180910390fd5b600061024a8a60405160200161022a91815260200190565b604051602081830303815290604052805190602001208a8a8a8a8a6106d5565b60008181526002602052604090205490915060ff161561029b5760405162461bcd60e51b815260206004820152600c60248201526b1d1a58dad95d081cdc195b9d60a21b6044820152606401610209565b67ffffffffffffffff87811614806102f3575060408051602081018c905290810182905267ffffffffffffffff8816906060016040516020818303038152906040528051906020012060c01c67ffffffffffffffff16105b6103355760405162461bcd60e51b81526020600482015260136024820152723a34b1b5b2ba103237b2b9903737ba103bb4b760691b6044820152606401610209565b6040517f19457468657265756d205369676e6564204d6573736167653a0a3332000000006020820152603c8101829052600090600190605c0160408051601f198184030181528282528051602091820120600084529083018083525260ff881690820152606081018690526080810185905260a0016020604051602081039080840390855afa1580156103cc573d6000803e3d6000fd5b5050604051601f1901519150506001600160a01b0381166104235760405162461bcd60e51b8152602060048201526011602482015270696e76616c6964207369676e617475726560781b6044820152606401610209565b6000828152600260209081526040808320805460ff191660011790556001600160a01b038416835290829052902054899081111561047657506001600160a01b0381166000908152602081905260409020545b6001600160a01b0382166000908152602081905260408120805483929061049e908490610997565b925050819055508a6001600160a01b0316826001600160a01b0316847fbdbaf70d5ad57b002382ab2439f43339eb5034dcb891ec13621a3009033f3e61846040516104eb91815260200190565b60405180910390a460008b6001600160a01b03168260405160006040518083038185875af1925050503d8060008114610540576040519150601f19603f3d011682016040523d82523d6000602084013e610545565b606091505b50509050806105885760405162461bcd60e51b815260206004820152600f60248201526e1d1c985b9cd9995c8819985a5b1959608a1b6044820152606401610209565b50505050505050505050505050565b3360009081526001602052604090205480158015906105b65750804210155b6105f35760405162461bcd60e51b815260206004820152600e60248201526d19195c1bdcda5d081b1bd8dad95960921b6044820152606401610209565b336000818152602081815260408083208054908490556001835281842093909355518281529192917f7084f5476618d8e60b11ef0d7d3f06914655adb8793e28ff7f018d4c76d505d5910160405180910390a2604051600090339083908381818185875af1925050503d8060008114610688576040519150601f19603f3d011682016040523d82523d6000602084013e61068d565b606091505b50509050806106d05760405162461bcd60e51b815260206004820152600f60248201526e1d1c985b9cd9995c8819985a5b1959608a1b6044820152606401610209565b505050565b604080516f6f7263686964207469636b657420763160801b602080830191909152603082019890985260609690961b6bffffffffffffffffffffffff19166050870152606486019490945260c092831b6001600160c01b03199081166084870152608c86019290925290911b1660ac8301528051609481840301815260b49092019052805191012090565b61076d62015180426109b0565b33600081815260016020526040908190208390555190917f0f0bc5b519ddefdd8e5f9e6423433aa2b869738de2ae34d58ebc796fc749fa0d916107b291815260200190565b60405180910390a2565b33600090815260208190526040812080543492906107db9084906109b0565b90915550503360008181526001602052604080822091909155517f2da466a7b24304f47e87fa2e1e5a81b9831ce54fec19055ce277ca2f39ba42c4906107b29034815260200190565b80356001600160a01b038116811461083b57600080fd5b919050565b803567ffffffffffffffff8116811461083b57600080fd5b60008060008060008060008060006101208a8c03121561087757600080fd5b8935985061088760208b01610824565b975060408a0135965061089c60608b01610840565b955060808a013594506108b160a08b01610840565b935060c08a013560ff811681146108c757600080fd5b8093505060e08a013591506101008a013590509295985092959850929598565b6000602082840312156108f957600080fd5b61090282610824565b9392505050565b60008060008060008060c0878903121561092257600080fd5b8635955061093260208801610824565b94506040870135935061094760608801610840565b92506080870135915061095c60a08801610840565b90509295509295509295565b60006020828403121561097a57600080fd5b5035919050565b634e487b7160e01b600052601160045260246000fd5b818103818111156109aa576109aa610981565b92915050565b808201808211156109aa576109aa61098156fea2646970667358221220363b729627ae114e86e38c3eb043be1bf6a4752929cd21cd5ee151109fe4fa6264736f6c63430008150033",
+}
+
+// LotteryABI is the input ABI used to generate the binding from.
+// Deprecated: Use LotteryMetaData.ABI instead.
+var LotteryABI = LotteryMetaData.ABI
+
+// LotteryBin is the compiled bytecode used for deploying new contracts.
+// Deprecated: Use LotteryMetaData.Bin instead.
+var LotteryBin = LotteryMetaData.Bin
+
+// DeployLottery deploys a new Ethereum contract, binding an instance of Lottery to it.
+func DeployLottery(auth *bind.TransactOpts, backend bind.ContractBackend) (common.Address, *types.Transaction, *Lottery, error) {
+	parsed, err := LotteryMetaData.GetAbi()
+	if err != nil {
+		return common.Address{}, nil, nil, err
+	}
+	if parsed == nil {
+		return common.Address{}, nil, nil, errors.New("GetABI returned nil")
+	}
+
+	address, tx, contract, err := bind.DeployContract(auth, *parsed, common.FromHex(LotteryBin), backend)
+	if err != nil {
+		return common.Address{}, nil, nil, err
+	}
+	return address, tx, &Lottery{LotteryCaller: LotteryCaller{contract: contract}, LotteryTransactor: LotteryTransactor{contract: contract}, LotteryFilterer: LotteryFilterer{contract: contract}}, nil
+}
+
+// Lottery is an auto generated Go binding around an Ethereum contract.
+type Lottery struct {
+	LotteryCaller     // Read-only binding to the contract
+	LotteryTransactor // Write-only binding to the contract
+	LotteryFilterer   // Log filterer for contract events
+}
+
+// LotteryCaller is an auto generated read-only Go binding around an Ethereum contract.
+type LotteryCaller struct {
+	contract *bind.BoundContract // Generic contract wrapper for the low level calls
+}
+
+// LotteryTransactor is an auto generated write-only Go binding around an Ethereum contract.
+type LotteryTransactor struct {
+	contract *bind.BoundContract // Generic contract wrapper for the low level calls
+}
+
+// LotteryFilterer is an auto generated log filtering Go binding around an Ethereum contract events.
+type LotteryFilterer struct {
+	contract *bind.BoundContract // Generic contract wrapper for the low level calls
+}
+
+// LotterySession is an auto generated Go binding around an Ethereum contract,
+// with pre-set call and transact options.
+type LotterySession struct {
+	Contract     *Lottery          // Generic contract binding to set the session for
+	CallOpts     bind.CallOpts     // Call options to use throughout this session
+	TransactOpts bind.TransactOpts // Transaction auth options to use throughout this session
+}
+
+// LotteryCallerSession is an auto generated read-only Go binding around an Ethereum contract,
+// with pre-set call options.
+type LotteryCallerSession struct {
+	Contract *LotteryCaller // Generic contract caller binding to set the session for
+	CallOpts bind.CallOpts  // Call options to use throughout this session
+}
+
+// LotteryTransactorSession is an auto generated write-only Go binding around an Ethereum contract,
+// with pre-set transact options.
+type LotteryTransactorSession struct {
+	Contract     *LotteryTransactor // Generic contract transactor binding to set the session for
+	TransactOpts bind.TransactOpts  // Transaction auth options to use throughout this session
+}
+
+// LotteryRaw is an auto generated low-level Go binding around an Ethereum contract.
+type LotteryRaw struct {
+	Contract *Lottery // Generic contract binding to access the raw methods on
+}
+
+// LotteryCallerRaw is an auto generated low-level read-only Go binding around an Ethereum contract.
+type LotteryCallerRaw struct {
+	Contract *LotteryCaller // Generic read-only contract binding to access the raw methods on
+}
+
+// LotteryTransactorRaw is an auto generated low-level write-only Go binding around an Ethereum contract.
+type LotteryTransactorRaw struct {
+	Contract *LotteryTransactor // Generic write-only contract binding to access the raw methods on
+}
+
+// NewLottery creates a new instance of Lottery, bound to a specific deployed contract.
+func NewLottery(address common.Address, backend bind.ContractBackend) (*Lottery, error) {
+	contract, err := bindLottery(address, backend, backend, backend)
+	if err != nil {
+		return nil, err
+	}
+	return &Lottery{LotteryCaller: LotteryCaller{contract: contract}, LotteryTransactor: LotteryTransactor{contract: contract}, LotteryFilterer: LotteryFilterer{contract: contract}}, nil
+}
+
+// NewLotteryCaller creates a new read-only instance of Lottery, bound to a specific deployed contract.
+func NewLotteryCaller(address common.Address, caller bind.ContractCaller) (*LotteryCaller, error) {
+	contract, err := bindLottery(address, caller, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &LotteryCaller{contract: contract}, nil
+}
+
+// NewLotteryTransactor creates a new write-only instance of Lottery, bound to a specific deployed contract.
+func NewLotteryTransactor(address common.Address, transactor bind.ContractTransactor) (*LotteryTransactor, error) {
+	contract, err := bindLottery(address, nil, transactor, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &LotteryTransactor{contract: contract}, nil
+}
+
+// NewLotteryFilterer creates a new log filterer instance of Lottery, bound to a specific deployed contract.
+func NewLotteryFilterer(address common.Address, filterer bind.ContractFilterer) (*LotteryFilterer, error) {
+	contract, err := bindLottery(address, nil, nil, filterer)
+	if err != nil {
+		return nil, err
+	}
+	return &LotteryFilterer{contract: contract}, nil
+}
+
+// bindLottery binds a generic wrapper to an already deployed contract.
+func bindLottery(address common.Address, caller bind.ContractCaller, transactor bind.ContractTransactor, filterer bind.ContractFilterer) (*bind.BoundContract, error) {
+	parsed, err := LotteryMetaData.GetAbi()
+	if err != nil {
+		return nil, err
+	}
+	return bind.NewBoundContract(address, *parsed, caller, transactor, filterer), nil
+}
+
+// Call invokes the (constant) contract method with params as input values and
+// sets the output to result. The result type might be a single field for simple
+// returns, a slice of interfaces for anonymous returns and a struct for named
+// returns.
+func (_Lottery *LotteryRaw) Call(opts *bind.CallOpts, result *[]interface{}, method string, params ...interface{}) error {
+	return _Lottery.Contract.LotteryCaller.contract.Call(opts, result, method, params...)
+}
+
+// Transfer initiates a plain transaction to move funds to the contract, calling
+// its default method if one is available.
+func (_Lottery *LotteryRaw) Transfer(opts *bind.TransactOpts) (*types.Transaction, error) {
+	return _Lottery.Contract.LotteryTransactor.contract.Transfer(opts)
+}
+
+// Transact invokes the (paid) contract method with params as input values.
+func (_Lottery *LotteryRaw) Transact(opts *bind.TransactOpts, method string, params ...interface{}) (*types.Transaction, error) {
+	return _Lottery.Contract.LotteryTransactor.contract.Transact(opts, method, params...)
+}
+
+// Call invokes the (constant) contract method with params as input values and
+// sets the output to result. The result type might be a single field for simple
+// returns, a slice of interfaces for anonymous returns and a struct for named
+// returns.
+func (_Lottery *LotteryCallerRaw) Call(opts *bind.CallOpts, result *[]interface{}, method string, params ...interface{}) error {
+	return _Lottery.Contract.contract.Call(opts, result, method, params...)
+}
+
+// Transfer initiates a plain transaction to move funds to the contract, calling
+// its default method if one is available.
+func (_Lottery *LotteryTransactorRaw) Transfer(opts *bind.TransactOpts) (*types.Transaction, error) {
+	return _Lottery.Contract.contract.Transfer(opts)
+}
+
+// Transact invokes the (paid) contract method with params as input values.
+func (_Lottery *LotteryTransactorRaw) Transact(opts *bind.TransactOpts, method string, params ...interface{}) (*types.Transaction, error) {
+	return _Lottery.Contract.contract.Transact(opts, method, params...)
+}
+
+// UNLOCKDELAY is a free data retrieval call binding the contract method 0x93203e67.
+//
+// Solidity: function UNLOCK_DELAY() view returns(uint256)
+func (_Lottery *LotteryCaller) UNLOCKDELAY(opts *bind.CallOpts) (*big.Int, error) {
+	var out []interface{}
+	err := _Lottery.contract.Call(opts, &out, "UNLOCK_DELAY")
+
+	if err != nil {
+		return *new(*big.Int), err
+	}
+
+	out0 := *abi.ConvertType(out[0], new(*big.Int)).(**big.Int)
+
+	return out0, err
+
+}
+
+// UNLOCKDELAY is a free data retrieval call binding the contract method 0x93203e67.
+//
+// Solidity: function UNLOCK_DELAY() view returns(uint256)
+func (_Lottery *LotterySession) UNLOCKDELAY() (*big.Int, error) {
+	return _Lottery.Contract.UNLOCKDELAY(&_Lottery.CallOpts)
+}
+
+// UNLOCKDELAY is a free data retrieval call binding the contract method 0x93203e67.
+//
+// Solidity: function UNLOCK_DELAY() view returns(uint256)
+func (_Lottery *LotteryCallerSession) UNLOCKDELAY() (*big.Int, error) {
+	return _Lottery.Contract.UNLOCKDELAY(&_Lottery.CallOpts)
+}
+
+// Balances is a free data retrieval call binding the contract method 0x27e235e3.
+//
+// Solidity: function balances(address ) view returns(uint256)
+func (_Lottery *LotteryCaller) Balances(opts *bind.CallOpts, arg0 common.Address) (*big.Int, error) {
+	var out []interface{}
+	err := _Lottery.contract.Call(opts, &out, "balances", arg0)
+
+	if err != nil {
+		return *new(*big.Int), err
+	}
+
+	out0 := *abi.ConvertType(out[0], new(*big.Int)).(**big.Int)
+
+	return out0, err
+
+}
+
+// Balances is a free data retrieval call binding the contract method 0x27e235e3.
+//
+// Solidity: function balances(address ) view returns(uint256)
+func (_Lottery *LotterySession) Balances(arg0 common.Address) (*big.Int, error) {
+	return _Lottery.Contract.Balances(&_Lottery.CallOpts, arg0)
+}
+
+// Balances is a free data retrieval call binding the contract method 0x27e235e3.
+//
+// Solidity: function balances(address ) view returns(uint256)
+func (_Lottery *LotteryCallerSession) Balances(arg0 common.Address) (*big.Int, error) {
+	return _Lottery.Contract.Balances(&_Lottery.CallOpts, arg0)
+}
+
+// Spent is a free data retrieval call binding the contract method 0xae20bed3.
+//
+// Solidity: function spent(bytes32 ) view returns(bool)
+func (_Lottery *LotteryCaller) Spent(opts *bind.CallOpts, arg0 [32]byte) (bool, error) {
+	var out []interface{}
+	err := _Lottery.contract.Call(opts, &out, "spent", arg0)
+
+	if err != nil {
+		return *new(bool), err
+	}
+
+	out0 := *abi.ConvertType(out[0], new(bool)).(*bool)
+
+	return out0, err
+
+}
+
+// Spent is a free data retrieval call binding the contract method 0xae20bed3.
+//
+// Solidity: function spent(bytes32 ) view returns(bool)
+func (_Lottery *LotterySession) Spent(arg0 [32]byte) (bool, error) {
+	return _Lottery.Contract.Spent(&_Lottery.CallOpts, arg0)
+}
+
+// Spent is a free data retrieval call binding the contract method 0xae20bed3.
+//
+// Solidity: function spent(bytes32 ) view returns(bool)
+func (_Lottery *LotteryCallerSession) Spent(arg0 [32]byte) (bool, error) {
+	return _Lottery.Contract.Spent(&_Lottery.CallOpts, arg0)
+}
+
+// TicketHash is a free data retrieval call binding the contract method 0x76e95c33.
+//
+// Solidity: function ticketHash(bytes32 commit, address recipient, uint256 faceValue, uint64 winProb, bytes32 nonce, uint64 expiry) pure returns(bytes32)
+func (_Lottery *LotteryCaller) TicketHash(opts *bind.CallOpts, commit [32]byte, recipient common.Address, faceValue *big.Int, winProb uint64, nonce [32]byte, expiry uint64) ([32]byte, error) {
+	var out []interface{}
+	err := _Lottery.contract.Call(opts, &out, "ticketHash", commit, recipient, faceValue, winProb, nonce, expiry)
+
+	if err != nil {
+		return *new([32]byte), err
+	}
+
+	out0 := *abi.ConvertType(out[0], new([32]byte)).(*[32]byte)
+
+	return out0, err
+
+}
+
+// TicketHash is a free data retrieval call binding the contract method 0x76e95c33.
+//
+// Solidity: function ticketHash(bytes32 commit, address recipient, uint256 faceValue, uint64 winProb, bytes32 nonce, uint64 expiry) pure returns(bytes32)
+func (_Lottery *LotterySession) TicketHash(commit [32]byte, recipient common.Address, faceValue *big.Int, winProb uint64, nonce [32]byte, expiry uint64) ([32]byte, error) {
+	return _Lottery.Contract.TicketHash(&_Lottery.CallOpts, commit, recipient, faceValue, winProb, nonce, expiry)
+}
+
+// TicketHash is a free data retrieval call binding the contract method 0x76e95c33.
+//
+// Solidity: function ticketHash(bytes32 commit, address recipient, uint256 faceValue, uint64 winProb, bytes32 nonce, uint64 expiry) pure returns(bytes32)
+func (_Lottery *LotteryCallerSession) TicketHash(commit [32]byte, recipient common.Address, faceValue *big.Int, winProb uint64, nonce [32]byte, expiry uint64) ([32]byte, error) {
+	return _Lottery.Contract.TicketHash(&_Lottery.CallOpts, commit, recipient, faceValue, winProb, nonce, expiry)
+}
+
+// Unlocks is a free data retrieval call binding the contract method 0xeb8844f9.
+//
+// Solidity: function unlocks(address ) view returns(uint256)
+func (_Lottery *LotteryCaller) Unlocks(opts *bind.CallOpts, arg0 common.Address) (*big.Int, error) {
+	var out []interface{}
+	err := _Lottery.contract.Call(opts, &out, "unlocks", arg0)
+
+	if err != nil {
+		return *new(*big.Int), err
+	}
+
+	out0 := *abi.ConvertType(out[0], new(*big.Int)).(**big.Int)
+
+	return out0, err
+
+}
+
+// Unlocks is a free data retrieval call binding the contract method 0xeb8844f9.
+//
+// Solidity: function unlocks(address ) view returns(uint256)
+func (_Lottery *LotterySession) Unlocks(arg0 common.Address) (*big.Int, error) {
+	return _Lottery.Contract.Unlocks(&_Lottery.CallOpts, arg0)
+}
+
+// Unlocks is a free data retrieval call binding the contract method 0xeb8844f9.
+//
+// Solidity: function unlocks(address ) view returns(uint256)
+func (_Lottery *LotteryCallerSession) Unlocks(arg0 common.Address) (*big.Int, error) {
+	return _Lottery.Contract.Unlocks(&_Lottery.CallOpts, arg0)
+}
+
+// Deposit is a paid mutator transaction binding the contract method 0xd0e30db0.
+//
+// Solidity: function deposit() payable returns()
+func (_Lottery *LotteryTransactor) Deposit(opts *bind.TransactOpts) (*types.Transaction, error) {
+	return _Lottery.contract.Transact(opts, "deposit")
+}
+
+// Deposit is a paid mutator transaction binding the contract method 0xd0e30db0.
+//
+// Solidity: function deposit() payable returns()
+func (_Lottery *LotterySession) Deposit() (*types.Transaction, error) {
+	return _Lottery.Contract.Deposit(&_Lottery.TransactOpts)
+}
+
+// Deposit is a paid mutator transaction binding the contract method 0xd0e30db0.
+//
+// Solidity: function deposit() payable returns()
+func (_Lottery *LotteryTransactorSession) Deposit() (*types.Transaction, error) {
+	return _Lottery.Contract.Deposit(&_Lottery.TransactOpts)
+}
+
+// Redeem is a paid mutator transaction binding the contract method 0x13d2e2f6.
+//
+// Solidity: function redeem(bytes32 secret, address recipient, uint256 faceValue, uint64 winProb, bytes32 nonce, uint64 expiry, uint8 v, bytes32 r, bytes32 s) returns()
+func (_Lottery *LotteryTransactor) Redeem(opts *bind.TransactOpts, secret [32]byte, recipient common.Address, faceValue *big.Int, winProb uint64, nonce [32]byte, expiry uint64, v uint8, r [32]byte, s [32]byte) (*types.Transaction, error) {
+	return _Lottery.contract.Transact(opts, "redeem", secret, recipient, faceValue, winProb, nonce, expiry, v, r, s)
+}
+
+// Redeem is a paid mutator transaction binding the contract method 0x13d2e2f6.
+//
+// Solidity: function redeem(bytes32 secret, address recipient, uint256 faceValue, uint64 winProb, bytes32 nonce, uint64 expiry, uint8 v, bytes32 r, bytes32 s) returns()
+func (_Lottery *LotterySession) Redeem(secret [32]byte, recipient common.Address, faceValue *big.Int, winProb uint64, nonce [32]byte, expiry uint64, v uint8, r [32]byte, s [32]byte) (*types.Transaction, error) {
+	return _Lottery.Contract.Redeem(&_Lottery.TransactOpts, secret, recipient, faceValue, winProb, nonce, expiry, v, r, s)
+}
+
+// Redeem is a paid mutator transaction binding the contract method 0x13d2e2f6.
+//
+// Solidity: function redeem(bytes32 secret, address recipient, uint256 faceValue, uint64 winProb, bytes32 nonce, uint64 expiry, uint8 v, bytes32 r, bytes32 s) returns()
+func (_Lottery *LotteryTransactorSession) Redeem(secret [32]byte, recipient common.Address, faceValue *big.Int, winProb uint64, nonce [32]byte, expiry uint64, v uint8, r [32]byte, s [32]byte) (*types.Transaction, error) {
+	return _Lottery.Contract.Redeem(&_Lottery.TransactOpts, secret, recipient, faceValue, winProb, nonce, expiry, v, r, s)
+}
+
+// Unlock is a paid mutator transaction binding the contract method 0xa69df4b5.
+//
+// Solidity: function unlock() returns()
+func (_Lottery *LotteryTransactor) Unlock(opts *bind.TransactOpts) (*types.Transaction, error) {
+	return _Lottery.contract.Transact(opts, "unlock")
+}
+
+// Unlock is a paid mutator transaction binding the contract method 0xa69df4b5.
+//
+// Solidity: function unlock() returns()
+func (_Lottery *LotterySession) Unlock() (*types.Transaction, error) {
+	return _Lottery.Contract.Unlock(&_Lottery.TransactOpts)
+}
+
+// Unlock is a paid mutator transaction binding the contract method 0xa69df4b5.
+//
+// Solidity: function unlock() returns()
+func (_Lottery *LotteryTransactorSession) Unlock() (*types.Transaction, error) {
+	return _Lottery.Contract.Unlock(&_Lottery.TransactOpts)
+}
+
+// Withdraw is a paid mutator transaction binding the contract method 0x3ccfd60b.
+//
+// Solidity: function withdraw() returns()
+func (_Lottery *LotteryTransactor) Withdraw(opts *bind.TransactOpts) (*types.Transaction, error) {
+	return _Lottery.contract.Transact(opts, "withdraw")
+}
+
+// Withdraw is a paid mutator transaction binding the contract method 0x3ccfd60b.
+//
+// Solidity: function withdraw() returns()
+func (_Lottery *LotterySession) Withdraw() (*types.Transaction, error) {
+	return _Lottery.Contract.Withdraw(&_Lottery.TransactOpts)
+}
+
+// Withdraw is a paid mutator transaction binding the contract method 0x3ccfd60b.
+//
+// Solidity: function withdraw() returns()
+func (_Lottery *LotteryTransactorSession) Withdraw() (*types.Transaction, error) {
+	return _Lottery.Contract.Withdraw(&_Lottery.TransactOpts)
+}
+
+// LotteryDepositedIterator is returned from FilterDeposited and is used to iterate over the raw logs and unpacked data for Deposited events raised by the Lottery contract.
+type LotteryDepositedIterator struct {
+	Event *LotteryDeposited // Event containing the contract specifics and raw log
+
+	contract *bind.BoundContract // Generic contract to use for unpacking event data
+	event    string              // Event name to use for unpacking event data
+
+	logs chan types.Log        // Log channel receiving the found contract events
+	sub  ethereum.Subscription // Subscription for errors, completion and termination
+	done bool                  // Whether the subscription completed delivering logs
+	fail error                 // Occurred error to stop iteration
+}
+
+// Next advances the iterator to the subsequent event, returning whether there
+// are any more events found. In case of a retrieval or parsing error, false is
+// returned and Error() can be queried for the exact failure.
+func (it *LotteryDepositedIterator) Next() bool {
+	// If the iterator failed, stop iterating
+	if it.fail != nil {
+		return false
+	}
+	// If the iterator completed, deliver directly whatever's available
+	if it.done {
+		select {
+		case log := <-it.logs:
+			it.Event = new(LotteryDeposited)
+			if err := it.contract.UnpackLog(it.Event, it.event, log); err != nil {
+				it.fail = err
+				return false
+			}
+			it.Event.Raw = log
+			return true
+
+		default:
+			return false
+		}
+	}
+	// Iterator still in progress, wait for either a data or an error event
+	select {
+	case log := <-it.logs:
+		it.Event = new(LotteryDeposited)
+		if err := it.contract.UnpackLog(it.Event, it.event, log); err != nil {
+			it.fail = err
+			return false
+		}
+		it.Event.Raw = log
+		return true
+
+	case err := <-it.sub.Err():
+		it.done = true
+		it.fail = err
+		return it.Next()
+	}
+}
+
+// Error returns any retrieval or parsing error occurred during filtering.
+func (it *LotteryDepositedIterator) Error() error {
+	return it.fail
+}
+
+// Close terminates the iteration process, releasing any pending underlying
+// resources.
+func (it *LotteryDepositedIterator) Close() error {
+	it.sub.Unsubscribe()
+	return nil
+}
+
+// LotteryDeposited represents a Deposited event raised by the Lottery contract.
+type LotteryDeposited struct {
+	Source common.Address
+	Amount *big.Int
+	Raw    types.Log // Blockchain specific contextual infos
+}
+
+// FilterDeposited is a free log retrieval operation binding the contract event 0x2da466a7b24304f47e87fa2e1e5a81b9831ce54fec19055ce277ca2f39ba42c4.
+//
+// Solidity: event Deposited(address indexed source, uint256 amount)
+func (_Lottery *LotteryFilterer) FilterDeposited(opts *bind.FilterOpts, source []common.Address) (*LotteryDepositedIterator, error) {
+
+	var sourceRule []interface{}
+	for _, sourceItem := range source {
+		sourceRule = append(sourceRule, sourceItem)
+	}
+
+	logs, sub, err := _Lottery.contract.FilterLogs(opts, "Deposited", sourceRule)
+	if err != nil {
+		return nil, err
+	}
+	return &LotteryDepositedIterator{contract: _Lottery.contract, event: "Deposited", logs: logs, sub: sub}, nil
+}
+
+// WatchDeposited is a free log subscription operation binding the contract event 0x2da466a7b24304f47e87fa2e1e5a81b9831ce54fec19055ce277ca2f39ba42c4.
+//
+// Solidity: event Deposited(address indexed source, uint256 amount)
+func (_Lottery *LotteryFilterer) WatchDeposited(opts *bind.WatchOpts, sink chan<- *LotteryDeposited, source []common.Address) (event.Subscription, error) {
+
+	var sourceRule []interface{}
+	for _, sourceItem := range source {
+		sourceRule = append(sourceRule, sourceItem)
+	}
+
+	logs, sub, err := _Lottery.contract.WatchLogs(opts, "Deposited", sourceRule)
+	if err != nil {
+		return nil, err
+	}
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		defer sub.Unsubscribe()
+		for {
+			select {
+			case log := <-logs:
+				// New log arrived, parse the event and forward to the user
+				event := new(LotteryDeposited)
+				if err := _Lottery.contract.UnpackLog(event, "Deposited", log); err != nil {
+					// If the signature doesn't match, skip this log.
+					if errors.Is(err, bind.ErrEventSignatureMismatch) {
+						continue
+					}
+					return err
+				}
+				event.Raw = log
+
+				select {
+				case sink <- event:
+				case err := <-sub.Err():
+					return err
+				case <-quit:
+					return nil
+				}
+			case err := <-sub.Err():
+				return err
+			case <-quit:
+				return nil
+			}
+		}
+	}), nil
+}
+
+// ParseDeposited is a log parse operation binding the contract event 0x2da466a7b24304f47e87fa2e1e5a81b9831ce54fec19055ce277ca2f39ba42c4.
+//
+// Solidity: event Deposited(address indexed source, uint256 amount)
+func (_Lottery *LotteryFilterer) ParseDeposited(log types.Log) (*LotteryDeposited, error) {
+	event := new(LotteryDeposited)
+	if err := _Lottery.contract.UnpackLog(event, "Deposited", log); err != nil {
+		return nil, err
+	}
+	event.Raw = log
+	return event, nil
+}
+
+// LotteryRedeemedIterator is returned from FilterRedeemed and is used to iterate over the raw logs and unpacked data for Redeemed events raised by the Lottery contract.
+type LotteryRedeemedIterator struct {
+	Event *LotteryRedeemed // Event containing the contract specifics and raw log
+
+	contract *bind.BoundContract // Generic contract to use for unpacking event data
+	event    string              // Event name to use for unpacking event data
+
+	logs chan types.Log        // Log channel receiving the found contract events
+	sub  ethereum.Subscription // Subscription for errors, completion and termination
+	done bool                  // Whether the subscription completed delivering logs
+	fail error                 // Occurred error to stop iteration
+}
+
+// Next advances the iterator to the subsequent event, returning whether there
+// are any more events found. In case of a retrieval or parsing error, false is
+// returned and Error() can be queried for the exact failure.
+func (it *LotteryRedeemedIterator) Next() bool {
+	// If the iterator failed, stop iterating
+	if it.fail != nil {
+		return false
+	}
+	// If the iterator completed, deliver directly whatever's available
+	if it.done {
+		select {
+		case log := <-it.logs:
+			it.Event = new(LotteryRedeemed)
+			if err := it.contract.UnpackLog(it.Event, it.event, log); err != nil {
+				it.fail = err
+				return false
+			}
+			it.Event.Raw = log
+			return true
+
+		default:
+			return false
+		}
+	}
+	// Iterator still in progress, wait for either a data or an error event
+	select {
+	case log := <-it.logs:
+		it.Event = new(LotteryRedeemed)
+		if err := it.contract.UnpackLog(it.Event, it.event, log); err != nil {
+			it.fail = err
+			return false
+		}
+		it.Event.Raw = log
+		return true
+
+	case err := <-it.sub.Err():
+		it.done = true
+		it.fail = err
+		return it.Next()
+	}
+}
+
+// Error returns any retrieval or parsing error occurred during filtering.
+func (it *LotteryRedeemedIterator) Error() error {
+	return it.fail
+}
+
+// Close terminates the iteration process, releasing any pending underlying
+// resources.
+func (it *LotteryRedeemedIterator) Close() error {
+	it.sub.Unsubscribe()
+	return nil
+}
+
+// LotteryRedeemed represents a Redeemed event raised by the Lottery contract.
+type LotteryRedeemed struct {
+	Ticket    [32]byte
+	Source    common.Address
+	Recipient common.Address
+	Amount    *big.Int
+	Raw       types.Log // Blockchain specific contextual infos
+}
+
+// FilterRedeemed is a free log retrieval operation binding the contract event 0xbdbaf70d5ad57b002382ab2439f43339eb5034dcb891ec13621a3009033f3e61.
+//
+// Solidity: event Redeemed(bytes32 indexed ticket, address indexed source, address indexed recipient, uint256 amount)
+func (_Lottery *LotteryFilterer) FilterRedeemed(opts *bind.FilterOpts, ticket [][32]byte, source []common.Address, recipient []common.Address) (*LotteryRedeemedIterator, error) {
+
+	var ticketRule []interface{}
+	for _, ticketItem := range ticket {
+		ticketRule = append(ticketRule, ticketItem)
+	}
+	var sourceRule []interface{}
+	for _, sourceItem := range source {
+		sourceRule = append(sourceRule, sourceItem)
+	}
+	var recipientRule []interface{}
+	for _, recipientItem := range recipient {
+		recipientRule = append(recipientRule, recipientItem)
+	}
+
+	logs, sub, err := _Lottery.contract.FilterLogs(opts, "Redeemed", ticketRule, sourceRule, recipientRule)
+	if err != nil {
+		return nil, err
+	}
+	return &LotteryRedeemedIterator{contract: _Lottery.contract, event: "Redeemed", logs: logs, sub: sub}, nil
+}
+
+// WatchRedeemed is a free log subscription operation binding the contract event 0xbdbaf70d5ad57b002382ab2439f43339eb5034dcb891ec13621a3009033f3e61.
+//
+// Solidity: event Redeemed(bytes32 indexed ticket, address indexed source, address indexed recipient, uint256 amount)
+func (_Lottery *LotteryFilterer) WatchRedeemed(opts *bind.WatchOpts, sink chan<- *LotteryRedeemed, ticket [][32]byte, source []common.Address, recipient []common.Address) (event.Subscription, error) {
+
+	var ticketRule []interface{}
+	for _, ticketItem := range ticket {
+		ticketRule = append(ticketRule, ticketItem)
+	}
+	var sourceRule []interface{}
+	for _, sourceItem := range source {
+		sourceRule = append(sourceRule, sourceItem)
+	}
+	var recipientRule []interface{}
+	for _, recipientItem := range recipient {
+		recipientRule = append(recipientRule, recipientItem)
+	}
+
+	logs, sub, err := _Lottery.contract.WatchLogs(opts, "Redeemed", ticketRule, sourceRule, recipientRule)
+	if err != nil {
+		return nil, err
+	}
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		defer sub.Unsubscribe()
+		for {
+			select {
+			case log := <-logs:
+				// New log arrived, parse the event and forward to the user
+				event := new(LotteryRedeemed)
+				if err := _Lottery.contract.UnpackLog(event, "Redeemed", log); err != nil {
+					// If the signature doesn't match, skip this log.
+					if errors.Is(err, bind.ErrEventSignatureMismatch) {
+						continue
+					}
+					return err
+				}
+				event.Raw = log
+
+				select {
+				case sink <- event:
+				case err := <-sub.Err():
+					return err
+				case <-quit:
+					return nil
+				}
+			case err := <-sub.Err():
+				return err
+			case <-quit:
+				return nil
+			}
+		}
+	}), nil
+}
+
+// ParseRedeemed is a log parse operation binding the contract event 0xbdbaf70d5ad57b002382ab2439f43339eb5034dcb891ec13621a3009033f3e61.
+//
+// Solidity: event Redeemed(bytes32 indexed ticket, address indexed source, address indexed recipient, uint256 amount)
+func (_Lottery *LotteryFilterer) ParseRedeemed(log types.Log) (*LotteryRedeemed, error) {
+	event := new(LotteryRedeemed)
+	if err := _Lottery.contract.UnpackLog(event, "Redeemed", log); err != nil {
+		return nil, err
+	}
+	event.Raw = log
+	return event, nil
+}
+
+// LotteryUnlockedIterator is returned from FilterUnlocked and is used to iterate over the raw logs and unpacked data for Unlocked events raised by the Lottery contract.
+type LotteryUnlockedIterator struct {
+	Event *LotteryUnlocked // Event containing the contract specifics and raw log
+
+	contract *bind.BoundContract // Generic contract to use for unpacking event data
+	event    string              // Event name to use for unpacking event data
+
+	logs chan types.Log        // Log channel receiving the found contract events
+	sub  ethereum.Subscription // Subscription for errors, completion and termination
+	done bool                  // Whether the subscription completed delivering logs
+	fail error                 // Occurred error to stop iteration
+}
+
+// Next advances the iterator to the subsequent event, returning whether there
+// are any more events found. In case of a retrieval or parsing error, false is
+// returned and Error() can be queried for the exact failure.
+func (it *LotteryUnlockedIterator) Next() bool {
+	// If the iterator failed, stop iterating
+	if it.fail != nil {
+		return false
+	}
+	// If the iterator completed, deliver directly whatever's available
+	if it.done {
+		select {
+		case log := <-it.logs:
+			it.Event = new(LotteryUnlocked)
+			if err := it.contract.UnpackLog(it.Event, it.event, log); err != nil {
+				it.fail = err
+				return false
+			}
+			it.Event.Raw = log
+			return true
+
+		default:
+			return false
+		}
+	}
+	// Iterator still in progress, wait for either a data or an error event
+	select {
+	case log := <-it.logs:
+		it.Event = new(LotteryUnlocked)
+		if err := it.contract.UnpackLog(it.Event, it.event, log); err != nil {
+			it.fail = err
+			return false
+		}
+		it.Event.Raw = log
+		return true
+
+	case err := <-it.sub.Err():
+		it.done = true
+		it.fail = err
+		return it.Next()
+	}
+}
+
+// Error returns any retrieval or parsing error occurred during filtering.
+func (it *LotteryUnlockedIterator) Error() error {
+	return it.fail
+}
+
+// Close terminates the iteration process, releasing any pending underlying
+// resources.
+func (it *LotteryUnlockedIterator) Close() error {
+	it.sub.Unsubscribe()
+	return nil
+}
+
+// LotteryUnlocked represents a Unlocked event raised by the Lottery contract.
+type LotteryUnlocked struct {
+	Source common.Address
+	At     *big.Int
+	Raw    types.Log // Blockchain specific contextual infos
+}
+
+// FilterUnlocked is a free log retrieval operation binding the contract event 0x0f0bc5b519ddefdd8e5f9e6423433aa2b869738de2ae34d58ebc796fc749fa0d.
+//
+// Solidity: event Unlocked(address indexed source, uint256 at)
+func (_Lottery *LotteryFilterer) FilterUnlocked(opts *bind.FilterOpts, source []common.Address) (*LotteryUnlockedIterator, error) {
+
+	var sourceRule []interface{}
+	for _, sourceItem := range source {
+		sourceRule = append(sourceRule, sourceItem)
+	}
+
+	logs, sub, err := _Lottery.contract.FilterLogs(opts, "Unlocked", sourceRule)
+	if err != nil {
+		return nil, err
+	}
+	return &LotteryUnlockedIterator{contract: _Lottery.contract, event: "Unlocked", logs: logs, sub: sub}, nil
+}
+
+// WatchUnlocked is a free log subscription operation binding the contract event 0x0f0bc5b519ddefdd8e5f9e6423433aa2b869738de2ae34d58ebc796fc749fa0d.
+//
+// Solidity: event Unlocked(address indexed source, uint256 at)
+func (_Lottery *LotteryFilterer) WatchUnlocked(opts *bind.WatchOpts, sink chan<- *LotteryUnlocked, source []common.Address) (event.Subscription, error) {
+
+	var sourceRule []interface{}
+	for _, sourceItem := range source {
+		sourceRule = append(sourceRule, sourceItem)
+	}
+
+	logs, sub, err := _Lottery.contract.WatchLogs(opts, "Unlocked", sourceRule)
+	if err != nil {
+		return nil, err
+	}
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		defer sub.Unsubscribe()
+		for {
+			select {
+			case log := <-logs:
+				// New log arrived, parse the event and forward to the user
+				event := new(LotteryUnlocked)
+				if err := _Lottery.contract.UnpackLog(event, "Unlocked", log); err != nil {
+					// If the signature doesn't match, skip this log.
+					if errors.Is(err, bind.ErrEventSignatureMismatch) {
+						continue
+					}
+					return err
+				}
+				event.Raw = log
+
+				select {
+				case sink <- event:
+				case err := <-sub.Err():
+					return err
+				case <-quit:
+					return nil
+				}
+			case err := <-sub.Err():
+				return err
+			case <-quit:
+				return nil
+			}
+		}
+	}), nil
+}
+
+// ParseUnlocked is a log parse operation binding the contract event 0x0f0bc5b519ddefdd8e5f9e6423433aa2b869738de2ae34d58ebc796fc749fa0d.
+//
+// Solidity: event Unlocked(address indexed source, uint256 at)
+func (_Lottery *LotteryFilterer) ParseUnlocked(log types.Log) (*LotteryUnlocked, error) {
+	event := new(LotteryUnlocked)
+	if err := _Lottery.contract.UnpackLog(event, "Unlocked", log); err != nil {
+		return nil, err
+	}
+	event.Raw = log
+	return event, nil
+}
+
+// LotteryWithdrawnIterator is returned from FilterWithdrawn and is used to iterate over the raw logs and unpacked data for Withdrawn events raised by the Lottery contract.
+type LotteryWithdrawnIterator struct {
+	Event *LotteryWithdrawn // Event containing the contract specifics and raw log
+
+	contract *bind.BoundContract // Generic contract to use for unpacking event data
+	event    string              // Event name to use for unpacking event data
+
+	logs chan types.Log        // Log channel receiving the found contract events
+	sub  ethereum.Subscription // Subscription for errors, completion and termination
+	done bool                  // Whether the subscription completed delivering logs
+	fail error                 // Occurred error to stop iteration
+}
+
+// Next advances the iterator to the subsequent event, returning whether there
+// are any more events found. In case of a retrieval or parsing error, false is
+// returned and Error() can be queried for the exact failure.
+func (it *LotteryWithdrawnIterator) Next() bool {
+	// If the iterator failed, stop iterating
+	if it.fail != nil {
+		return false
+	}
+	// If the iterator completed, deliver directly whatever's available
+	if it.done {
+		select {
+		case log := <-it.logs:
+			it.Event = new(LotteryWithdrawn)
+			if err := it.contract.UnpackLog(it.Event, it.event, log); err != nil {
+				it.fail = err
+				return false
+			}
+			it.Event.Raw = log
+			return true
+
+		default:
+			return false
+		}
+	}
+	// Iterator still in progress, wait for either a data or an error event
+	select {
+	case log := <-it.logs:
+		it.Event = new(LotteryWithdrawn)
+		if err := it.contract.UnpackLog(it.Event, it.event, log); err != nil {
+			it.fail = err
+			return false
+		}
+		it.Event.Raw = log
+		return true
+
+	case err := <-it.sub.Err():
+		it.done = true
+		it.fail = err
+		return it.Next()
+	}
+}
+
+// Error returns any retrieval or parsing error occurred during filtering.
+func (it *LotteryWithdrawnIterator) Error() error {
+	return it.fail
+}
+
+// Close terminates the iteration process, releasing any pending underlying
+// resources.
+func (it *LotteryWithdrawnIterator) Close() error {
+	it.sub.Unsubscribe()
+	return nil
+}
+
+// LotteryWithdrawn represents a Withdrawn event raised by the Lottery contract.
+type LotteryWithdrawn struct {
+	Source common.Address
+	Amount *big.Int
+	Raw    types.Log // Blockchain specific contextual infos
+}
+
+// FilterWithdrawn is a free log retrieval operation binding the contract event 0x7084f5476618d8e60b11ef0d7d3f06914655adb8793e28ff7f018d4c76d505d5.
+//
+// Solidity: event Withdrawn(address indexed source, uint256 amount)
+func (_Lottery *LotteryFilterer) FilterWithdrawn(opts *bind.FilterOpts, source []common.Address) (*LotteryWithdrawnIterator, error) {
+
+	var sourceRule []interface{}
+	for _, sourceItem := range source {
+		sourceRule = append(sourceRule, sourceItem)
+	}
+
+	logs, sub, err := _Lottery.contract.FilterLogs(opts, "Withdrawn", sourceRule)
+	if err != nil {
+		return nil, err
+	}
+	return &LotteryWithdrawnIterator{contract: _Lottery.contract, event: "Withdrawn", logs: logs, sub: sub}, nil
+}
+
+// WatchWithdrawn is a free log subscription operation binding the contract event 0x7084f5476618d8e60b11ef0d7d3f06914655adb8793e28ff7f018d4c76d505d5.
+//
+// Solidity: event Withdrawn(address indexed source, uint256 amount)
+func (_Lottery *LotteryFilterer) WatchWithdrawn(opts *bind.WatchOpts, sink chan<- *LotteryWithdrawn, source []common.Address) (event.Subscription, error) {
+
+	var sourceRule []interface{}
+	for _, sourceItem := range source {
+		sourceRule = append(sourceRule, sourceItem)
+	}
+
+	logs, sub, err := _Lottery.contract.WatchLogs(opts, "Withdrawn", sourceRule)
+	if err != nil {
+		return nil, err
+	}
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		defer sub.Unsubscribe()
+		for {
+			select {
+			case log := <-logs:
+				// New log arrived, parse the event and forward to the user
+				event := new(LotteryWithdrawn)
+				if err := _Lottery.contract.UnpackLog(event, "Withdrawn", log); err != nil {
+					// If the signature doesn't match, skip this log.
+					if errors.Is(err, bind.ErrEventSignatureMismatch) {
+						continue
+					}
+					return err
+				}
+				event.Raw = log
+
+				select {
+				case sink <- event:
+				case err := <-sub.Err():
+					return err
+				case <-quit:
+					return nil
+				}
+			case err := <-sub.Err():
+				return err
+			case <-quit:
+				return nil
+			}
+		}
+	}), nil
+}
+
+// ParseWithdrawn is a log parse operation binding the contract event 0x7084f5476618d8e60b11ef0d7d3f06914655adb8793e28ff7f018d4c76d505d5.
+//
+// Solidity: event Withdrawn(address indexed source, uint256 amount)
+func (_Lottery *LotteryFilterer) ParseWithdrawn(log types.Log) (*LotteryWithdrawn, error) {
+	event := new(LotteryWithdrawn)
+	if err := _Lottery.contract.UnpackLog(event, "Withdrawn", log); err != nil {
+		return nil, err
+	}
+	event.Raw = log
+	return event, nil
+}
@@ -0,0 +1,340 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package payment
+
+import (
+	"errors"
+	"io"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/* Bandwidth metering
+
+   An exit meters the bytes it forwards for each source peer with a Meter
+   and is paid for them with tickets, exchanged in-band over the control
+   channel of the peer (see node/control.go):
+
+   1. The first Budget bytes are forwarded on credit.
+   2. Once half of the bytes paid so far are used, the meter asks for the
+      next payment with a Request: the terms of a ticket for the current
+      commit of the exit.
+   3. The source answers with a ticket for the request (see Payer). Each
+      valid ticket, from a source with a deposit to pay it (see Deposits),
+      pays for Budget more bytes.
+   4. While the peer has used all bytes paid, its streams are throttled:
+      reads and writes block until the next ticket arrives.
+   5. If no ticket arrives within Timeout of a request, or a ticket does
+      not verify, the meter is closed and the exit disconnects the peer.
+
+   When a ticket wins, the meter keeps it with the secret needed to
+   redeem it and commits to a new secret. The meter is gone once its peer
+   disconnects, so exits save wins to a WinQueue.
+*/
+
+const (
+	DefaultBudget         = 4 << 20 // bytes
+	DefaultTimeout        = 30 * time.Second
+	DefaultTicketLifetime = 2 * time.Hour
+	// well below the UNLOCK_DELAY of the Lottery, see Deposits
+	MaxTicketLifetime = 6 * time.Hour
+)
+
+var (
+	ErrPaymentTimeout = errors.New("payment timeout")
+	ErrNoRequest      = errors.New("ticket without payment request")
+	ErrTicketTerms    = errors.New("ticket does not match payment request")
+	ErrTicketReplay   = errors.New("ticket replayed")
+	ErrMeterClosed    = errors.New("meter closed")
+	ErrTerms          = errors.New("invalid payment terms")
+)
+
+// Terms are the payment terms of an exit
+type Terms struct {
+	Recipient      common.Address
+	FaceValue      *big.Int
+	WinProb        uint64
+	Budget         uint64 // bytes paid by each ticket
+	Timeout        time.Duration
+	TicketLifetime time.Duration
+	Deposits       *Deposits // optional, checks the deposits of sources
+}
+
+// NewTerms returns terms with the default budget, timeout and lifetime
+func NewTerms(recipient common.Address, faceValue *big.Int, winProb uint64) *Terms {
+	return &Terms{
+		recipient,
+		faceValue,
+		winProb,
+		DefaultBudget,
+		DefaultTimeout,
+		DefaultTicketLifetime,
+		nil,
+	}
+}
+
+// Request asks a source for a ticket with the given fields,
+// paying for Budget bytes
+type Request struct {
+	Commit    common.Hash    `json:"commit"`
+	Recipient common.Address `json:"recipient"`
+	FaceValue *big.Int       `json:"faceValue"`
+	WinProb   uint64         `json:"winProb"`
+	Expiry    uint64         `json:"expiry"`
+	Budget    uint64         `json:"budget"`
+}
+
+// matches checks that t has the fields requested by r
+func (r *Request) matches(t *Ticket) bool {
+	return t.Commit == r.Commit &&
+		t.Recipient == r.Recipient &&
+		t.FaceValue != nil && t.FaceValue.Cmp(r.FaceValue) == 0 &&
+		t.WinProb == r.WinProb &&
+		t.Expiry == r.Expiry
+}
+
+// Win is a winning ticket with the secret to redeem it
+type Win struct {
+	Ticket *Ticket `json:"ticket"`
+	Secret Secret  `json:"secret"`
+}
+
+type Meter struct {
+	terms *Terms
+
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	secret  Secret
+	nonces  map[common.Hash]struct{} // of tickets paid with secret
+	used    uint64
+	paid    uint64
+	pending *Request
+	wins    []Win
+	err     error
+
+	requests chan *Request
+	done     chan struct{}
+}
+
+func NewMeter(terms *Terms) (*Meter, error) {
+	if terms.Budget == 0 || !validFaceValue(terms.FaceValue) || terms.TicketLifetime > MaxTicketLifetime {
+		return nil, ErrTerms
+	}
+	secret, err := NewSecret()
+	if err != nil {
+		return nil, err
+	}
+	m := &Meter{
+		terms:    terms,
+		secret:   secret,
+		nonces:   make(map[common.Hash]struct{}),
+		paid:     terms.Budget,
+		requests: make(chan *Request, 1),
+		done:     make(chan struct{}),
+	}
+	m.cond = sync.NewCond(&m.mutex)
+	return m, nil
+}
+
+// Requests delivers the payment requests to send to the peer
+func (m *Meter) Requests() <-chan *Request {
+	return m.requests
+}
+
+// Done is closed when the meter is closed, see Err
+func (m *Meter) Done() <-chan struct{} {
+	return m.done
+}
+
+// Err returns why the meter was closed
+func (m *Meter) Err() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.err
+}
+
+func (m *Meter) Close() error {
+	m.close(ErrMeterClosed)
+	return nil
+}
+
+func (m *Meter) close(err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.err != nil {
+		return
+	}
+	m.err = err
+	close(m.done)
+	m.cond.Broadcast()
+}
+
+// Used returns the bytes used and paid for
+func (m *Meter) Used() (used, paid uint64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.used, m.paid
+}
+
+// Wins returns the winning tickets paid so far
+func (m *Meter) Wins() []Win {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]Win{}, m.wins...)
+}
+
+// wait blocks while the peer has used all bytes paid
+func (m *Meter) wait() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for m.err == nil && m.used >= m.paid {
+		m.cond.Wait()
+	}
+	return m.err
+}
+
+// add counts n bytes used and requests the next payment
+// once half of the bytes paid are used
+func (m *Meter) add(n int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.used += uint64(n)
+	if m.pending != nil || m.err != nil || m.used < m.paid-m.terms.Budget/2 {
+		return
+	}
+	m.pending = &Request{
+		m.secret.Commit(),
+		m.terms.Recipient,
+		m.terms.FaceValue,
+		m.terms.WinProb,
+		uint64(time.Now().Add(m.terms.TicketLifetime).Unix()),
+		m.terms.Budget,
+	}
+	// at most one request is pending, so this never blocks
+	m.requests <- m.pending
+
+	pending := m.pending
+	time.AfterFunc(m.terms.Timeout, func() {
+		m.mutex.Lock()
+		timedOut := m.pending == pending
+		m.mutex.Unlock()
+		if timedOut {
+			m.close(ErrPaymentTimeout)
+		}
+	})
+}
+
+// Pay pays the pending request with t and returns whether t wins.
+// The meter is closed if t does not verify.
+func (m *Meter) Pay(t *Ticket, now time.Time) (bool, error) {
+	var win bool
+	err := m.verify(t, now)
+	if err == nil {
+		win, err = m.pay(t)
+	}
+	if err != nil {
+		m.close(err)
+	}
+	return win, err
+}
+
+// verify checks the signature of t and, with Deposits, the deposit of
+// its signer, which may call the Lottery and so runs without the mutex
+func (m *Meter) verify(t *Ticket, now time.Time) error {
+	signer, err := t.Verify(m.terms.Recipient, now)
+	if err != nil || m.terms.Deposits == nil {
+		return err
+	}
+	return m.terms.Deposits.Check(signer, t.FaceValue, now)
+}
+
+func (m *Meter) pay(t *Ticket) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.err != nil {
+		return false, m.err
+	}
+	if m.pending == nil {
+		return false, ErrNoRequest
+	}
+	if !m.pending.matches(t) {
+		return false, ErrTicketTerms
+	}
+	if _, ok := m.nonces[t.Nonce]; ok {
+		return false, ErrTicketReplay
+	}
+	win, err := t.Wins(m.secret)
+	if err != nil {
+		return false, err
+	}
+
+	m.nonces[t.Nonce] = struct{}{}
+	m.paid += m.terms.Budget
+	m.pending = nil
+	m.cond.Broadcast()
+
+	if win {
+		m.wins = append(m.wins, Win{t, m.secret})
+		secret, err := NewSecret()
+		if err != nil {
+			return true, err
+		}
+		m.secret = secret
+		m.nonces = make(map[common.Hash]struct{})
+	}
+	return win, nil
+}
+
+// Conn meters the bytes read from and written to rwc
+func (m *Meter) Conn(rwc io.ReadWriteCloser) io.ReadWriteCloser {
+	return &meteredConn{rwc, m}
+}
+
+type meteredConn struct {
+	rwc   io.ReadWriteCloser
+	meter *Meter
+}
+
+func (c *meteredConn) Read(p []byte) (int, error) {
+	err := c.meter.wait()
+	if err != nil {
+		return 0, err
+	}
+	n, err := c.rwc.Read(p)
+	c.meter.add(n)
+	return n, err
+}
+
+func (c *meteredConn) Write(p []byte) (int, error) {
+	err := c.meter.wait()
+	if err != nil {
+		return 0, err
+	}
+	n, err := c.rwc.Write(p)
+	c.meter.add(n)
+	return n, err
+}
+
+func (c *meteredConn) Close() error {
+	return c.rwc.Close()
+}
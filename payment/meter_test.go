@@ -0,0 +1,192 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package payment
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+type nopConn struct {
+	bytes.Buffer
+}
+
+func (c *nopConn) Close() error { return nil }
+
+func testTerms() *Terms {
+	t := NewTerms(common.Address{2}, big.NewInt(1e12), WinProbability(0.5))
+	t.Budget = 100
+	return t
+}
+
+func TestMeter(t *testing.T) {
+	source := testAccount(t, "0101010101010101010101010101010101010101010101010101010101010101")
+	payer := NewPayer(source, big.NewInt(1e18), big.NewInt(1e12))
+	m, err := NewMeter(testTerms())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := m.Conn(&nopConn{})
+
+	// the first budget is on credit, a payment is requested halfway
+	if _, err := conn.Write(make([]byte, 49)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-m.Requests():
+		t.Fatal("payment requested early")
+	default:
+	}
+	conn.Write(make([]byte, 51))
+	req := <-m.Requests()
+
+	// throttled until paid
+	written := make(chan error, 1)
+	go func() {
+		_, err := conn.Write([]byte{1})
+		written <- err
+	}()
+	select {
+	case <-written:
+		t.Fatal("write not throttled")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	for i := 0; i < 20; i++ {
+		ticket, err := payer.Pay(req, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := m.Pay(ticket, time.Now()); err != nil {
+			t.Fatal(i, err)
+		}
+		if i == 0 {
+			if err := <-written; err != nil {
+				t.Fatal(err)
+			}
+		}
+		conn.Write(make([]byte, 100))
+		req = <-m.Requests()
+	}
+	if used, paid := m.Used(); used != 2101 || paid != 2100 {
+		t.Fatal(used, paid)
+	}
+	for _, w := range m.Wins() {
+		if win, err := w.Ticket.Wins(w.Secret); !win || err != nil {
+			t.Fatal("not a winning ticket", err)
+		}
+	}
+
+	// a replayed ticket disconnects the peer
+	ticket, _ := payer.Pay(req, time.Now())
+	ticket.Expiry++
+	if _, err := m.Pay(ticket, time.Now()); err != ErrTicketTerms {
+		t.Fatal(err)
+	}
+	<-m.Done()
+	if _, err := conn.Write([]byte{1}); err != ErrTicketTerms {
+		t.Fatal(err)
+	}
+}
+
+func TestMeterTimeout(t *testing.T) {
+	terms := testTerms()
+	terms.Timeout = 10 * time.Millisecond
+	m, err := NewMeter(terms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := m.Conn(&nopConn{})
+	conn.Write(make([]byte, 100))
+	<-m.Requests()
+	if _, err := conn.Read(make([]byte, 1)); err != ErrPaymentTimeout {
+		t.Fatal(err)
+	}
+	if m.Err() != ErrPaymentTimeout {
+		t.Fatal(m.Err())
+	}
+}
+
+func TestPayerPrice(t *testing.T) {
+	source := testAccount(t, "0101010101010101010101010101010101010101010101010101010101010101")
+	now := time.Unix(1000, 0)
+	req := &Request{common.Hash{1}, common.Address{2}, big.NewInt(1 << 20), WinProbability(0.5), 2000, 1 << 20}
+
+	// expected value of 1<<19 per MiB
+	if _, err := NewPayer(source, big.NewInt(1<<19-1), big.NewInt(1<<20)).Pay(req, now); err != ErrPrice {
+		t.Fatal(err)
+	}
+	if _, err := NewPayer(source, big.NewInt(1<<19), big.NewInt(1<<20-1)).Pay(req, now); err != ErrPrice {
+		t.Fatal(err)
+	}
+	ticket, err := NewPayer(source, big.NewInt(1<<19), big.NewInt(1<<20)).Pay(req, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr, err := ticket.Verify(req.Recipient, now); err != nil || addr != source.Address {
+		t.Fatal(addr, err)
+	}
+	if _, err := NewPayer(source, big.NewInt(1<<19), big.NewInt(1<<20)).Pay(req, time.Unix(2000, 0)); err != ErrTerms {
+		t.Fatal(err)
+	}
+}
+
+func TestTabFlood(t *testing.T) {
+	source := testAccount(t, "0101010101010101010101010101010101010101010101010101010101010101")
+	payer := NewPayer(source, big.NewInt(1<<20), big.NewInt(1<<20))
+	req := &Request{common.Hash{1}, common.Address{2}, big.NewInt(1 << 20), WinProbability(0.5), 2000, 1 << 20}
+	now := time.Unix(1000, 0)
+	tab := new(Tab)
+	pay := func() error {
+		err := tab.Charge(req.Budget)
+		if err == nil {
+			_, err = payer.Pay(req, now)
+		}
+		return err
+	}
+
+	// without traffic, only the allowance of one budget is paid
+	if err := pay(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := pay(); err != ErrOverpay {
+			t.Fatal(err)
+		}
+	}
+	if _, paid := tab.Used(); paid != req.Budget {
+		t.Fatal(paid)
+	}
+
+	// bytes carried either way pay for the next budget
+	conn := tab.Conn(new(nopConn))
+	conn.Write(make([]byte, req.Budget/2))
+	conn.Read(make([]byte, req.Budget/2))
+	if err := pay(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pay(); err != ErrOverpay {
+		t.Fatal(err)
+	}
+}
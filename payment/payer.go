@@ -0,0 +1,149 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package payment
+
+import (
+	"errors"
+	"io"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/Gustav-Simonsson/orchid-lib/crypto"
+)
+
+var (
+	ErrPrice   = errors.New("payment request exceeds max price")
+	ErrOverpay = errors.New("payment requests exceed bytes carried")
+)
+
+// Payer pays the payment requests of exits with tickets of Account
+type Payer struct {
+	Account *crypto.Account
+
+	// max expected value paid per MiB
+	MaxPrice *big.Int
+	// max face value of a ticket, bounding the loss when it wins
+	MaxFaceValue *big.Int
+	// max lifetime of a ticket
+	MaxLifetime time.Duration
+}
+
+func NewPayer(account *crypto.Account, maxPrice, maxFaceValue *big.Int) *Payer {
+	return &Payer{account, maxPrice, maxFaceValue, MaxTicketLifetime}
+}
+
+// Pay returns a signed ticket for req unless its terms are
+// unacceptable to p
+func (p *Payer) Pay(req *Request, now time.Time) (*Ticket, error) {
+	if req.Budget == 0 || !validFaceValue(req.FaceValue) {
+		return nil, ErrTerms
+	}
+	expiry := time.Unix(int64(req.Expiry), 0)
+	if !expiry.After(now) || expiry.Sub(now) > p.MaxLifetime {
+		return nil, ErrTerms
+	}
+	if req.FaceValue.Cmp(p.MaxFaceValue) > 0 {
+		return nil, ErrPrice
+	}
+	t, err := NewTicket(req.Commit, req.Recipient, req.FaceValue, req.WinProb, expiry)
+	if err != nil {
+		return nil, err
+	}
+	// expected value / budget <= max price / MiB
+	ev := new(big.Int).Lsh(t.ExpectedValue(), 20)
+	if ev.Cmp(new(big.Int).Mul(p.MaxPrice, new(big.Int).SetUint64(req.Budget))) > 0 {
+		return nil, ErrPrice
+	}
+	err = t.Sign(p.Account)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Tab accounts the bytes an exit carried for a source against the
+// budgets the source paid, so an exit cannot request payment for
+// traffic it did not carry. Budgets are paid as long as they add up to
+// at most the bytes carried plus one budget, the allowance an exit
+// meters ahead (see Meter) and bytes in flight.
+type Tab struct {
+	mutex sync.Mutex
+	used  uint64
+	paid  uint64
+}
+
+func (t *Tab) add(n int) {
+	t.mutex.Lock()
+	t.used += uint64(n)
+	t.mutex.Unlock()
+}
+
+// Used returns the bytes carried and the budgets paid
+func (t *Tab) Used() (used, paid uint64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.used, t.paid
+}
+
+// Charge adds budget to the budgets paid unless it would exceed the
+// bytes carried plus budget
+func (t *Tab) Charge(budget uint64) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.paid+budget < t.paid || t.paid > t.used {
+		return ErrOverpay
+	}
+	t.paid += budget
+	return nil
+}
+
+// Refund takes back a budget charged but not paid
+func (t *Tab) Refund(budget uint64) {
+	t.mutex.Lock()
+	t.paid -= budget
+	t.mutex.Unlock()
+}
+
+// Conn counts the bytes read from and written to rwc on t
+func (t *Tab) Conn(rwc io.ReadWriteCloser) io.ReadWriteCloser {
+	return &tabConn{rwc, t}
+}
+
+type tabConn struct {
+	rwc io.ReadWriteCloser
+	tab *Tab
+}
+
+func (c *tabConn) Read(p []byte) (int, error) {
+	n, err := c.rwc.Read(p)
+	c.tab.add(n)
+	return n, err
+}
+
+func (c *tabConn) Write(p []byte) (int, error) {
+	n, err := c.rwc.Write(p)
+	c.tab.add(n)
+	return n, err
+}
+
+func (c *tabConn) Close() error {
+	return c.rwc.Close()
+}
@@ -0,0 +1,114 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package payment
+
+//go:generate solc --abi --bin --optimize --evm-version paris --overwrite -o ../contracts/build ../contracts/Lottery.sol
+//go:generate abigen --abi ../contracts/build/Lottery.abi --bin ../contracts/build/Lottery.bin --pkg payment --type Lottery --out lottery.go
+
+import (
+	"context"
+	"errors"
+	"math/big"
+
+	"github.com/Gustav-Simonsson/orchid-lib/crypto"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+/* Redemption
+
+   Winning tickets (see Meter.Wins) are redeemed with the Lottery contract
+   (contracts/Lottery.sol, bound in lottery.go), which pays the face value
+   of a ticket from the deposit of its source to its recipient.
+
+   A Redeemer checks a ticket against the chain head before sending the
+   redeem transaction, so tickets that expired or were already redeemed
+   do not cost gas; the contract enforces the same rules.
+*/
+
+var (
+	ErrTicketSpent  = errors.New("ticket already redeemed")
+	ErrTicketLoses  = errors.New("ticket does not win")
+	ErrTicketSigLen = errors.New("invalid ticket signature length")
+)
+
+// Redeemer redeems winning tickets with the Lottery contract at
+// address, paying for the transactions with account
+type Redeemer struct {
+	lottery *Lottery
+	backend bind.ContractBackend
+	opts    *bind.TransactOpts
+}
+
+func NewRedeemer(address common.Address, backend bind.ContractBackend, account *crypto.Account, chainID *big.Int) (*Redeemer, error) {
+	lottery, err := NewLottery(address, backend)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := bind.NewKeyedTransactorWithChainID(account.Key, chainID)
+	if err != nil {
+		return nil, err
+	}
+	return &Redeemer{lottery, backend, opts}, nil
+}
+
+// Spent checks if t has been redeemed
+func (r *Redeemer) Spent(ctx context.Context, t *Ticket) (bool, error) {
+	return r.lottery.Spent(&bind.CallOpts{Context: ctx}, t.Hash())
+}
+
+// Redeem sends the transaction redeeming win, after checking that it
+// wins, has not expired at the chain head and has not been redeemed
+func (r *Redeemer) Redeem(ctx context.Context, win Win) (*types.Transaction, error) {
+	t := win.Ticket
+	if len(t.Sig) != 65 {
+		return nil, ErrTicketSigLen
+	}
+	ok, err := t.Wins(win.Secret)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrTicketLoses
+	}
+	head, err := r.backend.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	// the next block is at least one second later
+	if head.Time+1 >= t.Expiry {
+		return nil, ErrTicketExpired
+	}
+	spent, err := r.Spent(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+	if spent {
+		return nil, ErrTicketSpent
+	}
+
+	var sigR, sigS [32]byte
+	copy(sigR[:], t.Sig[:32])
+	copy(sigS[:], t.Sig[32:64])
+	opts := *r.opts
+	opts.Context = ctx
+	return r.lottery.Redeem(&opts, win.Secret, t.Recipient, t.FaceValue, t.WinProb, t.Nonce, t.Expiry, t.Sig[64], sigR, sigS)
+}
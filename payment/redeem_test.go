@@ -0,0 +1,278 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package payment
+
+import (
+	"context"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Gustav-Simonsson/orchid-lib/crypto"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+)
+
+var ether = big.NewInt(1e18)
+
+type testChain struct {
+	t       *testing.T
+	sim     *simulated.Backend
+	client  simulated.Client
+	chainID *big.Int
+}
+
+func newTestChain(t *testing.T, accounts ...*crypto.Account) *testChain {
+	alloc := types.GenesisAlloc{}
+	for _, a := range accounts {
+		alloc[a.Address] = types.Account{Balance: new(big.Int).Mul(ether, big.NewInt(10))}
+	}
+	sim := simulated.NewBackend(alloc)
+	t.Cleanup(func() { sim.Close() })
+	chainID, err := sim.Client().ChainID(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testChain{t, sim, sim.Client(), chainID}
+}
+
+func (c *testChain) opts(a *crypto.Account) *bind.TransactOpts {
+	opts, err := bind.NewKeyedTransactorWithChainID(a.Key, c.chainID)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return opts
+}
+
+// mine commits tx and returns its receipt status
+func (c *testChain) mine(tx *types.Transaction, err error) uint64 {
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.sim.Commit()
+	receipt, err := bind.WaitMined(context.Background(), c.client, tx)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return receipt.Status
+}
+
+func (c *testChain) now() uint64 {
+	head, err := c.client.HeaderByNumber(context.Background(), nil)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return head.Time
+}
+
+func TestRedeem(t *testing.T) {
+	ctx := context.Background()
+	source := testAccount(t, "0101010101010101010101010101010101010101010101010101010101010101")
+	recipient := testAccount(t, "0202020202020202020202020202020202020202020202020202020202020202")
+	chain := newTestChain(t, source, recipient)
+
+	address, tx, lottery, err := DeployLottery(chain.opts(recipient), chain.client)
+	if chain.mine(tx, err) != types.ReceiptStatusSuccessful {
+		t.Fatal("deploy failed")
+	}
+	opts := chain.opts(source)
+	opts.Value = ether
+	if chain.mine(lottery.Deposit(opts)) != types.ReceiptStatusSuccessful {
+		t.Fatal("deposit failed")
+	}
+
+	redeemer, err := NewRedeemer(address, chain.client, recipient, chain.chainID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := Secret{42}
+	faceValue := new(big.Int).Div(ether, big.NewInt(10))
+	ticket := func(winProb uint64, expiry uint64) Win {
+		tk, err := NewTicket(secret.Commit(), recipient.Address, faceValue, winProb, time.Unix(int64(expiry), 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tk.Sign(source); err != nil {
+			t.Fatal(err)
+		}
+		return Win{tk, secret}
+	}
+
+	// the contract agrees on the ticket hash
+	win := ticket(AlwaysWins, chain.now()+3600)
+	tk := win.Ticket
+	hash, err := lottery.TicketHash(nil, tk.Commit, tk.Recipient, tk.FaceValue, tk.WinProb, tk.Nonce, tk.Expiry)
+	if err != nil || common.Hash(hash) != tk.Hash() {
+		t.Fatal(hash, err)
+	}
+
+	before, _ := chain.client.BalanceAt(ctx, recipient.Address, nil)
+	if chain.mine(redeemer.Redeem(ctx, win)) != types.ReceiptStatusSuccessful {
+		t.Fatal("redeem failed")
+	}
+	if spent, err := redeemer.Spent(ctx, tk); !spent || err != nil {
+		t.Fatal(spent, err)
+	}
+	deposit, _ := lottery.Balances(nil, source.Address)
+	if deposit.Cmp(new(big.Int).Sub(ether, faceValue)) != 0 {
+		t.Fatal(deposit)
+	}
+	after, _ := chain.client.BalanceAt(ctx, recipient.Address, nil)
+	if gain := new(big.Int).Sub(after, before); gain.Sign() <= 0 || gain.Cmp(faceValue) > 0 {
+		t.Fatal("recipient not paid", gain)
+	}
+
+	// redeeming twice is rejected by the redeemer and the contract
+	if _, err := redeemer.Redeem(ctx, win); err != ErrTicketSpent {
+		t.Fatal(err)
+	}
+	if chain.mine(redeemRaw(lottery, chain.opts(recipient), win)) != types.ReceiptStatusFailed {
+		t.Fatal("double spend accepted")
+	}
+
+	// as are expired tickets
+	expired := ticket(AlwaysWins, chain.now()+60)
+	chain.sim.AdjustTime(time.Hour)
+	chain.sim.Commit()
+	if _, err := redeemer.Redeem(ctx, expired); err != ErrTicketExpired {
+		t.Fatal(err)
+	}
+	if chain.mine(redeemRaw(lottery, chain.opts(recipient), expired)) != types.ReceiptStatusFailed {
+		t.Fatal("expired ticket accepted")
+	}
+
+	// and losing tickets
+	if _, err := redeemer.Redeem(ctx, ticket(0, chain.now()+3600)); err != ErrTicketLoses {
+		t.Fatal(err)
+	}
+	if deposit, _ := lottery.Balances(nil, source.Address); deposit.Cmp(new(big.Int).Sub(ether, faceValue)) != 0 {
+		t.Fatal(deposit)
+	}
+
+	// queued wins survive a restart and leave the queue once redeemed
+	path := filepath.Join(t.TempDir(), "wins.json")
+	queue, err := OpenWinQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Add(ticket(AlwaysWins, chain.now()+3600)); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Add(expired); err != nil {
+		t.Fatal(err)
+	}
+	queue, err = OpenWinQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wins := queue.Wins(); len(wins) != 2 || wins[0].Secret != secret || wins[1].Ticket.Hash() != expired.Ticket.Hash() {
+		t.Fatal(wins)
+	}
+	if err := queue.Redeem(ctx, redeemer); err != nil {
+		t.Fatal(err)
+	}
+	chain.sim.Commit()
+	if deposit, _ := lottery.Balances(nil, source.Address); deposit.Cmp(new(big.Int).Sub(ether, new(big.Int).Mul(faceValue, big.NewInt(2)))) != 0 {
+		t.Fatal(deposit)
+	}
+	if queue, err = OpenWinQueue(path); err != nil || len(queue.Wins()) != 0 {
+		t.Fatal(queue.Wins(), err)
+	}
+}
+
+func TestDeposits(t *testing.T) {
+	source := testAccount(t, "0101010101010101010101010101010101010101010101010101010101010101")
+	recipient := testAccount(t, "0202020202020202020202020202020202020202020202020202020202020202")
+	chain := newTestChain(t, source, recipient)
+
+	address, tx, lottery, err := DeployLottery(chain.opts(recipient), chain.client)
+	if chain.mine(tx, err) != types.ReceiptStatusSuccessful {
+		t.Fatal("deploy failed")
+	}
+	opts := chain.opts(source)
+	opts.Value = ether
+	if chain.mine(lottery.Deposit(opts)) != types.ReceiptStatusSuccessful {
+		t.Fatal("deposit failed")
+	}
+	deposits, err := NewDeposits(address, chain.client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	faceValue := new(big.Int).Div(ether, big.NewInt(10))
+	if err := deposits.Check(source.Address, faceValue, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := deposits.Check(source.Address, new(big.Int).Mul(ether, big.NewInt(2)), now); err != ErrDepositBalance {
+		t.Fatal(err)
+	}
+	if err := deposits.Check(recipient.Address, faceValue, now); err != ErrDepositBalance {
+		t.Fatal(err)
+	}
+	if stake, err := deposits.Stake(context.Background(), source.Address); err != nil || stake.Cmp(ether) != 0 {
+		t.Fatal(stake, err)
+	}
+
+	// unlocking is seen once the cached deposit is stale
+	if chain.mine(lottery.Unlock(chain.opts(source))) != types.ReceiptStatusSuccessful {
+		t.Fatal("unlock failed")
+	}
+	if err := deposits.Check(source.Address, faceValue, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := deposits.Check(source.Address, faceValue, now.Add(deposits.CacheAge)); err != ErrDepositUnlocking {
+		t.Fatal(err)
+	}
+	deposits.CacheAge = 0
+	if stake, err := deposits.Stake(context.Background(), source.Address); err != nil || stake.Sign() != 0 {
+		t.Fatal(stake, err)
+	}
+
+	// a meter does not accept tickets of sources without a deposit
+	terms := NewTerms(recipient.Address, faceValue, AlwaysWins)
+	terms.Deposits = deposits
+	m, err := NewMeter(terms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Conn(&nopConn{}).Write(make([]byte, terms.Budget))
+	tk, err := NewPayer(recipient, ether, ether).Pay(<-m.Requests(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Pay(tk, time.Now()); err != ErrDepositBalance {
+		t.Fatal(err)
+	}
+}
+
+// redeemRaw sends a redeem transaction without the checks of Redeemer
+func redeemRaw(lottery *Lottery, opts *bind.TransactOpts, win Win) (*types.Transaction, error) {
+	tk := win.Ticket
+	var sigR, sigS [32]byte
+	copy(sigR[:], tk.Sig[:32])
+	copy(sigS[:], tk.Sig[32:64])
+	// skip gas estimation, which fails for reverting transactions
+	opts.GasLimit = 200000
+	return lottery.Redeem(opts, win.Secret, tk.Recipient, tk.FaceValue, tk.WinProb, tk.Nonce, tk.Expiry, tk.Sig[64], sigR, sigS)
+}
@@ -0,0 +1,212 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package payment implements probabilistic micropayments: lottery
+// tickets paid by sources to the relays and exits they use.
+package payment
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"time"
+
+	crand "crypto/rand"
+
+	"github.com/Gustav-Simonsson/orchid-lib/crypto"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+)
+
+/* Lottery tickets
+
+   Instead of paying every small amount of bandwidth, a source pays with
+   tickets of a large face value that only win with a small probability:
+   the expected value of a ticket is FaceValue * WinProb / 2^64.
+
+   A ticket is won with a secret of the recipient, not chosen by the
+   source, so neither party alone can decide if a ticket wins:
+
+   1. The recipient picks a random Secret and gives its Commit to the source.
+   2. The source issues tickets for the commit with a fresh random nonce
+      each, signs them with its Ethereum account and sends them to the
+      recipient.
+   3. The recipient verifies each ticket and checks if it wins:
+
+        uint64(keccak256(secret || ticket hash)[:8]) < WinProb
+
+      Winning tickets are redeemed on chain by revealing the secret,
+      after which the recipient commits to a new secret.
+
+   The ticket hash, which the source signs as an Ethereum signed message
+   (see crypto.Account.Sign), is
+
+     keccak256("orchid ticket v1" || commit || recipient || face value
+               (32 bytes) || win prob (8) || nonce || expiry (8))
+
+   with integers big endian and expiry in unix seconds.
+*/
+
+const (
+	ticketPrefix = "orchid ticket v1"
+
+	// WinProb of a ticket that always wins
+	AlwaysWins = ^uint64(0)
+)
+
+var (
+	ErrTicketExpired   = errors.New("ticket expired")
+	ErrTicketRecipient = errors.New("ticket for another recipient")
+	ErrTicketValue     = errors.New("invalid ticket face value")
+	ErrTicketSig       = errors.New("invalid ticket signature")
+	ErrTicketCommit    = errors.New("secret does not match ticket commit")
+)
+
+// Secret is the secret of the recipient deciding which tickets win
+type Secret [32]byte
+
+func NewSecret() (Secret, error) {
+	var s Secret
+	_, err := crand.Read(s[:])
+	return s, err
+}
+
+func (s Secret) Commit() common.Hash {
+	return ethcrypto.Keccak256Hash(s[:])
+}
+
+func (s Secret) MarshalText() ([]byte, error) {
+	return hexutil.Bytes(s[:]).MarshalText()
+}
+
+func (s *Secret) UnmarshalText(input []byte) error {
+	return hexutil.UnmarshalFixedText("Secret", input, s[:])
+}
+
+type Ticket struct {
+	Commit    common.Hash    `json:"commit"`
+	Recipient common.Address `json:"recipient"`
+	FaceValue *big.Int       `json:"faceValue"`
+	WinProb   uint64         `json:"winProb"` // out of 2^64
+	Nonce     common.Hash    `json:"nonce"`
+	Expiry    uint64         `json:"expiry"` // unix seconds
+	Sig       hexutil.Bytes  `json:"sig"`
+}
+
+// NewTicket returns an unsigned ticket with a random nonce
+func NewTicket(commit common.Hash, recipient common.Address, faceValue *big.Int, winProb uint64, expiry time.Time) (*Ticket, error) {
+	t := &Ticket{
+		commit,
+		recipient,
+		new(big.Int).Set(faceValue),
+		winProb,
+		common.Hash{},
+		uint64(expiry.Unix()),
+		nil,
+	}
+	_, err := crand.Read(t.Nonce[:])
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// WinProbability returns the WinProb of probability p in [0, 1]
+func WinProbability(p float64) uint64 {
+	switch {
+	case p <= 0:
+		return 0
+	case p >= 1:
+		return AlwaysWins
+	}
+	f, _ := new(big.Float).Mul(big.NewFloat(p), new(big.Float).SetInt(two64)).Uint64()
+	return f
+}
+
+var two64 = new(big.Int).Lsh(big.NewInt(1), 64)
+
+// ExpectedValue is the face value times the win probability
+func (t *Ticket) ExpectedValue() *big.Int {
+	v := new(big.Int).Mul(t.FaceValue, new(big.Int).SetUint64(t.WinProb))
+	return v.Div(v, two64)
+}
+
+func (t *Ticket) Hash() common.Hash {
+	b := make([]byte, 0, len(ticketPrefix)+32+common.AddressLength+32+8+32+8)
+	b = append(b, ticketPrefix...)
+	b = append(b, t.Commit[:]...)
+	b = append(b, t.Recipient[:]...)
+	b = append(b, common.LeftPadBytes(t.FaceValue.Bytes(), 32)...)
+	b = binary.BigEndian.AppendUint64(b, t.WinProb)
+	b = append(b, t.Nonce[:]...)
+	b = binary.BigEndian.AppendUint64(b, t.Expiry)
+	return ethcrypto.Keccak256Hash(b)
+}
+
+// Sign signs t by the account of the source
+func (t *Ticket) Sign(source *crypto.Account) error {
+	if !validFaceValue(t.FaceValue) {
+		return ErrTicketValue
+	}
+	sig, err := source.Sign(t.Hash().Bytes())
+	if err != nil {
+		return err
+	}
+	t.Sig = sig
+	return nil
+}
+
+// Signer returns the address of the account that signed t
+func (t *Ticket) Signer() (common.Address, error) {
+	if !validFaceValue(t.FaceValue) {
+		return common.Address{}, ErrTicketValue
+	}
+	addr, err := crypto.RecoverAddress(t.Hash().Bytes(), t.Sig)
+	if err != nil {
+		return common.Address{}, ErrTicketSig
+	}
+	return addr, nil
+}
+
+// Verify checks that t is for recipient, has not expired at now and is
+// signed, and returns the address of the source paying it
+func (t *Ticket) Verify(recipient common.Address, now time.Time) (common.Address, error) {
+	if t.Recipient != recipient {
+		return common.Address{}, ErrTicketRecipient
+	}
+	if uint64(now.Unix()) >= t.Expiry {
+		return common.Address{}, ErrTicketExpired
+	}
+	return t.Signer()
+}
+
+// Wins checks if t wins with secret, the secret of the commit of t
+func (t *Ticket) Wins(secret Secret) (bool, error) {
+	if secret.Commit() != t.Commit {
+		return false, ErrTicketCommit
+	}
+	h := t.Hash()
+	r := ethcrypto.Keccak256(secret[:], h[:])
+	return binary.BigEndian.Uint64(r[:8]) < t.WinProb || t.WinProb == AlwaysWins, nil
+}
+
+func validFaceValue(v *big.Int) bool {
+	return v != nil && v.Sign() > 0 && v.BitLen() <= 256
+}
@@ -0,0 +1,117 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package payment
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/Gustav-Simonsson/orchid-lib/crypto"
+	"github.com/ethereum/go-ethereum/common"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+)
+
+func testAccount(t *testing.T, hex string) *crypto.Account {
+	key, err := ethcrypto.HexToECDSA(hex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &crypto.Account{Key: key, Address: ethcrypto.PubkeyToAddress(key.PublicKey)}
+}
+
+func testTicket(t *testing.T, source *crypto.Account, secret Secret, recipient common.Address, nonce byte) *Ticket {
+	tk := &Ticket{
+		secret.Commit(),
+		recipient,
+		big.NewInt(1e15),
+		WinProbability(0.25),
+		common.Hash{nonce},
+		1000,
+		nil,
+	}
+	if err := tk.Sign(source); err != nil {
+		t.Fatal(err)
+	}
+	return tk
+}
+
+func TestTicket(t *testing.T) {
+	source := testAccount(t, "0101010101010101010101010101010101010101010101010101010101010101")
+	recipient := testAccount(t, "0202020202020202020202020202020202020202020202020202020202020202").Address
+	secret := Secret{42}
+
+	tk := testTicket(t, source, secret, recipient, 1)
+	addr, err := tk.Verify(recipient, time.Unix(999, 0))
+	if err != nil || addr != source.Address {
+		t.Fatal(addr, err)
+	}
+	if _, err := tk.Verify(source.Address, time.Unix(999, 0)); err != ErrTicketRecipient {
+		t.Fatal(err)
+	}
+	if _, err := tk.Verify(recipient, time.Unix(1000, 0)); err != ErrTicketExpired {
+		t.Fatal(err)
+	}
+	if _, err := tk.Wins(Secret{43}); err != ErrTicketCommit {
+		t.Fatal(err)
+	}
+
+	// tampering with any field changes the signer
+	tk.FaceValue = big.NewInt(2e15)
+	if addr, err := tk.Verify(recipient, time.Unix(999, 0)); err == nil && addr == source.Address {
+		t.Fatal("tampered ticket verified")
+	}
+
+	if ev := testTicket(t, source, secret, recipient, 1).ExpectedValue(); ev.Cmp(big.NewInt(25e13)) != 0 {
+		t.Fatal(ev)
+	}
+}
+
+func TestTicketWins(t *testing.T) {
+	source := testAccount(t, "0101010101010101010101010101010101010101010101010101010101010101")
+	recipient := common.Address{2}
+	secret := Secret{42}
+
+	// deterministic: the same tickets win in every run
+	const n = 200
+	wins := 0
+	for i := 0; i < n; i++ {
+		w, err := testTicket(t, source, secret, recipient, byte(i)).Wins(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w {
+			wins++
+		}
+	}
+	if wins < n/8 || wins > n*3/8 {
+		t.Fatalf("%d of %d tickets won with probability 0.25", wins, n)
+	}
+
+	tk := testTicket(t, source, secret, recipient, 0)
+	tk.WinProb = 0
+	if w, _ := tk.Wins(secret); w {
+		t.Fatal("ticket won with probability 0")
+	}
+	tk.WinProb = AlwaysWins
+	if w, _ := tk.Wins(secret); !w {
+		t.Fatal("ticket lost with probability 1")
+	}
+}
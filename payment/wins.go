@@ -0,0 +1,123 @@
+/*  orchid-lib  golang packages for the Orchid protocol.
+    Copyright (C) 2018  Gustav Simonsson
+
+    This file is part of orchid-lib.
+
+    orchid-lib is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    orchid-lib is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package payment
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+/* Win queue
+
+   A meter only lives as long as the connection of its peer, so an exit
+   hands each winning ticket to a WinQueue, which saves it to a file
+   before anything else happens to it. Wins stay queued until they are
+   redeemed (see Redeemer), or can no longer be: redeemed by someone
+   else, expired, or not winning after all.
+*/
+
+// WinQueue is a queue of winning tickets saved to a file
+type WinQueue struct {
+	mutex sync.Mutex
+	path  string
+	wins  []Win
+}
+
+// OpenWinQueue returns the queue saved at path, or a new one if there
+// is none yet
+func OpenWinQueue(path string) (*WinQueue, error) {
+	q := &WinQueue{path: path}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &q.wins)
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// Add queues win and saves the queue
+func (q *WinQueue) Add(win Win) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.wins = append(q.wins, win)
+	return q.save()
+}
+
+// Wins returns a copy of the queued wins
+func (q *WinQueue) Wins() []Win {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return append([]Win{}, q.wins...)
+}
+
+// Redeem redeems the queued wins with r and removes those redeemed or
+// that cannot be redeemed anymore. Wins failing otherwise, e.g. when
+// the backend is unreachable, stay queued for the next call, which
+// returns the last such error.
+func (q *WinQueue) Redeem(ctx context.Context, r *Redeemer) error {
+	var last error
+	done := make(map[*Ticket]bool)
+	for _, win := range q.Wins() {
+		_, err := r.Redeem(ctx, win)
+		switch err {
+		case nil, ErrTicketSpent, ErrTicketExpired, ErrTicketLoses, ErrTicketSigLen, ErrTicketCommit:
+			done[win.Ticket] = true
+		default:
+			last = err
+		}
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	wins := q.wins[:0]
+	for _, win := range q.wins {
+		if !done[win.Ticket] {
+			wins = append(wins, win)
+		}
+	}
+	q.wins = wins
+	err := q.save()
+	if err != nil {
+		return err
+	}
+	return last
+}
+
+func (q *WinQueue) save() error {
+	b, err := json.MarshalIndent(q.wins, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := q.path + ".tmp"
+	err = os.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Clean(q.path))
+}
@@ -23,11 +23,14 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/Gustav-Simonsson/orchid-lib/crypto"
 	"github.com/Gustav-Simonsson/orchid-lib/node"
 	"github.com/Gustav-Simonsson/socks"
 	"github.com/ethereum/go-ethereum/log"
@@ -45,88 +48,139 @@ func TestMain(m *testing.M) {
 
 }
 
-func TestNodeOneConn(t *testing.T) {
-	// Setup simple test source & exit 	omain.SimpleSource()
-	go node.SimpleExit()
-	go node.SimpleSource()
-	time.Sleep(400 * time.Millisecond)
-	log.Debug("Node Test after node setup")
+// serve runs a node for the rest of the test binary, failing t if it
+// stops within wait, such as when its ports are taken
+func serve(t *testing.T, wait time.Duration, listenAndServe func() error) {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- listenAndServe()
+	}()
+	select {
+	case err := <-errc:
+		t.Fatal(err)
+	case <-time.After(wait):
+	}
+}
 
-	// setup test HTTP server to act as external website
-	http.HandleFunc("/orchid-node-test/", func(w http.ResponseWriter, r *http.Request) {
+// website acts as an external website reached through the nodes
+func website(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "test resp %v", 1)
-	})
-	go http.ListenAndServe(":3300", nil)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
 
+// get fetches url through the source proxying on port
+func get(port int, url string) error {
 	// Configure SOCKS5 Dialer to proxy the test HTTP requests through
-	dialSocksProxy := socks.DialSocksProxy(socks.SOCKS5, "127.0.0.1:"+strconv.Itoa(node.SourceTCPPort))
+	dialSocksProxy := socks.DialSocksProxy(socks.SOCKS5, "127.0.0.1:"+strconv.Itoa(port))
 
 	tr := &http.Transport{Dial: dialSocksProxy}
+	defer tr.CloseIdleConnections()
 	httpClient := &http.Client{Transport: tr}
 
-	resp, err := httpClient.Get("http://127.0.0.1:3300/orchid-node-test/")
+	resp, err := httpClient.Get(url)
 	if err != nil {
-		t.Fatal(err)
+		return err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		t.Fatal(resp.StatusCode)
+		return fmt.Errorf("status %d", resp.StatusCode)
 	}
 	buf, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		t.Fatal(err)
+		return err
 	}
 	if string(buf) != "test resp 1" {
-		t.Fatal("buf mismatch, got: ", string(buf))
+		return fmt.Errorf("buf mismatch, got: %s", buf)
 	}
+	return nil
+}
 
-	tr.CloseIdleConnections()
+// exit starts an exit with signaling on port and its SOCKS5 proxy on
+// port+1
+func exit(t *testing.T, port int) node.Hop {
+	exitKey, err := crypto.NewNodeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exit := node.NewExit(crypto.NewKeySet(exitKey), nil, nil)
+	exit.SOCKSPort = port + 1
+	serve(t, 100*time.Millisecond, func() error {
+		return exit.ListenAndServe(port)
+	})
+	return node.Hop{URL: node.LocalURL(port), Pub: exitKey.Pub}
+}
+
+func TestNodeOneConn(t *testing.T) {
+	// each test has its own ports, as nodes run until the binary exits
+	const sourcePort, exitPort = 3210, 3211
+
+	hop := exit(t, exitPort)
+	serve(t, 400*time.Millisecond, func() error {
+		return (&node.Source{Port: sourcePort}).Serve(hop)
+	})
+	log.Debug("Node Test after node setup")
+
+	err := get(sourcePort, website(t).URL+"/orchid-node-test/")
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	time.Sleep(200 * time.Millisecond)
 }
 
 func TestNodeConcurrentConns(t *testing.T) {
-	// Setup simple test source & exit 	omain.SimpleSource()
-	go node.SimpleExit()
-	go node.SimpleSource()
-	time.Sleep(400 * time.Millisecond)
-	log.Debug("Node Test after node setup")
+	const sourcePort, exitPort = 3220, 3221
 
-	// setup test HTTP server to act as external website
-	http.HandleFunc("/orchid-node-test/", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "test resp %v", 1)
+	hop := exit(t, exitPort)
+	serve(t, 400*time.Millisecond, func() error {
+		return (&node.Source{Port: sourcePort}).Serve(hop)
 	})
-	go http.ListenAndServe(":3300", nil)
+	log.Debug("Node Test after node setup")
 
+	url := website(t).URL + "/orchid-node-test/"
+	var wg sync.WaitGroup
 	for i := 0; i < 4; i++ {
-		go func(t *testing.T, i int) {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
 			log.Debug("TEST FUNC A", "i", i)
-			// Configure SOCKS5 Dialer to proxy the test HTTP requests through
-			dialSocksProxy := socks.DialSocksProxy(socks.SOCKS5, "127.0.0.1:"+strconv.Itoa(node.SourceTCPPort))
-
-			tr := &http.Transport{Dial: dialSocksProxy}
-			httpClient := &http.Client{Transport: tr}
-
-			resp, err := httpClient.Get("http://127.0.0.1:3300/orchid-node-test/")
+			err := get(sourcePort, url)
 			log.Debug("TEST FUNC B", "i", i)
 			if err != nil {
-				t.Fatal(err)
-			}
-			defer resp.Body.Close()
-			if resp.StatusCode != http.StatusOK {
-				t.Fatal(resp.StatusCode)
-			}
-			buf, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				t.Fatal(err)
-			}
-			if string(buf) != "test resp 1" {
-				t.Fatal("buf mismatch, got: ", string(buf))
+				t.Error(err)
 			}
+		}(i)
+	}
+	wg.Wait()
+}
 
-			tr.CloseIdleConnections()
-		}(t, i)
+func TestNodeCircuitOneConn(t *testing.T) {
+	// Setup test source -> relay -> exit circuit
+	const sourcePort, exitPort, relayPort = 3230, 3231, 3233
+
+	exitHop := exit(t, exitPort)
+	relayKey, err := crypto.NewNodeKey()
+	if err != nil {
+		t.Fatal(err)
 	}
+	relay := node.NewRelay(crypto.NewKeySet(relayKey), nil)
+	relay.PrivateHops = true // the exit is on localhost
+	serve(t, 100*time.Millisecond, func() error {
+		return relay.ListenAndServe(relayPort)
+	})
+	relayHop := node.Hop{URL: node.LocalURL(relayPort), Pub: relayKey.Pub}
+	serve(t, 600*time.Millisecond, func() error {
+		return (&node.Source{Port: sourcePort}).Serve(relayHop, exitHop)
+	})
+	log.Debug("Node Test after node setup")
 
-	time.Sleep(1200 * time.Millisecond)
+	err = get(sourcePort, website(t).URL+"/orchid-relay-test/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
 }